@@ -0,0 +1,71 @@
+package otgrpc
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// BaggageKey is the type of the context.Context keys under which the server
+// interceptors store the baggage items selected with WithBaggageToContext.
+type BaggageKey string
+
+// BaggageValue returns the value of the baggage item named key that the
+// server interceptors stored in ctx, or "" if there is none.
+func BaggageValue(ctx context.Context, key string) string {
+	val, _ := ctx.Value(BaggageKey(key)).(string)
+	return val
+}
+
+// contextWithBaggage returns a copy of ctx holding the value of each of the
+// given baggage items of span.
+func contextWithBaggage(ctx context.Context, span opentracing.Span, keys []string) context.Context {
+	for _, key := range keys {
+		if val := span.BaggageItem(key); val != "" {
+			ctx = context.WithValue(ctx, BaggageKey(key), val)
+		}
+	}
+	return ctx
+}
+
+// baggageToMetadata returns a copy of ctx whose outgoing gRPC metadata holds
+// the baggage items of span named in mapping under the mapped header names.
+// Headers already set are kept unless overwrite is set.
+func baggageToMetadata(ctx context.Context, span opentracing.Span, mapping map[string]string, overwrite bool) context.Context {
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+	var md metadata.MD
+	for item, key := range mapping {
+		val := span.BaggageItem(item)
+		if val == "" || !overwrite && len(outgoing[key]) > 0 {
+			continue
+		}
+		if md == nil {
+			md = outgoing.Copy()
+		}
+		md[key] = []string{val}
+	}
+	if md == nil {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// metadataToBaggage sets baggage items on span from the headers named in
+// mapping of the metadata attached to ctx with NewContext, or else of its
+// incoming gRPC metadata. Baggage items already set are kept unless
+// overwrite is set.
+func metadataToBaggage(span opentracing.Span, ctx context.Context, mapping map[string]string, overwrite bool) {
+	md, _ := FromContext(ctx)
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	for key, item := range mapping {
+		if !overwrite && span.BaggageItem(item) != "" {
+			continue
+		}
+		for _, md := range []metadata.MD{md, incoming} {
+			if vals := metadataValues(md, key); len(vals) > 0 {
+				span.SetBaggageItem(item, vals[0])
+				break
+			}
+		}
+	}
+}
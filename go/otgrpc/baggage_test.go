@@ -0,0 +1,110 @@
+package otgrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestBaggageToContext(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("user-id", "42")
+	parent.SetBaggageItem("other", "ignored")
+	ctx, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+
+	opt := WithBaggageToContext([]string{"user-id", "missing"})
+	interceptor := OpenTracingServerInterceptor(tracer, opt)
+	_, err = interceptor(ctx, nil, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Equal(t, "42", BaggageValue(ctx, "user-id"))
+		assert.Equal(t, "", BaggageValue(ctx, "other"))
+		assert.Equal(t, "", BaggageValue(ctx, "missing"))
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer, opt)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: ctx}, streamInfo, func(srv interface{}, ss grpc.ServerStream) error {
+		assert.Equal(t, "42", BaggageValue(ss.Context(), "user-id"))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBaggageMetadataRoundTrip(t *testing.T) {
+	tracer := mocktracer.New()
+	var headers []string
+	var baggage []string
+	// The server cannot extract the HTTPHeaders SpanContext of the client, so
+	// the baggage can only come from the plain header.
+	lis := serveBufconn(t,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			md, _ := metadata.FromIncomingContext(ss.Context())
+			headers = append(headers, md.Get("x-tenant-id")...)
+			baggage = append(baggage, opentracing.SpanFromContext(ss.Context()).BaggageItem("tenant-id"))
+			if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			return ss.SendMsg(&emptypb.Empty{})
+		},
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer,
+			WithPropagationFormat(opentracing.Binary),
+			WithMetadataToBaggage(map[string]string{"X-Tenant-ID": "tenant-id"})))})
+	cc := dialBufconn(t, lis,
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer,
+			WithBaggageToMetadata(map[string]string{"tenant-id": "X-Tenant-ID"}))))
+
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("tenant-id", "acme")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	assert.NoError(t, cc.Invoke(ctx, "/pkg.Service/Method", &emptypb.Empty{}, &emptypb.Empty{}))
+	// Headers set by the application are kept.
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant-id", "globex")
+	assert.NoError(t, cc.Invoke(ctx, "/pkg.Service/Method", &emptypb.Empty{}, &emptypb.Empty{}))
+
+	assert.Equal(t, []string{"acme", "globex"}, headers)
+	assert.Equal(t, []string{"acme", "globex"}, baggage)
+}
+
+func TestBaggageMetadataOverwrite(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("tenant-id", "acme")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-tenant-id", "globex")
+
+	var headers []string
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		headers = append(headers, md.Get("x-tenant-id")...)
+		return nil
+	}
+	mapping := WithBaggageToMetadata(map[string]string{"tenant-id": "x-tenant-id"})
+	assert.NoError(t, OpenTracingClientInterceptor(tracer, mapping)(ctx, "/pkg.Service/Method", nil, nil, nil, invoker))
+	assert.NoError(t, OpenTracingClientInterceptor(tracer, mapping, OverwriteBaggageMetadata())(ctx, "/pkg.Service/Method", nil, nil, nil, invoker))
+	assert.Equal(t, []string{"globex", "acme"}, headers)
+
+	// On the server, baggage items of the client are kept unless overwritten.
+	serverCtx, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+	serverCtx = metadata.NewIncomingContext(serverCtx, metadata.Pairs("x-tenant-id", "globex"))
+	var baggage []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		baggage = append(baggage, opentracing.SpanFromContext(ctx).BaggageItem("tenant-id"))
+		return nil, nil
+	}
+	reverse := WithMetadataToBaggage(map[string]string{"x-tenant-id": "tenant-id"})
+	_, err = OpenTracingServerInterceptor(tracer, reverse)(serverCtx, nil, unaryInfo, handler)
+	assert.NoError(t, err)
+	_, err = OpenTracingServerInterceptor(tracer, reverse, OverwriteBaggageMetadata())(serverCtx, nil, unaryInfo, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"acme", "globex"}, baggage)
+}
@@ -0,0 +1,47 @@
+package otgrpc
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+)
+
+// ServerOptions returns the grpc.ServerOptions installing both the unary and
+// the stream OpenTracing server interceptors, configured alike from optFuncs.
+// The interceptors are chained after any other interceptor of the server.
+//
+// For example:
+//
+//	s := grpc.NewServer(otgrpc.ServerOptions(tracer, otgrpc.LogPayloads())...)
+func ServerOptions(tracer opentracing.Tracer, optFuncs ...Option) []grpc.ServerOption {
+	unary, stream := NewServerInterceptors(tracer, optFuncs...)
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// NewServerInterceptors returns both the unary and the stream OpenTracing
+// server interceptors, configured alike from optFuncs, for servers that need
+// to place them among other interceptors by hand. Most servers can use
+// ServerOptions instead.
+func NewServerInterceptors(tracer opentracing.Tracer, optFuncs ...Option) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.apply(optFuncs...)
+	return openTracingServerInterceptor(tracer, otgrpcOpts), openTracingStreamServerInterceptor(tracer, otgrpcOpts)
+}
+
+// DialOptions returns the grpc.DialOptions installing both the unary and the
+// stream OpenTracing client interceptors, configured alike from optFuncs. The
+// interceptors are chained after any other interceptor of the connection.
+//
+// For example:
+//
+//	conn, err := grpc.Dial(address, otgrpc.DialOptions(tracer, otgrpc.LogPayloads())...)
+func DialOptions(tracer opentracing.Tracer, optFuncs ...Option) []grpc.DialOption {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.apply(optFuncs...)
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(openTracingClientInterceptor(tracer, otgrpcOpts)),
+		grpc.WithChainStreamInterceptor(openTracingStreamClientInterceptor(tracer, otgrpcOpts)),
+	}
+}
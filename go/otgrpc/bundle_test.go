@@ -0,0 +1,106 @@
+package otgrpc
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestServerAndDialOptions(t *testing.T) {
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(ServerOptions(tracer)...)
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "pkg.Service",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Unary",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &emptypb.Empty{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/pkg.Service/Unary"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return &emptypb.Empty{}, nil
+				})
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName: "Stream",
+			Handler: func(srv interface{}, ss grpc.ServerStream) error {
+				if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+					return err
+				}
+				return ss.SendMsg(&emptypb.Empty{})
+			},
+			ServerStreams: true,
+		}},
+	}, struct{}{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	dialOpts := append(DialOptions(tracer), grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	cc, err := grpc.Dial("bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+
+	err = cc.Invoke(context.Background(), "/pkg.Service/Unary", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.NoError(t, err)
+	cs, err := cc.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true}, "/pkg.Service/Stream")
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(&emptypb.Empty{}))
+	assert.NoError(t, cs.CloseSend())
+	assert.NoError(t, cs.RecvMsg(&emptypb.Empty{}))
+	assert.Equal(t, io.EOF, cs.RecvMsg(&emptypb.Empty{}))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, expected := range []struct {
+		name string
+		kind ext.SpanKindEnum
+	}{
+		{"/pkg.Service/Unary", ext.SpanKindRPCServerEnum},
+		{"/pkg.Service/Unary", ext.SpanKindRPCClientEnum},
+		{"/pkg.Service/Stream", ext.SpanKindRPCServerEnum},
+		{"/pkg.Service/Stream", ext.SpanKindRPCClientEnum},
+	} {
+		assert.Equal(t, expected.name, spans[i].OperationName)
+		assert.Equal(t, expected.kind, spans[i].Tag("span.kind"))
+	}
+}
+
+func TestNewServerInterceptors(t *testing.T) {
+	tracer := mocktracer.New()
+	unary, stream := NewServerInterceptors(tracer, WithOperationNameFunc(func(fullMethod string) string {
+		return "renamed"
+	}))
+	_, err := unary(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = stream(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "renamed", span.OperationName)
+	}
+}
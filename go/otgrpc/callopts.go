@@ -0,0 +1,60 @@
+package otgrpc
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+)
+
+// noTraceCallOption is the grpc.CallOption returned by NoTrace.
+type noTraceCallOption struct {
+	grpc.EmptyCallOption
+}
+
+// NoTrace returns a grpc.CallOption that keeps the OpenTracing client
+// interceptors from tracing the call it is passed to: no span is started and
+// no SpanContext is injected. This is useful for the RPCs of a span exporter,
+// whose tracing would recurse. For example:
+//
+//	err := conn.Invoke(ctx, method, req, resp, otgrpc.NoTrace())
+func NoTrace() grpc.CallOption {
+	return noTraceCallOption{}
+}
+
+// hasNoTrace reports whether opts contain the grpc.CallOption of NoTrace.
+func hasNoTrace(opts []grpc.CallOption) bool {
+	for _, opt := range opts {
+		if _, ok := opt.(noTraceCallOption); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// spanTagsCallOption is the grpc.CallOption returned by WithSpanTags.
+type spanTagsCallOption struct {
+	grpc.EmptyCallOption
+	tags opentracing.Tags
+}
+
+// WithSpanTags returns a grpc.CallOption that sets tags on the client span of
+// the call it is passed to, e.g. request-scoped tenant or shard tags. Tags of
+// several WithSpanTags of a call are merged, the later ones winning. For
+// example:
+//
+//	err := conn.Invoke(ctx, method, req, resp,
+//		otgrpc.WithSpanTags(opentracing.Tags{"tenant": tenant}))
+func WithSpanTags(tags opentracing.Tags) grpc.CallOption {
+	return spanTagsCallOption{tags: tags}
+}
+
+// setCallSpanTags sets on clientSpan the tags of the WithSpanTags among opts,
+// in order.
+func setCallSpanTags(clientSpan opentracing.Span, opts []grpc.CallOption) {
+	for _, opt := range opts {
+		if tagsOpt, ok := opt.(spanTagsCallOption); ok {
+			for k, v := range tagsOpt.tags {
+				clientSpan.SetTag(k, v)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package otgrpc
 
 import (
+	"bytes"
 	"encoding/base64"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -9,9 +10,12 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"io"
+	"net"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // OpenTracingClientInterceptor returns a grpc.UnaryClientInterceptor suitable
@@ -28,9 +32,28 @@ import (
 // metadata; they will also look in the context.Context for an active
 // in-process parent Span and establish a ChildOf reference if such a parent
 // Span could be found.
+//
+// If tracer is nil or an opentracing.NoopTracer, the interceptor only calls
+// the invoker, at no per-call cost.
 func OpenTracingClientInterceptor(tracer opentracing.Tracer, optFuncs ...Option) grpc.UnaryClientInterceptor {
 	otgrpcOpts := newOptions()
 	otgrpcOpts.apply(optFuncs...)
+	return openTracingClientInterceptor(tracer, otgrpcOpts)
+}
+
+func openTracingClientInterceptor(tracer opentracing.Tracer, otgrpcOpts *options) grpc.UnaryClientInterceptor {
+	if isNoopTracer(tracer) && !otgrpcOpts.hasCallWork() {
+		return func(
+			ctx context.Context,
+			method string,
+			req, resp interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}
+	}
 	return func(
 		ctx context.Context,
 		method string,
@@ -39,40 +62,98 @@ func OpenTracingClientInterceptor(tracer opentracing.Tracer, optFuncs ...Option)
 		invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption,
 	) error {
+		if otgrpcOpts.tracingDisabled() || hasNoTrace(opts) {
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}
+		start := time.Now()
+		otgrpcOpts := otgrpcOpts.forMethod(method)
+		tracer := otgrpcOpts.callTracer(ctx, tracer, method)
 		var err error
 		var parentCtx opentracing.SpanContext
 		if parent := opentracing.SpanFromContext(ctx); parent != nil {
 			parentCtx = parent.Context()
 		}
-		if otgrpcOpts.inclusionFunc != nil &&
-			!otgrpcOpts.inclusionFunc(parentCtx, method, req, resp) {
-			return invoker(ctx, method, req, resp, cc, opts...)
+		var preserveHeaders bool
+		if otgrpcOpts.preserveTraceHeaders {
+			if sc := existingSpanContext(ctx, tracer, otgrpcOpts.propagationFormat); sc != nil {
+				parentCtx, preserveHeaders = sc, true
+			}
 		}
-		clientSpan := StartSpanFactory(
+		if unsampled := otgrpcOpts.unsampledParent(parentCtx); unsampled ||
+			!otgrpcOpts.include(parentCtx, method, req, resp, nil) {
+			if unsampled && !preserveHeaders {
+				ctx = injectUnsampledParent(ctx, tracer, parentCtx, method, otgrpcOpts)
+			}
+			err = invoker(ctx, method, req, resp, cc, opts...)
+			if otgrpcOpts.observeExcluded {
+				otgrpcOpts.observeMetrics(method, err, start, false)
+			}
+			return err
+		}
+		clientSpan := otgrpcOpts.startRPCSpan(
 			parentCtx,
 			tracer,
-			method,
-			opentracing.ChildOf(parentCtx),
+			otgrpcOpts.operationName(method),
+			clientSpanReference(parentCtx, otgrpcOpts),
 			ext.SpanKindRPCClient,
-			gRPCComponentTag,
+			otgrpcOpts.componentTag(),
 		)
+		otgrpcOpts.setStaticTags(clientSpan)
+		setCallSpanTags(clientSpan, opts)
 		defer clientSpan.Finish()
-		ctx = injectSpanContext(ctx, tracer, clientSpan, otgrpcOpts)
-		if otgrpcOpts.logPayloads {
-			clientSpan.LogFields(log.Object("gRPC request", req))
+		defer func() { otgrpcOpts.observeMetrics(method, err, start, false) }()
+		if otgrpcOpts.tagTarget {
+			setTargetTags(clientSpan, cc)
+		}
+		if otgrpcOpts.tagServiceMethod {
+			setServiceMethodTags(clientSpan, method)
+		}
+		otgrpcOpts.tagFromRequest(clientSpan, method, req)
+		if len(otgrpcOpts.metadataTags) > 0 {
+			setClientMetadataTags(clientSpan, ctx, otgrpcOpts.metadataTags)
+		}
+		otgrpcOpts.setSpanTagsFromFunc(ctx, clientSpan, method, req)
+		if len(otgrpcOpts.baggageToMetadata) > 0 {
+			ctx = baggageToMetadata(ctx, clientSpan, otgrpcOpts.baggageToMetadata, otgrpcOpts.overwriteBaggageMetadata)
+		}
+		if !preserveHeaders {
+			ctx = injectSpanContext(ctx, tracer, clientSpan, method, otgrpcOpts)
+		}
+		if otgrpcOpts.retryAttemptSpans {
+			ctx = withCallAttempts(ctx, tracer, otgrpcOpts, clientSpan, method)
+		}
+		if otgrpcOpts.clientTimingTags {
+			ctx = withCallTiming(ctx, clientSpan, start)
+		}
+		if otgrpcOpts.logRequests {
+			logPayload(clientSpan, method, RequestPayload, req, otgrpcOpts)
+		}
+		if otgrpcOpts.messageSizeTags {
+			setMessageSizeTag(clientSpan, "grpc.request.size", req)
 		}
 		err = invoker(ctx, method, req, resp, cc, opts...)
+		if otgrpcOpts.clientTimingTags {
+			setTotalTag(clientSpan, start)
+		}
+		setCodeTag(clientSpan, err)
 		if err == nil {
-			if otgrpcOpts.logPayloads {
-				clientSpan.LogFields(log.Object("gRPC response", resp))
+			if otgrpcOpts.logResponses {
+				logPayload(clientSpan, method, ResponsePayload, resp, otgrpcOpts)
+			}
+			if otgrpcOpts.messageSizeTags {
+				setMessageSizeTag(clientSpan, "grpc.response.size", resp)
 			}
 		} else if otgrpcOpts.logError {
-			SetSpanTags(clientSpan, err, true)
+			setErrorTags(clientSpan, err, true, otgrpcOpts)
 			clientSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
 		}
-		if otgrpcOpts.decorator != nil {
-			otgrpcOpts.decorator(ctx, clientSpan, method, req, resp, err)
+		if otgrpcOpts.logPayloadsOnFailure(err) {
+			logPayload(clientSpan, method, RequestPayload, req, otgrpcOpts)
+			if resp != nil {
+				logPayload(clientSpan, method, ResponsePayload, resp, otgrpcOpts)
+			}
 		}
+		otgrpcOpts.decorate(ctx, clientSpan, method, req, resp, err)
 		return err
 	}
 }
@@ -95,6 +176,22 @@ func OpenTracingClientInterceptor(tracer opentracing.Tracer, optFuncs ...Option)
 func OpenTracingStreamClientInterceptor(tracer opentracing.Tracer, optFuncs ...Option) grpc.StreamClientInterceptor {
 	otgrpcOpts := newOptions()
 	otgrpcOpts.apply(optFuncs...)
+	return openTracingStreamClientInterceptor(tracer, otgrpcOpts)
+}
+
+func openTracingStreamClientInterceptor(tracer opentracing.Tracer, otgrpcOpts *options) grpc.StreamClientInterceptor {
+	if isNoopTracer(tracer) && !otgrpcOpts.hasCallWork() {
+		return func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			method string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+	}
 	return func(
 		ctx context.Context,
 		desc *grpc.StreamDesc,
@@ -103,41 +200,101 @@ func OpenTracingStreamClientInterceptor(tracer opentracing.Tracer, optFuncs ...O
 		streamer grpc.Streamer,
 		opts ...grpc.CallOption,
 	) (grpc.ClientStream, error) {
+		if otgrpcOpts.tracingDisabled() || hasNoTrace(opts) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		start := time.Now()
+		otgrpcOpts := otgrpcOpts.forMethod(method)
+		tracer := otgrpcOpts.callTracer(ctx, tracer, method)
 		var err error
 		var parentCtx opentracing.SpanContext
 		if parent := opentracing.SpanFromContext(ctx); parent != nil {
 			parentCtx = parent.Context()
 		}
-		if otgrpcOpts.inclusionFunc != nil &&
-			!otgrpcOpts.inclusionFunc(parentCtx, method, nil, nil) {
-			return streamer(ctx, desc, cc, method, opts...)
+		var preserveHeaders bool
+		if otgrpcOpts.preserveTraceHeaders {
+			if sc := existingSpanContext(ctx, tracer, otgrpcOpts.propagationFormat); sc != nil {
+				parentCtx, preserveHeaders = sc, true
+			}
+		}
+		if unsampled := otgrpcOpts.unsampledParent(parentCtx); unsampled ||
+			!otgrpcOpts.include(parentCtx, method, nil, nil, nil) {
+			if unsampled && !preserveHeaders {
+				ctx = injectUnsampledParent(ctx, tracer, parentCtx, method, otgrpcOpts)
+			}
+			if !otgrpcOpts.observeExcluded || otgrpcOpts.metricsObserver == nil {
+				return streamer(ctx, desc, cc, method, opts...)
+			}
+			// Follow the stream with a no-op span to observe its end.
+			cs, err := streamer(ctx, desc, cc, method, opts...)
+			if err != nil {
+				otgrpcOpts.observeMetrics(method, err, start, true)
+				return cs, err
+			}
+			return newOpenTracingClientStream(cs, method, desc, opentracing.NoopTracer{},
+				opentracing.NoopTracer{}.StartSpan(method), otgrpcOpts.metricsOnly(), start), nil
 		}
 
-		clientSpan := StartSpanFactory(
+		clientSpan := otgrpcOpts.startRPCSpan(
 			parentCtx,
 			tracer,
-			method,
-			opentracing.ChildOf(parentCtx),
+			otgrpcOpts.operationName(method),
+			clientSpanReference(parentCtx, otgrpcOpts),
 			ext.SpanKindRPCClient,
-			gRPCComponentTag,
+			otgrpcOpts.componentTag(),
 		)
-		ctx = injectSpanContext(ctx, tracer, clientSpan, otgrpcOpts)
+		otgrpcOpts.setStaticTags(clientSpan)
+		setCallSpanTags(clientSpan, opts)
+		if otgrpcOpts.tagTarget {
+			setTargetTags(clientSpan, cc)
+		}
+		if otgrpcOpts.tagServiceMethod {
+			setServiceMethodTags(clientSpan, method)
+		}
+		if len(otgrpcOpts.metadataTags) > 0 {
+			setClientMetadataTags(clientSpan, ctx, otgrpcOpts.metadataTags)
+		}
+		otgrpcOpts.setSpanTagsFromFunc(ctx, clientSpan, method, nil)
+		if len(otgrpcOpts.baggageToMetadata) > 0 {
+			ctx = baggageToMetadata(ctx, clientSpan, otgrpcOpts.baggageToMetadata, otgrpcOpts.overwriteBaggageMetadata)
+		}
+		if !preserveHeaders {
+			ctx = injectSpanContext(ctx, tracer, clientSpan, method, otgrpcOpts)
+		}
+		if otgrpcOpts.retryAttemptSpans {
+			ctx = withCallAttempts(ctx, tracer, otgrpcOpts, clientSpan, method)
+		}
+		if otgrpcOpts.clientTimingTags {
+			ctx = withCallTiming(ctx, clientSpan, start)
+		}
 		cs, err := streamer(ctx, desc, cc, method, opts...)
 		if err != nil {
+			if otgrpcOpts.clientTimingTags {
+				setTotalTag(clientSpan, start)
+			}
+			setCodeTag(clientSpan, err)
 			if otgrpcOpts.logError {
 				clientSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
-				SetSpanTags(clientSpan, err, true)
+				setErrorTags(clientSpan, err, true, otgrpcOpts)
 			}
+			otgrpcOpts.decorate(ctx, clientSpan, method, nil, nil, err)
 			clientSpan.Finish()
+			otgrpcOpts.observeMetrics(method, err, start, true)
 			return cs, err
 		}
-		return newOpenTracingClientStream(cs, method, desc, clientSpan, otgrpcOpts), nil
+		return newOpenTracingClientStream(cs, method, desc, tracer, clientSpan, otgrpcOpts, start), nil
 	}
 }
 
-func newOpenTracingClientStream(cs grpc.ClientStream, method string, desc *grpc.StreamDesc, clientSpan opentracing.Span, otgrpcOpts *options) grpc.ClientStream {
+func newOpenTracingClientStream(cs grpc.ClientStream, method string, desc *grpc.StreamDesc, tracer opentracing.Tracer, clientSpan opentracing.Span, otgrpcOpts *options, start time.Time) grpc.ClientStream {
 	finishChan := make(chan struct{})
 
+	// The counters are shared with finishFunc via pointers rather than through
+	// otcs, as finishFunc must not keep otcs reachable (see the finalizer
+	// below).
+	seq := new(uint64)
+	counts := &messageCounts{sizes: otgrpcOpts.messageSizeTags}
+
 	isFinished := new(int32)
 	*isFinished = 0
 	finishFunc := func(err error) {
@@ -148,15 +305,26 @@ func newOpenTracingClientStream(cs grpc.ClientStream, method string, desc *grpc.
 		if !atomic.CompareAndSwapInt32(isFinished, 0, 1) {
 			return
 		}
+		// io.EOF marks the normal end of the stream rather than a failure.
+		if err == io.EOF {
+			err = nil
+		}
 		close(finishChan)
+		defer otgrpcOpts.observeMetrics(method, err, start, true)
 		defer clientSpan.Finish()
+		if otgrpcOpts.clientTimingTags {
+			setTotalTag(clientSpan, start)
+		}
+		setCodeTag(clientSpan, err)
+		counts.setTags(clientSpan)
+		if otgrpcOpts.streamMessageSpans {
+			clientSpan.SetTag("grpc.message.count", atomic.LoadUint64(seq))
+		}
 		if err != nil && otgrpcOpts.logError {
 			clientSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
-			SetSpanTags(clientSpan, err, true)
-		}
-		if otgrpcOpts.decorator != nil {
-			otgrpcOpts.decorator(cs.Context(), clientSpan, method, nil, nil, err)
+			setErrorTags(clientSpan, err, true, otgrpcOpts)
 		}
+		otgrpcOpts.decorate(cs.Context(), clientSpan, method, nil, nil, err)
 	}
 	go func() {
 		select {
@@ -171,6 +339,16 @@ func newOpenTracingClientStream(cs grpc.ClientStream, method string, desc *grpc.
 		ClientStream: cs,
 		desc:         desc,
 		finishFunc:   finishFunc,
+		messageSpans: otgrpcOpts.streamMessageSpans,
+		seq:          seq,
+		counts:       counts,
+		payloads:     newStreamPayloadLogger(clientSpan, method, otgrpcOpts, true),
+		otgrpcOpts:   otgrpcOpts,
+		tracer:       tracer,
+		span:         clientSpan,
+		start:        start,
+		isFinished:   isFinished,
+		method:       method,
 	}
 
 	// The `ClientStream` interface allows one to omit calling `Recv` if it's
@@ -189,26 +367,83 @@ type openTracingClientStream struct {
 	grpc.ClientStream
 	desc       *grpc.StreamDesc
 	finishFunc func(error)
+	counts     *messageCounts
+	payloads   *streamPayloadLogger
+
+	span       opentracing.Span
+	start      time.Time
+	isFinished *int32 // accessed atomically
+	// headersLogged and firstMessageLogged are set to 1, atomically, once the
+	// corresponding events have been logged on span.
+	headersLogged      uint32
+	firstMessageLogged uint32
+
+	// The fields below are only used when per-message spans are enabled.
+	messageSpans bool
+	seq          *uint64 // accessed atomically
+	otgrpcOpts   *options
+	tracer       opentracing.Tracer
+	method       string
+}
+
+// logOnce logs event on the span of cs, along with the milliseconds elapsed
+// since the stream started, unless flag says it was logged already, the span
+// is finished or the call is not a stream but a unary call made through the
+// stream API.
+func (cs *openTracingClientStream) logOnce(flag *uint32, event string) {
+	if !cs.desc.ServerStreams && !cs.desc.ClientStreams {
+		return
+	}
+	if atomic.LoadInt32(cs.isFinished) != 0 || !atomic.CompareAndSwapUint32(flag, 0, 1) {
+		return
+	}
+	cs.span.LogFields(
+		log.String("event", event),
+		log.Int64("elapsed_ms", time.Since(cs.start).Milliseconds()),
+	)
 }
 
 func (cs *openTracingClientStream) Header() (metadata.MD, error) {
 	md, err := cs.ClientStream.Header()
 	if err != nil {
 		cs.finishFunc(err)
+	} else {
+		cs.logOnce(&cs.headersLogged, "headers_received")
 	}
 	return md, err
 }
 
 func (cs *openTracingClientStream) SendMsg(m interface{}) error {
+	var msgSpan opentracing.Span
+	if cs.messageSpans {
+		msgSpan = startMessageSpan(cs.otgrpcOpts, cs.tracer, cs.span, cs.method, "send", atomic.AddUint64(cs.seq, 1))
+	}
+	cs.payloads.log(m, true)
 	err := cs.ClientStream.SendMsg(m)
-	if err != nil {
+	if msgSpan != nil {
+		finishMessageSpan(msgSpan, err, true)
+	}
+	if err == io.EOF {
+		// The stream was ended by the server, whose status is only returned by
+		// RecvMsg, which finishes the span.
+		return err
+	} else if err != nil {
 		cs.finishFunc(err)
+		return err
 	}
-	return err
+	cs.counts.countSent(m)
+	return nil
 }
 
 func (cs *openTracingClientStream) RecvMsg(m interface{}) error {
+	var msgSpan opentracing.Span
+	if cs.messageSpans {
+		msgSpan = startMessageSpan(cs.otgrpcOpts, cs.tracer, cs.span, cs.method, "recv", atomic.AddUint64(cs.seq, 1))
+	}
 	err := cs.ClientStream.RecvMsg(m)
+	if msgSpan != nil {
+		finishMessageSpan(msgSpan, err, true)
+	}
 	if err == io.EOF {
 		cs.finishFunc(nil)
 		return err
@@ -216,6 +451,9 @@ func (cs *openTracingClientStream) RecvMsg(m interface{}) error {
 		cs.finishFunc(err)
 		return err
 	}
+	cs.logOnce(&cs.firstMessageLogged, "first_message_received")
+	cs.counts.countReceived(m)
+	cs.payloads.log(m, false)
 	if !cs.desc.ServerStreams {
 		cs.finishFunc(nil)
 	}
@@ -230,20 +468,147 @@ func (cs *openTracingClientStream) CloseSend() error {
 	return err
 }
 
-func injectSpanContext(ctx context.Context, tracer opentracing.Tracer, clientSpan opentracing.Span, otgrpcOpts *options) context.Context {
-	md, ok := FromContext(ctx)
-	if !ok {
-		md = New(nil)
-	} else {
-		md = md.Copy()
+// clientSpanReference returns the option making a client span reference
+// parentCtx, the SpanContext of the span of its caller, if any, with the
+// reference type configured in otgrpcOpts.
+func clientSpanReference(parentCtx opentracing.SpanContext, otgrpcOpts *options) opentracing.StartSpanOption {
+	if otgrpcOpts.clientReferenceType == opentracing.FollowsFromRef {
+		return opentracing.FollowsFrom(parentCtx)
+	}
+	return opentracing.ChildOf(parentCtx)
+}
+
+func injectSpanContext(ctx context.Context, tracer opentracing.Tracer, clientSpan opentracing.Span, method string, otgrpcOpts *options) context.Context {
+	newCtx, err := injectMetadata(ctx, tracer, clientSpan.Context(), otgrpcOpts.propagationFormat)
+	if err != nil {
+		if otgrpcOpts.logError {
+			clientSpan.LogFields(log.String("event", "Tracer.Inject() failed"), log.Error(err))
+		}
+		otgrpcOpts.reportTracingError(err, method)
+	}
+	return newCtx
+}
+
+// injectUnsampledParent injects parent, the unsampled parent of a call that
+// is not traced because of WithRespectUpstreamSampling, into the metadata of
+// ctx, so that the server does not start a new trace.
+func injectUnsampledParent(ctx context.Context, tracer opentracing.Tracer, parent opentracing.SpanContext, method string, otgrpcOpts *options) context.Context {
+	newCtx, err := injectMetadata(ctx, tracer, parent, otgrpcOpts.propagationFormat)
+	if err != nil {
+		otgrpcOpts.reportTracingError(err, method)
+	}
+	return newCtx
+}
+
+// existingSpanContext returns the SpanContext that the metadata to be sent
+// along with an RPC already carries in format, if any. Both the metadata
+// attached to ctx with NewContext and its outgoing gRPC metadata are looked
+// into, in that order.
+func existingSpanContext(ctx context.Context, tracer opentracing.Tracer, format opentracing.BuiltinFormat) opentracing.SpanContext {
+	md, _ := FromContext(ctx)
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+	for _, md := range []metadata.MD{md, outgoing} {
+		if len(md) == 0 {
+			continue
+		}
+		if sc, err := extractFromMD(md, tracer, format, nil); err == nil {
+			return sc
+		}
+	}
+	return nil
+}
+
+// InjectSpanContext injects sc into the outgoing gRPC metadata of ctx and
+// returns the resulting context. The metadata already attached to ctx is
+// copied rather than modified, and any keys already set on it are preserved,
+// except for the tracing headers of an earlier injection, which are replaced.
+//
+// If the injection fails, ctx is returned unchanged along with the error.
+func InjectSpanContext(ctx context.Context, tracer opentracing.Tracer, sc opentracing.SpanContext) (context.Context, error) {
+	return injectMetadata(ctx, tracer, sc, opentracing.HTTPHeaders)
+}
+
+func injectMetadata(ctx context.Context, tracer opentracing.Tracer, sc opentracing.SpanContext, format opentracing.BuiltinFormat) (context.Context, error) {
+	carrier, err := injectCarrier(tracer, sc, format)
+	if err != nil {
+		return ctx, err
+	}
+	md, _ := FromContext(ctx)
+	ctx = NewContext(ctx, mergeMetadata(md, carrier))
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, mergeMetadata(outgoing, carrier)), nil
+}
+
+// injectCarrier returns the metadata carrying sc in format, injected with
+// tracer.
+func injectCarrier(tracer opentracing.Tracer, sc opentracing.SpanContext, format opentracing.BuiltinFormat) (metadata.MD, error) {
+	carrier := New(nil)
+	if format == opentracing.Binary {
+		var buf bytes.Buffer
+		if err := tracer.Inject(sc, format, &buf); err != nil {
+			return nil, err
+		}
+		carrier[binarySpanContextKey] = []string{buf.String()}
+	} else if err := tracer.Inject(sc, format, metadataReaderWriter{MD: carrier}); err != nil {
+		return nil, err
+	}
+	return carrier, nil
+}
+
+// mergeMetadata returns a copy of md in which the keys of carrier are set to
+// their values in carrier. Values that a previous injection left under these
+// keys, e.g. for an earlier attempt of the call, are replaced rather than
+// duplicated; the other keys of md are kept as they are.
+func mergeMetadata(md, carrier metadata.MD) metadata.MD {
+	md = md.Copy()
+	for k, vals := range carrier {
+		md[k] = vals
+	}
+	return md
+}
+
+// setClientMetadataTags tags clientSpan with the headers named keys of the
+// outgoing gRPC metadata, or else of the metadata attached with NewContext.
+func setClientMetadataTags(clientSpan opentracing.Span, ctx context.Context, keys []string) {
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+	md, _ := FromContext(ctx)
+	setMetadataTags(clientSpan, keys, outgoing, md)
+}
+
+// setTargetTags tags clientSpan with the target of cc. The target may be a
+// bare "host:port" or a "scheme://authority/endpoint" URI; in both cases the
+// endpoint is split into its host and port so that DNS names and IP addresses
+// end up under the appropriate peer tags.
+func setTargetTags(clientSpan opentracing.Span, cc *grpc.ClientConn) {
+	if cc == nil {
+		return
+	}
+	target := cc.Target()
+	clientSpan.SetTag("grpc.target", target)
+
+	endpoint := target
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		endpoint = endpoint[i+len("://"):]
+		if j := strings.Index(endpoint, "/"); j >= 0 {
+			endpoint = endpoint[j+1:]
+		}
+	}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host, port = endpoint, ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			ext.PeerHostIPv4.SetString(clientSpan, host)
+		} else {
+			ext.PeerHostIPv6.Set(clientSpan, host)
+		}
+	} else if host != "" {
+		ext.PeerHostname.Set(clientSpan, host)
 	}
-	mdWriter := metadataReaderWriter{md}
-	err := tracer.Inject(clientSpan.Context(), opentracing.HTTPHeaders, mdWriter)
-	// We have no better place to record an error than the Span itself :-/
-	if err != nil && otgrpcOpts.logError {
-		clientSpan.LogFields(log.String("event", "Tracer.Inject() failed"), log.Error(err))
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		ext.PeerPort.Set(clientSpan, uint16(p))
 	}
-	return NewContext(ctx, md)
 }
 
 const (
@@ -0,0 +1,883 @@
+package otgrpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeClientStream is a grpc.ClientStream that never talks to a server.
+type fakeClientStream struct {
+	ctx context.Context
+}
+
+func (cs *fakeClientStream) Header() (metadata.MD, error) { return nil, nil }
+func (cs *fakeClientStream) Trailer() metadata.MD         { return nil }
+func (cs *fakeClientStream) CloseSend() error             { return nil }
+func (cs *fakeClientStream) Context() context.Context     { return cs.ctx }
+func (cs *fakeClientStream) SendMsg(m interface{}) error  { return nil }
+func (cs *fakeClientStream) RecvMsg(m interface{}) error  { return nil }
+
+// eofClientStream is a fakeClientStream whose server has nothing to send.
+type eofClientStream struct {
+	fakeClientStream
+}
+
+func (cs *eofClientStream) RecvMsg(m interface{}) error { return io.EOF }
+
+func fakeInvoker(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+	return nil
+}
+
+func fakeStreamer(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return &fakeClientStream{ctx: ctx}, nil
+}
+
+// corruptTracer is a tracer whose Extract always fails as if the tracing
+// headers were malformed.
+type corruptTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t corruptTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	return nil, opentracing.ErrSpanContextCorrupted
+}
+
+func dial(t *testing.T, target string) *grpc.ClientConn {
+	cc, err := grpc.Dial(target, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial(%q) = %v", target, err)
+	}
+	return cc
+}
+
+func TestTagTarget(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, tc := range []struct {
+		target       string
+		expectedTags map[string]interface{}
+	}{
+		{
+			target: "localhost:50051",
+			expectedTags: map[string]interface{}{
+				"peer.hostname": "localhost",
+				"peer.port":     uint16(50051),
+			},
+		},
+		{
+			target: "dns:///example.com:443",
+			expectedTags: map[string]interface{}{
+				"peer.hostname": "example.com",
+				"peer.port":     uint16(443),
+			},
+		},
+		{
+			target: "127.0.0.1:8080",
+			expectedTags: map[string]interface{}{
+				"peer.ipv4": "127.0.0.1",
+				"peer.port": uint16(8080),
+			},
+		},
+		{
+			target: "[::1]:8080",
+			expectedTags: map[string]interface{}{
+				"peer.ipv6": "::1",
+				"peer.port": uint16(8080),
+			},
+		},
+	} {
+		cc := dial(t, tc.target)
+
+		tracer.Reset()
+		interceptor := OpenTracingClientInterceptor(tracer, TagTarget())
+		err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, cc, fakeInvoker)
+		assert.NoError(t, err)
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("Incorrect span length")
+		}
+		assert.Equal(t, tc.target, spans[0].Tag("grpc.target"))
+		for k, v := range tc.expectedTags {
+			assert.Equal(t, v, spans[0].Tag(k), "target %q, tag %q", tc.target, k)
+		}
+
+		tracer.Reset()
+		streamInterceptor := OpenTracingStreamClientInterceptor(tracer, TagTarget())
+		cs, err := streamInterceptor(context.Background(), &grpc.StreamDesc{}, cc, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.RecvMsg(nil))
+
+		spans = tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("Incorrect span length")
+		}
+		assert.Equal(t, tc.target, spans[0].Tag("grpc.target"))
+
+		cc.Close()
+	}
+}
+
+func TestTagTargetDisabled(t *testing.T) {
+	tracer := mocktracer.New()
+	cc := dial(t, "localhost:50051")
+	defer cc.Close()
+
+	interceptor := OpenTracingClientInterceptor(tracer)
+	err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, cc, fakeInvoker)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Nil(t, spans[0].Tag("grpc.target"))
+}
+
+func TestExtractSpanContextMissingMetadata(t *testing.T) {
+	tracer := mocktracer.New()
+	_, err := ExtractSpanContext(context.Background(), tracer)
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
+
+func TestExtractSpanContextMalformed(t *testing.T) {
+	tracer := corruptTracer{mocktracer.New()}
+	ctx := NewContext(context.Background(), New(map[string]string{
+		"mockpfx-ids-traceid": "not-a-number",
+		"mockpfx-ids-spanid":  "1",
+	}))
+	_, err := ExtractSpanContext(ctx, tracer)
+	assert.Equal(t, opentracing.ErrSpanContextCorrupted, err)
+}
+
+func TestInjectExtractSpanContext(t *testing.T) {
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("parent")
+	defer span.Finish()
+
+	ctx := NewContext(context.Background(), New(map[string]string{"custom-key": "value"}))
+	ctx, err := InjectSpanContext(ctx, tracer, span.Context())
+	assert.NoError(t, err)
+
+	md, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"value"}, md["custom-key"])
+
+	sc, err := ExtractSpanContext(ctx, tracer)
+	assert.NoError(t, err)
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).TraceID, sc.(mocktracer.MockSpanContext).TraceID)
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).SpanID, sc.(mocktracer.MockSpanContext).SpanID)
+}
+
+func TestClientStreamMessageSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamClientInterceptor(tracer, WithStreamMessageSpans())
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &eofClientStream{fakeClientStream{ctx: ctx}}, nil
+	}
+	cs, err := interceptor(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, "/pkg.Service/Method", streamer)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(nil))
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	streamSpan := spans[2]
+	assert.Equal(t, uint64(2), streamSpan.Tag("grpc.message.count"))
+	for i, direction := range []string{"send", "recv"} {
+		assert.Equal(t, "/pkg.Service/Method/"+direction, spans[i].OperationName)
+		assert.Equal(t, direction, spans[i].Tag("grpc.message.direction"))
+		assert.Equal(t, uint64(i+1), spans[i].Tag("grpc.message.seq"))
+		assert.Equal(t, streamSpan.SpanContext.SpanID, spans[i].ParentID)
+		assert.Nil(t, spans[i].Tag("error"))
+	}
+}
+
+func TestClientStreamMessageSpansError(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamClientInterceptor(tracer, WithStreamMessageSpans())
+	internal := status.Error(codes.Internal, "")
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &errClientStream{fakeClientStream{ctx: ctx}, internal}, nil
+	}
+	cs, err := interceptor(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, "/pkg.Service/Method", streamer)
+	assert.NoError(t, err)
+	assert.Equal(t, internal, cs.RecvMsg(nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	msgSpan := spans[0]
+	assert.Equal(t, "/pkg.Service/Method/recv", msgSpan.OperationName)
+	assert.Equal(t, spans[1].SpanContext.SpanID, msgSpan.ParentID)
+	assert.Equal(t, true, msgSpan.Tag("error"))
+	assert.Equal(t, "Internal", msgSpan.Tag("grpc.code"))
+	assert.Equal(t, "error", logFields(msgSpan)["event"])
+}
+
+func TestClientInclusionFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	var included []interface{}
+	exclude := IncludingSpans(func(parentSpanCtx opentracing.SpanContext, method string, req, resp interface{}) bool {
+		assert.Equal(t, parent.Context(), parentSpanCtx)
+		assert.Equal(t, "/grpc.health.v1.Health/Check", method)
+		included = append(included, req)
+		return false
+	})
+
+	invoked := false
+	interceptor := OpenTracingClientInterceptor(tracer, exclude)
+	err := interceptor(ctx, "/grpc.health.v1.Health/Check", "req", nil, nil,
+		func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			invoked = true
+			_, ok := FromContext(ctx)
+			assert.False(t, ok, "tracing headers must not be injected")
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.True(t, invoked)
+
+	streamInterceptor := OpenTracingStreamClientInterceptor(tracer, exclude)
+	cs, err := streamInterceptor(ctx, &grpc.StreamDesc{}, nil, "/grpc.health.v1.Health/Check", fakeStreamer)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.RecvMsg(nil))
+	_, ok := FromContext(cs.Context())
+	assert.False(t, ok, "tracing headers must not be injected")
+
+	assert.Equal(t, []interface{}{"req", nil}, included)
+	assert.Empty(t, tracer.FinishedSpans())
+}
+
+func TestPropagationFormat(t *testing.T) {
+	tracer := mocktracer.New()
+	server := OpenTracingServerInterceptor(tracer, WithPropagationFormat(opentracing.TextMap))
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := FromContext(ctx)
+		// mocktracer only URL-escapes baggage in the HTTPHeaders format.
+		assert.Equal(t, []string{"a b"}, md["mockpfx-baggage-item"])
+		_, err := server(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, echoHandler)
+		return err
+	}
+
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("item", "a b")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	client := OpenTracingClientInterceptor(tracer, WithPropagationFormat(opentracing.TextMap))
+	assert.NoError(t, client(ctx, "/pkg.Service/Method", nil, nil, nil, invoker))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID)
+}
+
+func TestTracingErrorHandlerInject(t *testing.T) {
+	tracer := mocktracer.New()
+	var reported []error
+	handler := WithTracingErrorHandler(func(err error, method string) {
+		reported = append(reported, err)
+	})
+	interceptor := OpenTracingClientInterceptor(tracer, handler, WithPropagationFormat(opentracing.Binary))
+	assert.NoError(t, interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker))
+	assert.Equal(t, 1, len(reported))
+}
+
+// binaryHeaderTracer is a mocktracer that also propagates a binary header
+// through TextMap carriers, and fails to extract if it got mangled.
+type binaryHeaderTracer struct {
+	*mocktracer.MockTracer
+}
+
+const binaryHeaderValue = "\x00\xff\xfe"
+
+func (t binaryHeaderTracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	if err := t.MockTracer.Inject(sc, format, carrier); err != nil {
+		return err
+	}
+	if w, ok := carrier.(opentracing.TextMapWriter); ok {
+		w.Set("X-Trace-Bin", binaryHeaderValue)
+	}
+	return nil
+}
+
+func (t binaryHeaderTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return t.MockTracer.Extract(format, carrier)
+	}
+	var val string
+	r.ForeachKey(func(key, v string) error {
+		if key == "x-trace-bin" {
+			val = v
+		}
+		return nil
+	})
+	if val != binaryHeaderValue {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	return t.MockTracer.Extract(format, carrier)
+}
+
+func TestBinaryHeadersOverTheWire(t *testing.T) {
+	mock := mocktracer.New()
+	mock.RegisterInjector(opentracing.Binary, binaryPropagator{})
+	mock.RegisterExtractor(opentracing.Binary, binaryPropagator{})
+	tracer := binaryHeaderTracer{mock}
+	for _, format := range []opentracing.BuiltinFormat{opentracing.HTTPHeaders, opentracing.Binary} {
+		mock.Reset()
+		opt := WithPropagationFormat(format)
+		cc := statsEchoConn(t,
+			[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, opt, LogError()))},
+			grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, opt)))
+		err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+		assert.NoError(t, err)
+
+		spans := waitForSpans(t, mock, 2, clientSpanFirst)
+		client, server := spans[0], spans[1]
+		assert.Equal(t, client.SpanContext.SpanID, server.ParentID, "%v", format)
+	}
+}
+
+func TestExtractEncodedBinarySpanContext(t *testing.T) {
+	tracer := mocktracer.New()
+	tracer.RegisterInjector(opentracing.Binary, binaryPropagator{})
+	tracer.RegisterExtractor(opentracing.Binary, binaryPropagator{})
+	parent := tracer.StartSpan("parent")
+	var buf bytes.Buffer
+	assert.NoError(t, tracer.Inject(parent.Context(), opentracing.Binary, &buf))
+	raw := buf.String()
+
+	// Binary headers that did not go through the gRPC transport may still be
+	// base64-encoded, padded or not, and their names may not be lower-case.
+	for _, md := range []metadata.MD{
+		{"ot-span-context-bin": {raw}},
+		New(map[string]string{"ot-span-context-bin": raw}),
+		{"ot-span-context-bin": {base64.RawStdEncoding.EncodeToString([]byte(raw))}},
+		{"Ot-Span-Context-Bin": {raw}},
+	} {
+		for _, ctx := range []context.Context{
+			NewContext(context.Background(), md),
+			metadata.NewIncomingContext(context.Background(), md),
+		} {
+			sc, err := extractMetadata(ctx, tracer, opentracing.Binary, nil)
+			if assert.NoError(t, err, "%v", md) {
+				assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, sc.(mocktracer.MockSpanContext).SpanID)
+			}
+		}
+	}
+
+	_, err := extractMetadata(metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("ot-span-context-bin", "not a span context")), tracer, opentracing.Binary, nil)
+	assert.Error(t, err)
+}
+
+// binaryPropagator propagates MockSpanContexts in the opentracing.Binary
+// format, which mocktracer does not support out of the box.
+type binaryPropagator struct{}
+
+func (binaryPropagator) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	return json.NewEncoder(carrier.(io.Writer)).Encode(sc)
+}
+
+func (binaryPropagator) Extract(carrier interface{}) (mocktracer.MockSpanContext, error) {
+	var sc mocktracer.MockSpanContext
+	err := json.NewDecoder(carrier.(io.Reader)).Decode(&sc)
+	return sc, err
+}
+
+func TestBinaryPropagation(t *testing.T) {
+	tracer := mocktracer.New()
+	tracer.RegisterInjector(opentracing.Binary, binaryPropagator{})
+	tracer.RegisterExtractor(opentracing.Binary, binaryPropagator{})
+
+	server := OpenTracingServerInterceptor(tracer, WithPropagationFormat(opentracing.Binary))
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := FromContext(ctx)
+		assert.Equal(t, 1, len(md["ot-span-context-bin"]))
+		_, err := server(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, echoHandler)
+		return err
+	}
+
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	client := OpenTracingClientInterceptor(tracer, WithPropagationFormat(opentracing.Binary))
+	assert.NoError(t, client(ctx, "/pkg.Service/Method", nil, nil, nil, invoker))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, spans[1].SpanContext.TraceID, spans[0].SpanContext.TraceID)
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID)
+
+	_, err := extractMetadata(context.Background(), tracer, opentracing.Binary, nil)
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
+
+func TestClientSpanDecorator(t *testing.T) {
+	tracer := mocktracer.New()
+	var errs []error
+	decorator := SpanDecorator(func(ctx context.Context, span opentracing.Span, method string, req, resp interface{}, grpcError error) {
+		span.SetTag("shard", "7")
+		errs = append(errs, grpcError)
+	})
+	streamErr := status.Error(codes.Unavailable, "unavailable")
+	failingStreamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return nil, streamErr
+	}
+	eofStreamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &eofClientStream{fakeClientStream{ctx: ctx}}, nil
+	}
+	desc := &grpc.StreamDesc{ServerStreams: true}
+
+	err := OpenTracingClientInterceptor(tracer, decorator)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	streamInterceptor := OpenTracingStreamClientInterceptor(tracer, decorator)
+	_, err = streamInterceptor(context.Background(), desc, nil, "/pkg.Service/Method", failingStreamer)
+	assert.Equal(t, streamErr, err)
+	cs, err := streamInterceptor(context.Background(), desc, nil, "/pkg.Service/Method", eofStreamer)
+	assert.NoError(t, err)
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "7", span.Tag("shard"))
+	}
+	assert.Equal(t, []error{nil, streamErr, nil}, errs)
+}
+
+func TestNoTrace(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingClientInterceptor(tracer)
+	streamInterceptor := OpenTracingStreamClientInterceptor(tracer)
+	var passed []grpc.CallOption
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, ok := FromContext(ctx)
+		assert.False(t, ok, "tracing headers must not be injected")
+		passed = opts
+		return nil
+	}
+
+	// NoTrace composes with other CallOptions, which are passed on.
+	opts := []grpc.CallOption{grpc.WaitForReady(true), NoTrace()}
+	err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil, invoker, opts...)
+	assert.NoError(t, err)
+	assert.Equal(t, opts, passed)
+	cs, err := streamInterceptor(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer, opts...)
+	assert.NoError(t, err)
+	assert.IsType(t, &fakeClientStream{}, cs)
+	_, ok := FromContext(cs.Context())
+	assert.False(t, ok, "tracing headers must not be injected")
+	assert.Empty(t, tracer.FinishedSpans())
+
+	// Calls without it are traced as usual.
+	err = interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker, grpc.WaitForReady(true))
+	assert.NoError(t, err)
+	cs, err = streamInterceptor(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	cs.(*openTracingClientStream).finishFunc(nil)
+	assert.Len(t, tracer.FinishedSpans(), 2)
+}
+
+func TestWithSpanTags(t *testing.T) {
+	tracer := mocktracer.New()
+	opts := []grpc.CallOption{
+		WithSpanTags(opentracing.Tags{"tenant": "acme", "shard": 1}),
+		grpc.WaitForReady(true),
+		WithSpanTags(opentracing.Tags{"shard": 2}),
+	}
+	var passed []grpc.CallOption
+	interceptor := OpenTracingClientInterceptor(tracer)
+	err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			passed = opts
+			return nil
+		}, opts...)
+	assert.NoError(t, err)
+	assert.Equal(t, opts, passed)
+	cs, err := OpenTracingStreamClientInterceptor(tracer)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer, opts...)
+	assert.NoError(t, err)
+	cs.(*openTracingClientStream).finishFunc(nil)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "acme", span.Tag("tenant"))
+		assert.Equal(t, 2, span.Tag("shard"))
+	}
+}
+
+// uberPropagator propagates mocktracer SpanContexts in a Jaeger-like
+// "uber-trace-id" header.
+type uberPropagator struct{}
+
+func (uberPropagator) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	carrier.(opentracing.TextMapWriter).Set("uber-trace-id", fmt.Sprintf("%d:%d", sc.TraceID, sc.SpanID))
+	return nil
+}
+
+func (uberPropagator) Extract(carrier interface{}) (mocktracer.MockSpanContext, error) {
+	return mocktracer.MockSpanContext{}, opentracing.ErrSpanContextNotFound
+}
+
+func TestInjectPreservesOutgoingMetadata(t *testing.T) {
+	tracer := mocktracer.New()
+	tracer.RegisterInjector(opentracing.HTTPHeaders, uberPropagator{})
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"x-custom", "a", "x-custom", "b", "uber-trace-id", "stale")
+	ctx = NewContext(ctx, metadata.Pairs("x-custom", "a", "uber-trace-id", "stale"))
+
+	var outgoing []metadata.MD
+	interceptor := OpenTracingClientInterceptor(tracer)
+	var invoker grpc.UnaryInvoker
+	invoker = func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		outgoing = append(outgoing, md)
+		// A retrying interceptor further down the chain re-enters ours with
+		// the context it was given.
+		if len(outgoing) == 1 {
+			return interceptor(ctx, method, req, resp, cc, invoker)
+		}
+		return nil
+	}
+	assert.NoError(t, interceptor(ctx, "/pkg.Service/Method", nil, nil, nil, invoker))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, md := range outgoing {
+		sc := spans[1-i].SpanContext
+		assert.Equal(t, []string{"a", "b"}, md["x-custom"])
+		assert.Equal(t, []string{fmt.Sprintf("%d:%d", sc.TraceID, sc.SpanID)}, md["uber-trace-id"])
+		assert.Len(t, md, 2)
+	}
+
+	// The caller's metadata is left untouched.
+	md, _ := metadata.FromOutgoingContext(ctx)
+	assert.Equal(t, []string{"stale"}, md["uber-trace-id"])
+	md, _ = FromContext(ctx)
+	assert.Equal(t, []string{"stale"}, md["uber-trace-id"])
+}
+
+func TestPreserveExistingTraceHeaders(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		tracer := mocktracer.New()
+		var proxyOpts []Option
+		if preserve {
+			proxyOpts = append(proxyOpts, WithPreserveExistingTraceHeaders())
+		}
+		backend := OpenTracingServerInterceptor(tracer)
+		proxyServer := OpenTracingServerInterceptor(tracer)
+		proxyClient := OpenTracingClientInterceptor(tracer, proxyOpts...)
+		// The proxy forwards the metadata of the RPCs it receives.
+		proxyHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			err := proxyClient(ctx, "/pkg.Service/Method", req, nil, nil,
+				func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					_, err := backend(ctx, req, unaryInfo, echoHandler)
+					return err
+				})
+			return nil, err
+		}
+		origin := OpenTracingClientInterceptor(tracer)
+		err := origin(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+			func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				_, err := proxyServer(ctx, req, unaryInfo, proxyHandler)
+				return err
+			})
+		assert.NoError(t, err)
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 4 {
+			t.Fatalf("Incorrect span length")
+		}
+		backendSpan, proxyClientSpan, originSpan := spans[0], spans[1], spans[3]
+		for _, span := range spans {
+			assert.Equal(t, originSpan.SpanContext.TraceID, span.SpanContext.TraceID)
+		}
+		if preserve {
+			// The backend sees the headers of the origin.
+			assert.Equal(t, originSpan.SpanContext.SpanID, backendSpan.ParentID)
+			assert.Equal(t, originSpan.SpanContext.SpanID, proxyClientSpan.ParentID)
+		} else {
+			assert.Equal(t, proxyClientSpan.SpanContext.SpanID, backendSpan.ParentID)
+		}
+	}
+}
+
+// errClientStreamPair is a fakeClientStream whose SendMsg and RecvMsg return
+// fixed errors.
+type errClientStreamPair struct {
+	fakeClientStream
+	sendErr, recvErr error
+}
+
+func (cs *errClientStreamPair) SendMsg(m interface{}) error { return cs.sendErr }
+func (cs *errClientStreamPair) RecvMsg(m interface{}) error { return cs.recvErr }
+
+func TestClientStreamEOF(t *testing.T) {
+	tracer := mocktracer.New()
+	internal := status.Error(codes.Internal, "")
+	for _, tc := range []struct {
+		sendErr, recvErr error
+		expectedError    interface{}
+		expectedCode     string
+	}{
+		{nil, io.EOF, nil, "OK"},
+		{nil, internal, true, "Internal"},
+		// SendMsg returns io.EOF when the server ended the stream, whose
+		// status is then returned by RecvMsg.
+		{io.EOF, io.EOF, nil, "OK"},
+		{io.EOF, internal, true, "Internal"},
+	} {
+		tracer.Reset()
+		interceptor := OpenTracingStreamClientInterceptor(tracer, LogError(), WithStreamMessageSpans())
+		cs, err := interceptor(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, "/pkg.Service/Method",
+			func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return &errClientStreamPair{fakeClientStream{ctx: ctx}, tc.sendErr, tc.recvErr}, nil
+			})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.sendErr, cs.SendMsg(nil))
+		assert.Equal(t, tc.recvErr, cs.RecvMsg(nil))
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 3 {
+			t.Fatalf("Incorrect span length")
+		}
+		streamSpan := spans[2]
+		assert.Equal(t, tc.expectedError, streamSpan.Tag("error"), "%v, %v", tc.sendErr, tc.recvErr)
+		assert.Equal(t, tc.expectedCode, streamSpan.Tag("grpc.code"), "%v, %v", tc.sendErr, tc.recvErr)
+		// Message spans never flag io.EOF either.
+		assert.Nil(t, spans[0].Tag("error"))
+		assert.Equal(t, tc.expectedError, spans[1].Tag("error"))
+	}
+}
+
+// serverStreamingClientStream is a fakeClientStream that receives messages
+// messages, then err.
+type serverStreamingClientStream struct {
+	fakeClientStream
+	messages int
+	err      error
+}
+
+func (cs *serverStreamingClientStream) RecvMsg(m interface{}) error {
+	if cs.messages > 0 {
+		cs.messages--
+		return nil
+	}
+	if cs.err == nil {
+		<-cs.ctx.Done()
+		return status.FromContextError(cs.ctx.Err()).Err()
+	}
+	return cs.err
+}
+
+func TestClientStreamFinish(t *testing.T) {
+	tracer := mocktracer.New()
+	internal := status.Error(codes.Internal, "")
+	for _, tc := range []struct {
+		name         string
+		err          error
+		cancel       bool
+		expectedCode string
+	}{
+		{"completion", io.EOF, false, "OK"},
+		{"server error", internal, false, "Internal"},
+		{"cancellation", nil, true, "Canceled"},
+	} {
+		tracer.Reset()
+		goroutines := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		interceptor := OpenTracingStreamClientInterceptor(tracer)
+		cs, err := interceptor(ctx, &grpc.StreamDesc{ServerStreams: true}, nil, "/pkg.Service/Method",
+			func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return &serverStreamingClientStream{fakeClientStream{ctx: ctx}, 2, tc.err}, nil
+			})
+		assert.NoError(t, err)
+		assert.NoError(t, cs.SendMsg(nil))
+		assert.NoError(t, cs.CloseSend())
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, cs.RecvMsg(nil))
+		}
+		// The span lasts until the stream completes.
+		assert.Empty(t, tracer.FinishedSpans(), tc.name)
+
+		if tc.cancel {
+			cancel()
+			// The span is finished by the context, before RecvMsg returns.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(tracer.FinishedSpans()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		assert.Error(t, cs.RecvMsg(nil))
+		assert.Error(t, cs.RecvMsg(nil))
+		cancel()
+
+		spans := tracer.FinishedSpans()
+		if assert.Len(t, spans, 1, tc.name) {
+			assert.Equal(t, tc.expectedCode, spans[0].Tag("grpc.code"), tc.name)
+		}
+		// The goroutine watching the context has returned.
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines, tc.name)
+	}
+}
+
+func TestClientStreamFirstResponseEvents(t *testing.T) {
+	tracer := mocktracer.New()
+	const delay = 50 * time.Millisecond
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+		if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		if method, _ := grpc.MethodFromServerStream(ss); method == "/pkg.Service/Fail" {
+			return status.Error(codes.Internal, "")
+		}
+		time.Sleep(delay)
+		for i := 0; i < 3; i++ {
+			if err := ss.SendMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithStreamInterceptor(OpenTracingStreamClientInterceptor(tracer)))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Fail"} {
+		cs, err := cc.NewStream(context.Background(), desc, method)
+		if err != nil {
+			t.Fatalf("NewStream = %v", err)
+		}
+		assert.NoError(t, cs.SendMsg(&emptypb.Empty{}))
+		assert.NoError(t, cs.CloseSend())
+		if method == "/pkg.Service/Method" {
+			for i := 0; i < 2; i++ {
+				_, err := cs.Header()
+				assert.NoError(t, err)
+			}
+		}
+		err = cs.RecvMsg(&emptypb.Empty{})
+		for err == nil {
+			err = cs.RecvMsg(&emptypb.Empty{})
+		}
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	var events []string
+	for _, record := range spans[0].Logs() {
+		fields := map[string]string{}
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+		events = append(events, fields["event"])
+		elapsed, err := strconv.ParseInt(fields["elapsed_ms"], 10, 64)
+		assert.NoError(t, err)
+		// Both wait for the first send of the server.
+		assert.GreaterOrEqual(t, elapsed, delay.Milliseconds(), fields["event"])
+	}
+	assert.Equal(t, []string{"headers_received", "first_message_received"}, events)
+	// The stream failed before any message.
+	assert.Empty(t, spans[1].Logs())
+}
+
+func TestClientReferenceType(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	var refs []opentracing.SpanReferenceType
+	factory := WithSpanFactory(func(spanContext opentracing.SpanContext, tracer opentracing.Tracer, operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+		sso := opentracing.StartSpanOptions{}
+		for _, o := range opts {
+			o.Apply(&sso)
+		}
+		for _, ref := range sso.References {
+			refs = append(refs, ref.Type)
+		}
+		return tracer.StartSpan(operationName, opts...)
+	})
+
+	followsFrom := WithClientReferenceType(opentracing.FollowsFromRef)
+	for _, optFuncs := range [][]Option{{factory}, {factory, followsFrom}} {
+		err := OpenTracingClientInterceptor(tracer, optFuncs...)(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		cs.(*openTracingClientStream).finishFunc(nil)
+	}
+	// Client spans without a parent have no reference, and server spans keep
+	// referencing the client span as its child.
+	err := OpenTracingClientInterceptor(tracer, factory, followsFrom)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	incoming, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+	_, err = OpenTracingServerInterceptor(tracer, factory, followsFrom)(incoming, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, []opentracing.SpanReferenceType{
+		opentracing.ChildOfRef, opentracing.ChildOfRef,
+		opentracing.FollowsFromRef, opentracing.FollowsFromRef,
+		opentracing.ChildOfRef,
+	}, refs)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 6 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans[:4] {
+		assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+	}
+	assert.Equal(t, 0, spans[4].ParentID)
+}
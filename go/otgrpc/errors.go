@@ -1,10 +1,15 @@
 package otgrpc
 
 import (
+	"errors"
+
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // A Class is a set of types of outcomes (including errors) that will often
@@ -50,16 +55,108 @@ func ErrorClass(err error) Class {
 }
 
 // SetSpanTags sets one or more tags on the given span according to the
-// error.
+// error. The gRPC status code of err is tagged the way the interceptors tag
+// it, by name under "grpc.code" and by number under "grpc.status_code";
+// errors that do not carry a gRPC status map to codes.Unknown.
 func SetSpanTags(span opentracing.Span, err error, client bool) {
+	setSpanTags(span, err, client, true)
+}
+
+// setSpanTags is SetSpanTags, flagging span as failed only if flagError is
+// set.
+func setSpanTags(span opentracing.Span, err error, client bool, flagError bool) {
+	setCodeTag(span, err)
 	c := ErrorClass(err)
 	code := grpc.Code(err)
 	span.SetTag("response_code", code)
 	span.SetTag("response_class", c)
-	if err == nil {
+	if err == nil || !flagError {
 		return
 	}
 	if client || c == ServerError {
 		ext.Error.Set(span, true)
 	}
 }
+
+// setErrorTags tags span according to err, using the ErrorTaggerFunc or else
+// the ErrorClassifierFunc configured in otgrpcOpts if any, and SetSpanTags
+// otherwise, leaving out the error flag for the codes of WithNonErrorCodes.
+// Timeouts and cancellations are tagged in any case.
+func setErrorTags(span opentracing.Span, err error, client bool, otgrpcOpts *options) {
+	setCauseTags(span, err)
+	if otgrpcOpts.errorTagger != nil {
+		otgrpcOpts.errorTagger(span, err, client)
+		return
+	}
+	_, nonError := otgrpcOpts.nonErrorCodes[status.Code(err)]
+	if otgrpcOpts.errorClassifier == nil {
+		setSpanTags(span, err, client, !nonError)
+		return
+	}
+	isError, class := otgrpcOpts.errorClassifier(err)
+	span.SetTag("response_code", grpc.Code(err))
+	ext.Error.Set(span, isError && !nonError)
+	if class != "" {
+		span.SetTag("error.class", class)
+	}
+}
+
+// setCauseTags tags span with "grpc.timeout" if err is due to a deadline
+// being exceeded and with "grpc.canceled" if it is due to a cancellation,
+// whether err is a context error or a gRPC status error.
+func setCauseTags(span opentracing.Span, err error) {
+	code := status.Code(err)
+	if errors.Is(err, context.DeadlineExceeded) || code == codes.DeadlineExceeded {
+		span.SetTag("grpc.timeout", true)
+	} else if errors.Is(err, context.Canceled) || code == codes.Canceled {
+		span.SetTag("grpc.canceled", true)
+	}
+}
+
+// rpcCode returns the gRPC status code of err, mapping the context errors
+// that do not carry a status to Canceled and DeadlineExceeded.
+func rpcCode(err error) codes.Code {
+	code := status.Code(err)
+	if code == codes.Unknown {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return codes.DeadlineExceeded
+		} else if errors.Is(err, context.Canceled) {
+			return codes.Canceled
+		}
+	}
+	return code
+}
+
+// setCodeTag tags span with the name and the number of the gRPC status code
+// of err. A nil err maps to OK, the context errors to Canceled and
+// DeadlineExceeded, as gRPC maps them, and other errors that do not carry a
+// gRPC status to Unknown.
+func setCodeTag(span opentracing.Span, err error) {
+	code := rpcCode(err)
+	span.SetTag("grpc.code", code.String())
+	span.SetTag("grpc.status_code", uint32(code))
+}
+
+// errorWithTraceID returns err as a status error whose details also hold an
+// errdetails.RequestInfo carrying the trace ID of serverSpan, for clients to
+// report it. Errors that are not status errors are converted as gRPC would
+// convert them, and err is returned as is if the trace ID cannot be told.
+func errorWithTraceID(err error, serverSpan opentracing.Span, otgrpcOpts *options) error {
+	traceIDFunc := otgrpcOpts.traceIDFunc
+	if traceIDFunc == nil {
+		traceIDFunc = SpanContextTraceID
+	}
+	traceID := traceIDFunc(serverSpan.Context())
+	if traceID == "" {
+		return err
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.FromContextError(err)
+	}
+	withID, detailsErr := st.WithDetails(&errdetails.RequestInfo{RequestId: traceID})
+	if detailsErr != nil {
+		return err
+	}
+	return withID.Err()
+}
@@ -1,13 +1,21 @@
 package otgrpc
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 const (
@@ -28,8 +36,10 @@ func TestSpanTags(t *testing.T) {
 		// Assert added tags
 		rawSpan := tracer.FinishedSpans()[0]
 		expectedTags := map[string]interface{}{
-			"response_code":  code,
-			"response_class": ErrorClass(err),
+			"response_code":    code,
+			"response_class":   ErrorClass(err),
+			"grpc.code":        code.String(),
+			"grpc.status_code": uint32(code),
 		}
 		if err != nil {
 			expectedTags["error"] = true
@@ -46,8 +56,10 @@ func TestSpanTags(t *testing.T) {
 		// Assert added tags
 		rawSpan = tracer.FinishedSpans()[0]
 		expectedTags = map[string]interface{}{
-			"response_code":  code,
-			"response_class": ErrorClass(err),
+			"response_code":    code,
+			"response_class":   ErrorClass(err),
+			"grpc.code":        code.String(),
+			"grpc.status_code": uint32(code),
 		}
 		if err != nil && ErrorClass(err) == ServerError {
 			expectedTags["error"] = true
@@ -55,3 +67,268 @@ func TestSpanTags(t *testing.T) {
 		assert.Equal(t, expectedTags, rawSpan.Tags())
 	}
 }
+
+func TestSpanTagsNonStatusError(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, client := range []bool{true, false} {
+		span := tracer.StartSpan("test-trace")
+		SetSpanTags(span, errors.New("plain error"), client)
+		span.Finish()
+	}
+	for _, span := range tracer.FinishedSpans() {
+		assert.Equal(t, "Unknown", span.Tag("grpc.code"))
+		assert.Equal(t, uint32(codes.Unknown), span.Tag("grpc.status_code"))
+		assert.Equal(t, codes.Unknown, span.Tag("response_code"))
+	}
+}
+
+func TestCodeTag(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, tc := range []struct {
+		err          error
+		expectedName string
+		expectedCode uint32
+	}{
+		{nil, "OK", 0},
+		{status.Error(codes.NotFound, ""), "NotFound", 5},
+		{fmt.Errorf("lookup: %w", status.Error(codes.NotFound, "")), "NotFound", 5},
+		{errors.New("plain error"), "Unknown", 2},
+		{context.Canceled, "Canceled", 1},
+	} {
+		// The code is tagged whether or not errors are logged.
+		for _, optFuncs := range [][]Option{nil, {LogError()}} {
+			tracer.Reset()
+			_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil, unaryInfo,
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+				func(srv interface{}, ss grpc.ServerStream) error {
+					return tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+				func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					return tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+			assert.NoError(t, err)
+			cs.(*openTracingClientStream).finishFunc(tc.err)
+
+			spans := tracer.FinishedSpans()
+			if len(spans) != 4 {
+				t.Fatalf("Incorrect span length")
+			}
+			for _, span := range spans {
+				assert.Equal(t, tc.expectedName, span.Tag("grpc.code"))
+				assert.Equal(t, tc.expectedCode, span.Tag("grpc.status_code"))
+			}
+		}
+	}
+}
+
+func TestErrorClassifier(t *testing.T) {
+	tracer := mocktracer.New()
+	classifier := WithErrorClassifier(func(err error) (bool, string) {
+		code := status.Code(err)
+		if err == context.Canceled {
+			code = codes.Canceled
+		}
+		return code != codes.NotFound && code != codes.Canceled, code.String()
+	})
+	for _, tc := range []struct {
+		err           error
+		expectedError bool
+		expectedClass string
+	}{
+		{status.Error(codes.NotFound, ""), false, "NotFound"},
+		{status.Error(codes.Internal, ""), true, "Internal"},
+		{errors.New("plain error"), true, "Unknown"},
+		{context.Canceled, false, "Canceled"},
+	} {
+		tracer.Reset()
+		interceptor := OpenTracingClientInterceptor(tracer, LogError(), classifier)
+		err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+			func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return tc.err
+			})
+		assert.Equal(t, tc.err, err)
+
+		span := tracer.FinishedSpans()[0]
+		assert.Equal(t, tc.expectedError, span.Tag("error"), "%v", tc.err)
+		assert.Equal(t, tc.expectedClass, span.Tag("error.class"), "%v", tc.err)
+	}
+}
+
+func TestNonErrorCodes(t *testing.T) {
+	tracer := mocktracer.New()
+	nonErrors := WithNonErrorCodes(codes.NotFound, codes.AlreadyExists)
+	classifier := WithErrorClassifier(func(err error) (bool, string) {
+		return true, "classified"
+	})
+	for _, tc := range []struct {
+		err           error
+		optFuncs      []Option
+		expectedError interface{}
+	}{
+		{status.Error(codes.NotFound, ""), []Option{nonErrors}, nil},
+		{status.Error(codes.AlreadyExists, ""), []Option{nonErrors}, nil},
+		{status.Error(codes.Internal, ""), []Option{nonErrors}, true},
+		{status.Error(codes.NotFound, ""), nil, true},
+		{status.Error(codes.NotFound, ""), []Option{nonErrors, classifier}, false},
+		{status.Error(codes.Internal, ""), []Option{nonErrors, classifier}, true},
+		// Codes add up over several WithNonErrorCodes.
+		{status.Error(codes.Internal, ""), []Option{nonErrors, WithNonErrorCodes(codes.Internal)}, nil},
+	} {
+		tracer.Reset()
+		interceptor := OpenTracingClientInterceptor(tracer, append([]Option{LogError()}, tc.optFuncs...)...)
+		err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+			func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return tc.err
+			})
+		assert.Equal(t, tc.err, err)
+
+		span := tracer.FinishedSpans()[0]
+		assert.Equal(t, tc.expectedError, span.Tag("error"), "%v", tc.err)
+		// The error is still tagged and logged.
+		assert.Equal(t, status.Code(tc.err), span.Tag("response_code"), "%v", tc.err)
+		assert.Equal(t, "error", logFields(span)["event"], "%v", tc.err)
+	}
+}
+
+func TestErrorTagger(t *testing.T) {
+	tracer := mocktracer.New()
+	var isClients []bool
+	tagger := WithErrorTagger(func(span opentracing.Span, err error, isClient bool) {
+		span.SetTag("error.kind", status.Code(err).String())
+		isClients = append(isClients, isClient)
+	})
+	classifier := WithErrorClassifier(func(err error) (bool, string) {
+		return true, "classified"
+	})
+	internal := status.Error(codes.Internal, "")
+
+	_, err := OpenTracingServerInterceptor(tracer, LogError(), tagger, classifier)(context.Background(), nil, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, internal
+		})
+	assert.Equal(t, internal, err)
+	err = OpenTracingStreamServerInterceptor(tracer, LogError(), tagger)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			return internal
+		})
+	assert.Equal(t, internal, err)
+	err = OpenTracingClientInterceptor(tracer, LogError(), tagger)(context.Background(), "/pkg.Service/Method", nil, nil, nil,
+		func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return internal
+		})
+	assert.Equal(t, internal, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		// The tagger replaces both SetSpanTags and the classifier.
+		assert.Equal(t, "Internal", span.Tag("error.kind"))
+		assert.Nil(t, span.Tag("error"))
+		assert.Nil(t, span.Tag("error.class"))
+	}
+	assert.Equal(t, []bool{false, false, true}, isClients)
+}
+
+func TestCauseTags(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, tc := range []struct {
+		err              error
+		expectedTimeout  interface{}
+		expectedCanceled interface{}
+	}{
+		{context.DeadlineExceeded, true, nil},
+		{status.Error(codes.DeadlineExceeded, ""), true, nil},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), true, nil},
+		{context.Canceled, nil, true},
+		{status.Error(codes.Canceled, ""), nil, true},
+		{status.Error(codes.Internal, ""), nil, nil},
+	} {
+		tracer.Reset()
+		_, err := OpenTracingServerInterceptor(tracer, LogError())(context.Background(), nil, unaryInfo,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, tc.err
+			})
+		assert.Equal(t, tc.err, err)
+		span := tracer.FinishedSpans()[0]
+		assert.Equal(t, tc.expectedTimeout, span.Tag("grpc.timeout"), "%v", tc.err)
+		assert.Equal(t, tc.expectedCanceled, span.Tag("grpc.canceled"), "%v", tc.err)
+	}
+}
+
+func TestTraceIDInErrorDetails(t *testing.T) {
+	tracer := mocktracer.New()
+	errorInfo := &errdetails.ErrorInfo{Reason: "QUOTA"}
+	withInfo, _ := status.New(codes.ResourceExhausted, "quota").WithDetails(errorInfo)
+	errs := map[string]error{
+		"/pkg.Service/Status":  status.Error(codes.NotFound, "missing"),
+		"/pkg.Service/Details": withInfo.Err(),
+		"/pkg.Service/Plain":   errors.New("plain error"),
+		"/pkg.Service/Timeout": fmt.Errorf("call: %w", context.DeadlineExceeded),
+		"/pkg.Service/OK":      nil,
+	}
+	opt := WithTraceIDInErrorDetails()
+	cc := dialBufconn(t, serveBufconn(t,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			method, _ := grpc.MethodFromServerStream(ss)
+			if err := errs[method]; err != nil {
+				return err
+			}
+			return ss.SendMsg(&emptypb.Empty{})
+		},
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, opt))}))
+
+	for _, tc := range []struct {
+		method          string
+		expectedCode    codes.Code
+		expectedMessage string
+		expectedDetails int
+	}{
+		{"/pkg.Service/Status", codes.NotFound, "missing", 1},
+		{"/pkg.Service/Details", codes.ResourceExhausted, "quota", 2},
+		{"/pkg.Service/Plain", codes.Unknown, "plain error", 1},
+		{"/pkg.Service/Timeout", codes.DeadlineExceeded, "call: context deadline exceeded", 1},
+		{"/pkg.Service/OK", codes.OK, "", 0},
+	} {
+		tracer.Reset()
+		err := cc.Invoke(context.Background(), tc.method, &emptypb.Empty{}, &emptypb.Empty{})
+		st := status.Convert(err)
+		assert.Equal(t, tc.expectedCode, st.Code(), tc.method)
+		assert.Equal(t, tc.expectedMessage, st.Message(), tc.method)
+		details := st.Details()
+		if !assert.Len(t, details, tc.expectedDetails, tc.method) || len(details) == 0 {
+			continue
+		}
+		if tc.expectedDetails == 2 {
+			assert.Equal(t, errorInfo.Reason, details[0].(*errdetails.ErrorInfo).Reason)
+		}
+		span := waitForSpans(t, tracer, 1, bySpanID)[0]
+		requestInfo := details[len(details)-1].(*errdetails.RequestInfo)
+		assert.Equal(t, strconv.Itoa(span.SpanContext.TraceID), requestInfo.RequestId, tc.method)
+		// The span is tagged with the error of the handler.
+		assert.Equal(t, tc.expectedCode.String(), span.Tag("grpc.code"), tc.method)
+	}
+
+	// The unary interceptor uses the extractor of WithTraceIDResponseHeader.
+	_, err := OpenTracingServerInterceptor(tracer, opt, WithTraceIDResponseHeader("x-trace-id",
+		func(opentracing.SpanContext) string { return "custom" }))(context.Background(), nil, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.Internal, "")
+		})
+	details := status.Convert(err).Details()
+	if assert.Len(t, details, 1) {
+		assert.Equal(t, "custom", details[0].(*errdetails.RequestInfo).RequestId)
+	}
+}
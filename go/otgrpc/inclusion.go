@@ -0,0 +1,180 @@
+package otgrpc
+
+import (
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	healthService = "grpc.health.v1.Health"
+)
+
+var reflectionServices = []string{
+	"grpc.reflection.v1alpha.ServerReflection",
+	"grpc.reflection.v1.ServerReflection",
+}
+
+// ExcludeMethods returns a SpanInclusionFunc that excludes the gRPC methods
+// whose full name, e.g. "/pkg.Service/Method", is one of methods. Names must
+// match exactly; see ExcludeServices to exclude every method of a service.
+func ExcludeMethods(methods ...string) SpanInclusionFunc {
+	excluded := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		excluded[method] = struct{}{}
+	}
+	return func(
+		parentSpanCtx opentracing.SpanContext,
+		method string,
+		req, resp interface{}) bool {
+		_, ok := excluded[method]
+		return !ok
+	}
+}
+
+// ExcludeServices returns a SpanInclusionFunc that excludes every method of
+// the gRPC services whose full name, e.g. "pkg.Service", is one of services.
+func ExcludeServices(services ...string) SpanInclusionFunc {
+	prefixes := make([]string, len(services))
+	for i, service := range services {
+		prefixes[i] = "/" + service + "/"
+	}
+	return func(
+		parentSpanCtx opentracing.SpanContext,
+		method string,
+		req, resp interface{}) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(method, prefix) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ExcludeHealthCheck returns a SpanInclusionFunc that excludes the methods of
+// the standard gRPC health checking service.
+func ExcludeHealthCheck() SpanInclusionFunc {
+	return ExcludeServices(healthService)
+}
+
+// ExcludeReflection returns a SpanInclusionFunc that excludes the methods of
+// the standard gRPC server reflection service.
+func ExcludeReflection() SpanInclusionFunc {
+	return ExcludeServices(reflectionServices...)
+}
+
+// SampleFraction returns a SpanInclusionFunc that includes a gRPC call with
+// probability p: calls are never traced if p <= 0 and always if p >= 1. It is
+// safe for concurrent use and takes no locks.
+//
+// The decision is made by the interceptors independently of the sampler of
+// the tracer, which still applies to the calls SampleFraction includes: with
+// a tracer sampling 10% of traces, SampleFraction(0.5) records about 5% of
+// the calls.
+func SampleFraction(p float64) SpanInclusionFunc {
+	var threshold uint64
+	switch {
+	case p >= 1:
+		threshold = math.MaxUint64
+	case p > 0:
+		threshold = uint64(p * math.MaxUint64)
+	}
+	state := uint64(time.Now().UnixNano())
+	return func(
+		parentSpanCtx opentracing.SpanContext,
+		method string,
+		req, resp interface{}) bool {
+		if threshold == math.MaxUint64 {
+			return true
+		}
+		return splitMix64(atomic.AddUint64(&state, splitMix64Gamma)) < threshold
+	}
+}
+
+// splitMix64Gamma is the increment of the SplitMix64 generator.
+const splitMix64Gamma = 0x9e3779b97f4a7c15
+
+// splitMix64 is the output function of the SplitMix64 generator, mixing the
+// bits of its state x, which advances by splitMix64Gamma between outputs.
+// Advancing the state with an atomic add makes the generator lock-free.
+func splitMix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// AllInclusionFuncs returns a SpanInclusionFunc that includes a gRPC call only
+// if every one of funcs does. funcs are evaluated in order, and evaluation
+// stops at the first one that excludes the call.
+//
+// For example, to exclude health checks as well as a custom set of methods:
+//
+//	otgrpc.IncludingSpans(otgrpc.AllInclusionFuncs(
+//	    otgrpc.ExcludeHealthCheck(),
+//	    myInclusionFunc))
+func AllInclusionFuncs(funcs ...SpanInclusionFunc) SpanInclusionFunc {
+	return func(
+		parentSpanCtx opentracing.SpanContext,
+		method string,
+		req, resp interface{}) bool {
+		for _, f := range funcs {
+			if !f(parentSpanCtx, method, req, resp) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyInclusionFuncs returns a SpanInclusionFunc that includes a gRPC call if
+// any of funcs does. funcs are evaluated in order, and evaluation stops at the
+// first one that includes the call. With no funcs, every call is excluded.
+//
+// For example, to trace only the calls of a service and those with a sampled
+// parent:
+//
+//	otgrpc.IncludingSpans(otgrpc.AnyInclusionFuncs(
+//	    myServiceInclusionFunc,
+//	    mySampledParentInclusionFunc))
+func AnyInclusionFuncs(funcs ...SpanInclusionFunc) SpanInclusionFunc {
+	return func(
+		parentSpanCtx opentracing.SpanContext,
+		method string,
+		req, resp interface{}) bool {
+		for _, f := range funcs {
+			if f(parentSpanCtx, method, req, resp) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SpanContextIsSampled reports whether spanContext is sampled according to
+// its IsSampled method, like the SpanContexts of Jaeger and of OpenTelemetry
+// bridges, or its Sampled method. SpanContexts with neither are deemed
+// sampled. It is meant for WithRespectUpstreamSampling.
+func SpanContextIsSampled(spanContext opentracing.SpanContext) bool {
+	switch sc := spanContext.(type) {
+	case interface{ IsSampled() bool }:
+		return sc.IsSampled()
+	case interface{ Sampled() bool }:
+		return sc.Sampled()
+	}
+	return true
+}
+
+// SpanContextFlagsSampled reports whether spanContext is sampled according to
+// the sampled bit, the lowest one, of the byte returned by its Flags method,
+// like Jaeger's flags or W3C trace-flags. SpanContexts without it are deemed
+// sampled. It is meant for WithRespectUpstreamSampling.
+func SpanContextFlagsSampled(spanContext opentracing.SpanContext) bool {
+	if sc, ok := spanContext.(interface{ Flags() byte }); ok {
+		return sc.Flags()&1 != 0
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package otgrpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestExcludeMethods(t *testing.T) {
+	exclude := ExcludeMethods("/pkg.Service/Method", "/pkg.Other/Method")
+	assert.False(t, exclude(nil, "/pkg.Service/Method", nil, nil), "exact match")
+	assert.False(t, exclude(nil, "/pkg.Other/Method", nil, nil), "exact match")
+	assert.True(t, exclude(nil, "/pkg.Service/MethodV2", nil, nil), "prefix only")
+	assert.True(t, exclude(nil, "/pkg.Service/OtherMethod", nil, nil), "no match")
+}
+
+func TestExcludeServices(t *testing.T) {
+	exclude := ExcludeServices("pkg.Service")
+	assert.False(t, exclude(nil, "/pkg.Service/Method", nil, nil))
+	assert.False(t, exclude(nil, "/pkg.Service/OtherMethod", nil, nil))
+	assert.True(t, exclude(nil, "/pkg.ServiceV2/Method", nil, nil), "service name prefix only")
+	assert.True(t, exclude(nil, "/pkg.Other/Method", nil, nil), "no match")
+}
+
+func TestExcludeHealthCheckAndReflection(t *testing.T) {
+	include := AllInclusionFuncs(ExcludeHealthCheck(), ExcludeReflection())
+	assert.False(t, include(nil, "/grpc.health.v1.Health/Check", nil, nil))
+	assert.False(t, include(nil, "/grpc.health.v1.Health/Watch", nil, nil))
+	assert.False(t, include(nil, "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", nil, nil))
+	assert.False(t, include(nil, "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", nil, nil))
+	assert.True(t, include(nil, "/pkg.Service/Method", nil, nil))
+}
+
+// inclusionRecorder returns a SpanInclusionFunc returning result that appends
+// name to *calls when called.
+func inclusionRecorder(calls *[]string, name string, result bool) SpanInclusionFunc {
+	return func(parentSpanCtx opentracing.SpanContext, method string, req, resp interface{}) bool {
+		*calls = append(*calls, name)
+		return result
+	}
+}
+
+func TestAllInclusionFuncs(t *testing.T) {
+	var calls []string
+	recorder := func(name string, result bool) SpanInclusionFunc {
+		return inclusionRecorder(&calls, name, result)
+	}
+	assert.True(t, AllInclusionFuncs()(nil, "/pkg.Service/Method", nil, nil))
+	assert.True(t, AllInclusionFuncs(recorder("a", true), recorder("b", true))(nil, "/pkg.Service/Method", nil, nil))
+	assert.Equal(t, []string{"a", "b"}, calls)
+
+	calls = nil
+	assert.False(t, AllInclusionFuncs(recorder("a", false), recorder("b", true))(nil, "/pkg.Service/Method", nil, nil))
+	assert.Equal(t, []string{"a"}, calls, "evaluation must stop at the first exclusion")
+}
+
+func TestAnyInclusionFuncs(t *testing.T) {
+	var calls []string
+	recorder := func(name string, result bool) SpanInclusionFunc {
+		return inclusionRecorder(&calls, name, result)
+	}
+	assert.False(t, AnyInclusionFuncs()(nil, "/pkg.Service/Method", nil, nil))
+	assert.False(t, AnyInclusionFuncs(recorder("a", false), recorder("b", false))(nil, "/pkg.Service/Method", nil, nil))
+	assert.Equal(t, []string{"a", "b"}, calls)
+
+	calls = nil
+	assert.True(t, AnyInclusionFuncs(recorder("a", true), recorder("b", false))(nil, "/pkg.Service/Method", nil, nil))
+	assert.Equal(t, []string{"a"}, calls, "evaluation must stop at the first inclusion")
+
+	// Combined with AllInclusionFuncs.
+	include := AllInclusionFuncs(ExcludeHealthCheck(), AnyInclusionFuncs(
+		ExcludeServices("pkg.Other"),
+		ExcludeMethods("/pkg.Other/Method")))
+	assert.False(t, include(nil, "/grpc.health.v1.Health/Check", nil, nil))
+	assert.True(t, include(nil, "/pkg.Other/OtherMethod", nil, nil))
+	assert.False(t, include(nil, "/pkg.Other/Method", nil, nil))
+	assert.True(t, include(nil, "/pkg.Service/Method", nil, nil))
+}
+
+func TestSampleFraction(t *testing.T) {
+	const calls = 100000
+	for _, p := range []float64{-1, 0, 0.1, 0.5, 1, 2} {
+		include := SampleFraction(p)
+		var included uint64
+		var wg sync.WaitGroup
+		for g := 0; g < 10; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < calls/10; i++ {
+					if include(nil, "/pkg.Service/Method", nil, nil) {
+						atomic.AddUint64(&included, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		expected := p
+		if expected < 0 {
+			expected = 0
+		} else if expected > 1 {
+			expected = 1
+		}
+		assert.InDelta(t, expected, float64(included)/calls, 0.01, "p = %v", p)
+	}
+}
+
+func BenchmarkSampleFraction(b *testing.B) {
+	include := SampleFraction(0.1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			include(nil, "/pkg.Service/Method", nil, nil)
+		}
+	})
+}
+
+// flagsSpanContext is a SpanContext with a Flags method.
+type flagsSpanContext struct {
+	opentracing.SpanContext
+	flags byte
+}
+
+func (sc flagsSpanContext) Flags() byte { return sc.flags }
+
+// sampledMethodSpanContext is a SpanContext with a Sampled method.
+type sampledMethodSpanContext struct {
+	opentracing.SpanContext
+	sampled bool
+}
+
+func (sc sampledMethodSpanContext) Sampled() bool { return sc.sampled }
+
+func TestSpanContextSampledPredicates(t *testing.T) {
+	for _, tc := range []struct {
+		spanContext             opentracing.SpanContext
+		isSampled, flagsSampled bool
+	}{
+		{sampledSpanContext{sampled: true}, true, true},
+		{sampledSpanContext{sampled: false}, false, true},
+		{sampledMethodSpanContext{sampled: true}, true, true},
+		{sampledMethodSpanContext{sampled: false}, false, true},
+		{flagsSpanContext{flags: 0x1}, true, true},
+		{flagsSpanContext{flags: 0x3}, true, true},
+		{flagsSpanContext{flags: 0x0}, true, false},
+		{flagsSpanContext{flags: 0x2}, true, false},
+		{mocktracer.MockSpanContext{}, true, true},
+	} {
+		assert.Equal(t, tc.isSampled, SpanContextIsSampled(tc.spanContext), "%+v", tc.spanContext)
+		assert.Equal(t, tc.flagsSampled, SpanContextFlagsSampled(tc.spanContext), "%+v", tc.spanContext)
+	}
+}
@@ -0,0 +1,106 @@
+package otgrpc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"golang.org/x/net/context"
+)
+
+// SpanContextIDsFunc returns the trace and span IDs of spanContext, or false
+// if they cannot be told.
+type SpanContextIDsFunc func(spanContext opentracing.SpanContext) (traceID, spanID string, ok bool)
+
+// SpanContextFields returns the "trace_id" and "span_id" log fields of the
+// Span in ctx, e.g. the server span in the context of a handler, for
+// application logs to be correlated with the trace. The IDs are found with
+// ids, e.g. SpanContextIDs. It returns nil if ctx has no Span or its IDs
+// cannot be told.
+func SpanContextFields(ctx context.Context, ids SpanContextIDsFunc) []log.Field {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	traceID, spanID, ok := ids(span.Context())
+	if !ok {
+		return nil
+	}
+	return []log.Field{
+		log.String("trace_id", traceID),
+		log.String("span_id", spanID),
+	}
+}
+
+// TraceIDFunc returns the trace ID of spanContext, or "" if it cannot be
+// told.
+type TraceIDFunc func(spanContext opentracing.SpanContext) string
+
+// SpanContextTraceID is a TraceIDFunc for SpanContexts with a TraceID method,
+// like Jaeger's, or field, like Zipkin's and the mocktracer's.
+func SpanContextTraceID(spanContext opentracing.SpanContext) string {
+	v := reflect.ValueOf(spanContext)
+	if !v.IsValid() {
+		return ""
+	}
+	traceID, _ := idValue(v, "TraceID")
+	return traceID
+}
+
+// CarrierTraceID returns a TraceIDFunc that falls back from
+// SpanContextTraceID to injecting the SpanContext with tracer into a TextMap
+// carrier and reading the key of the carrier named key, case-insensitively,
+// e.g. "ot-tracer-traceid" for LightStep or "x-b3-traceid" for B3.
+func CarrierTraceID(tracer opentracing.Tracer, key string) TraceIDFunc {
+	return func(spanContext opentracing.SpanContext) string {
+		if traceID := SpanContextTraceID(spanContext); traceID != "" {
+			return traceID
+		}
+		carrier := opentracing.TextMapCarrier{}
+		if err := tracer.Inject(spanContext, opentracing.TextMap, carrier); err != nil {
+			return ""
+		}
+		for k, v := range carrier {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+		return ""
+	}
+}
+
+// SpanContextIDs is a SpanContextIDsFunc for SpanContexts with TraceID and
+// SpanID methods, like Jaeger's, or fields, like Zipkin's and the
+// mocktracer's.
+func SpanContextIDs(spanContext opentracing.SpanContext) (traceID, spanID string, ok bool) {
+	v := reflect.ValueOf(spanContext)
+	if !v.IsValid() {
+		return "", "", false
+	}
+	traceID, traceOK := idValue(v, "TraceID")
+	spanID, spanOK := idValue(v, "SpanID")
+	return traceID, spanID, traceOK && spanOK
+}
+
+// idValue formats the result of the method named name of v, or else the
+// value of its field of that name.
+func idValue(v reflect.Value, name string) (string, bool) {
+	if m := v.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() == 1 {
+		return fmt.Sprint(m.Call(nil)[0].Interface()), true
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+	if f := v.FieldByName(name); f.IsValid() && f.CanInterface() {
+		return fmt.Sprint(f.Interface()), true
+	}
+	return "", false
+}
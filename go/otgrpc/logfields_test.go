@@ -0,0 +1,97 @@
+package otgrpc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+)
+
+// hexID mimics the Stringer ID types of tracers like Jaeger.
+type hexID uint64
+
+func (id hexID) String() string { return fmt.Sprintf("%x", uint64(id)) }
+
+// methodSpanContext is shaped like a Jaeger SpanContext.
+type methodSpanContext struct {
+	traceID, spanID hexID
+}
+
+func (c methodSpanContext) TraceID() hexID                            { return c.traceID }
+func (c methodSpanContext) SpanID() hexID                             { return c.spanID }
+func (c methodSpanContext) ForeachBaggageItem(func(k, v string) bool) {}
+
+type contextSpan struct {
+	opentracing.Span
+	spanContext opentracing.SpanContext
+}
+
+func (s contextSpan) Context() opentracing.SpanContext { return s.spanContext }
+
+func TestSpanContextFields(t *testing.T) {
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("span").(*mocktracer.MockSpan)
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	assert.Equal(t, []log.Field{
+		log.String("trace_id", fmt.Sprint(span.SpanContext.TraceID)),
+		log.String("span_id", fmt.Sprint(span.SpanContext.SpanID)),
+	}, SpanContextFields(ctx, SpanContextIDs))
+
+	ctx = opentracing.ContextWithSpan(context.Background(),
+		contextSpan{span, methodSpanContext{traceID: 0xabc, spanID: 0xdef}})
+	assert.Equal(t, []log.Field{
+		log.String("trace_id", "abc"),
+		log.String("span_id", "def"),
+	}, SpanContextFields(ctx, SpanContextIDs))
+
+	assert.Nil(t, SpanContextFields(context.Background(), SpanContextIDs))
+	ctx = opentracing.ContextWithSpan(context.Background(), opentracing.NoopTracer{}.StartSpan("span"))
+	assert.Nil(t, SpanContextFields(ctx, SpanContextIDs))
+
+	// Unrecognized SpanContexts can be supported by passing another
+	// SpanContextIDsFunc.
+	ids := func(spanContext opentracing.SpanContext) (string, string, bool) {
+		return "trace", "span", true
+	}
+	assert.Equal(t, []log.Field{
+		log.String("trace_id", "trace"),
+		log.String("span_id", "span"),
+	}, SpanContextFields(ctx, ids))
+}
+
+// opaqueSpanContext hides the IDs of a mocktracer SpanContext.
+type opaqueSpanContext struct {
+	sc mocktracer.MockSpanContext
+}
+
+func (c opaqueSpanContext) ForeachBaggageItem(func(k, v string) bool) {}
+
+// opaqueTracer injects opaqueSpanContexts.
+type opaqueTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t opaqueTracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return t.MockTracer.Inject(sc.(opaqueSpanContext).sc, format, carrier)
+}
+
+func TestTraceIDFuncs(t *testing.T) {
+	tracer := mocktracer.New()
+	mockContext := tracer.StartSpan("span").Context().(mocktracer.MockSpanContext)
+	traceID := fmt.Sprint(mockContext.TraceID)
+
+	assert.Equal(t, "a", SpanContextTraceID(methodSpanContext{traceID: 10, spanID: 11}))
+	assert.Equal(t, traceID, SpanContextTraceID(mockContext))
+	assert.Equal(t, "", SpanContextTraceID(opaqueSpanContext{mockContext}))
+	assert.Equal(t, "", SpanContextTraceID(nil))
+
+	extract := CarrierTraceID(opaqueTracer{tracer}, "MockPfx-Ids-TraceId")
+	assert.Equal(t, "a", extract(methodSpanContext{traceID: 10, spanID: 11}))
+	assert.Equal(t, traceID, extract(opaqueSpanContext{mockContext}))
+	assert.Equal(t, "", CarrierTraceID(opaqueTracer{tracer}, "missing")(opaqueSpanContext{mockContext}))
+}
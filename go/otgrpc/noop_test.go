@@ -0,0 +1,85 @@
+package otgrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func nopHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func nopStreamHandler(srv interface{}, ss grpc.ServerStream) error {
+	return nil
+}
+
+func TestNoopTracerPassThrough(t *testing.T) {
+	ctx := context.Background()
+	ss := &fakeServerStream{ctx: ctx}
+	for _, tracer := range []opentracing.Tracer{nil, opentracing.NoopTracer{}} {
+		unary := OpenTracingServerInterceptor(tracer)
+		stream := OpenTracingStreamServerInterceptor(tracer)
+		client := OpenTracingClientInterceptor(tracer)
+		streamClient := OpenTracingStreamClientInterceptor(tracer)
+		assert.Zero(t, testing.AllocsPerRun(100, func() {
+			unary(ctx, nil, unaryInfo, nopHandler)
+			stream(nil, ss, streamInfo, nopStreamHandler)
+			client(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		}))
+		// The client stream is passed through unwrapped.
+		cs, err := streamClient(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		assert.IsType(t, &fakeClientStream{}, cs)
+	}
+}
+
+func TestNoopTracerDelegatedInterceptors(t *testing.T) {
+	var delegated []string
+	unary := OpenTracingServerInterceptor(opentracing.NoopTracer{}, WithServerInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			delegated = append(delegated, "unary")
+			return handler(ctx, req)
+		}))
+	stream := OpenTracingStreamServerInterceptor(opentracing.NoopTracer{}, WithStreamServerInterceptor(
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			delegated = append(delegated, "stream")
+			return handler(srv, ss)
+		}))
+	_, err := unary(context.Background(), nil, unaryInfo, nopHandler)
+	assert.NoError(t, err)
+	err = stream(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, nopStreamHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unary", "stream"}, delegated)
+}
+
+func BenchmarkServerInterceptorNoopTracer(b *testing.B) {
+	interceptor := OpenTracingServerInterceptor(opentracing.NoopTracer{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		interceptor(ctx, nil, unaryInfo, nopHandler)
+	}
+}
+
+func BenchmarkStreamServerInterceptorNoopTracer(b *testing.B) {
+	interceptor := OpenTracingStreamServerInterceptor(opentracing.NoopTracer{})
+	ss := &fakeServerStream{ctx: context.Background()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		interceptor(nil, ss, streamInfo, nopStreamHandler)
+	}
+}
+
+func BenchmarkClientInterceptorNoopTracer(b *testing.B) {
+	interceptor := OpenTracingClientInterceptor(opentracing.NoopTracer{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		interceptor(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	}
+}
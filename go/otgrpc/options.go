@@ -2,9 +2,16 @@ package otgrpc
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // Option instances may be used in OpenTracing(Server|Client)Interceptor
@@ -15,13 +22,117 @@ import (
 type Option func(o *options)
 
 // LogPayloads returns an Option that tells the OpenTracing instrumentation to
-// try to log application payloads in both directions.
+// try to log application payloads in both directions. On streaming RPCs, every
+// message is logged on the stream span along with its direction and sequence
+// number; see MaxStreamPayloadLogs.
+//
+// LogPayloads is the union of LogRequestPayloads and LogResponsePayloads.
 func LogPayloads() Option {
 	return func(o *options) {
-		o.logPayloads = true
+		o.logRequests = true
+		o.logResponses = true
+	}
+}
+
+// LogRequestPayloads returns an Option that tells the OpenTracing
+// instrumentation to log request payloads only, i.e. the messages sent by
+// clients.
+func LogRequestPayloads() Option {
+	return func(o *options) {
+		o.logRequests = true
+	}
+}
+
+// LogResponsePayloads returns an Option that tells the OpenTracing
+// instrumentation to log response payloads only, i.e. the messages sent by
+// servers.
+func LogResponsePayloads() Option {
+	return func(o *options) {
+		o.logResponses = true
+	}
+}
+
+// LogPayloadsOnError returns an Option that tells the OpenTracing
+// instrumentation of unary RPCs to log the request payload, along with the
+// response payload if there is one, only if the RPC fails, as decided by the
+// ErrorClassifierFunc bound by WithErrorClassifier if any, with a code not
+// given to WithNonErrorCodes. Successful RPCs
+// only pay for holding on to the request. LogPayloads, LogRequestPayloads and
+// LogResponsePayloads take precedence over it.
+func LogPayloadsOnError() Option {
+	return func(o *options) {
+		o.logPayloadsOnError = true
+	}
+}
+
+// WithPayloadLogOnErrorOnly is an alias for LogPayloadsOnError.
+func WithPayloadLogOnErrorOnly() Option {
+	return LogPayloadsOnError()
+}
+
+// MaxPayloadLogSize returns an Option that caps the size of the payloads
+// logged because of LogPayloads. Payloads are serialized to a string and, if
+// that string is longer than size bytes, truncated to at most size bytes
+// (including a "...(truncated, original N bytes)" marker); the original size
+// is then logged as a separate field. A size <= 0 disables the cap.
+func MaxPayloadLogSize(size int) Option {
+	return func(o *options) {
+		o.maxPayloadLogSize = size
+	}
+}
+
+// WithMaxPayloadLogSize is an alias for MaxPayloadLogSize.
+func WithMaxPayloadLogSize(size int) Option {
+	return MaxPayloadLogSize(size)
+}
+
+// MaxStreamPayloadLogs returns an Option that caps the number of messages
+// logged because of LogPayloads on each streaming RPC. Once n messages have
+// been logged on a stream, a single "payload logging capped" event is logged
+// in place of the remaining ones. An n <= 0 disables the cap.
+func MaxStreamPayloadLogs(n int) Option {
+	return func(o *options) {
+		o.maxStreamPayloadLogs = n
+	}
+}
+
+// PayloadDirection tells a PayloadRedactorFunc which payload of an RPC it is
+// being asked to redact.
+type PayloadDirection int
+
+const (
+	// RequestPayload is the request message of an RPC.
+	RequestPayload PayloadDirection = iota
+	// ResponsePayload is the response message of an RPC.
+	ResponsePayload
+)
+
+// PayloadRedactorFunc returns the representation of msg that should be logged
+// in its place, e.g. a copy with passwords and tokens blanked out, or nil to
+// not log msg at all. It must not modify msg itself.
+type PayloadRedactorFunc func(fullMethod string, msg interface{}, direction PayloadDirection) interface{}
+
+// WithPayloadRedactor binds a function that redacts the payloads logged
+// because of LogPayloads before they are handed to the tracer.
+func WithPayloadRedactor(redactor PayloadRedactorFunc) Option {
+	return func(o *options) {
+		o.payloadRedactor = redactor
 	}
 }
 
+// PayloadSanitizerFunc is a PayloadRedactorFunc that treats requests and
+// responses alike.
+type PayloadSanitizerFunc func(method string, msg interface{}) interface{}
+
+// WithPayloadSanitizer binds a function that sanitizes the payloads logged
+// because of LogPayloads, in both directions. It is a shorthand for
+// WithPayloadRedactor, which it overrides.
+func WithPayloadSanitizer(sanitizer PayloadSanitizerFunc) Option {
+	return WithPayloadRedactor(func(fullMethod string, msg interface{}, direction PayloadDirection) interface{} {
+		return sanitizer(fullMethod, msg)
+	})
+}
+
 // LogError returns an Option that tells the OpenTracing instrumentation to
 // try to log errors in both directions.
 func LogError() Option {
@@ -30,27 +141,742 @@ func LogError() Option {
 	}
 }
 
+// TagTarget returns an Option that tells the OpenTracing client
+// instrumentation to tag client spans with the target the grpc.ClientConn was
+// dialed against, as well as the peer host and port parsed from that target.
+func TagTarget() Option {
+	return func(o *options) {
+		o.tagTarget = true
+	}
+}
+
+// TagServiceMethod returns an Option that tells the OpenTracing
+// instrumentation to tag client and server spans with the service and the
+// method parsed from the full gRPC method name, under "grpc.service" and
+// "grpc.method". The tags are set whatever the operation name of the spans,
+// which makes service-level rollups possible with WithOperationNameFunc.
+func TagServiceMethod() Option {
+	return func(o *options) {
+		o.tagServiceMethod = true
+	}
+}
+
+// WithStreamMessageSpans returns an Option that tells the OpenTracing
+// instrumentation to create a short-lived child span of the stream span for
+// every message sent or received on a streaming RPC, on both the client and
+// the server. Each message span is tagged with its direction and a per-stream
+// sequence number so that the relative ordering of messages can be recovered;
+// the stream span is tagged with the total number of messages.
+func WithStreamMessageSpans() Option {
+	return func(o *options) {
+		o.streamMessageSpans = true
+	}
+}
+
+// WithStreamLifecycleEvents returns an Option that tells the OpenTracing
+// server instrumentation to log a "stream.open" event on stream spans as soon
+// as they are started and a "stream.close" event right before they are
+// finished, to tell a slow stream setup apart from a slow teardown.
+func WithStreamLifecycleEvents() Option {
+	return func(o *options) {
+		o.streamLifecycleEvents = true
+	}
+}
+
+// OperationNameFunc maps the full gRPC method name, e.g.
+// "/pkg.Service/Method", to the operation name of the Span created for it.
+type OperationNameFunc func(fullMethod string) string
+
+// WithOperationNameFunc binds a function that computes the operation name of
+// client and server Spans. By default the full gRPC method name is used.
+func WithOperationNameFunc(f OperationNameFunc) Option {
+	return func(o *options) {
+		o.opNameFunc = f
+	}
+}
+
+// WithComponentName returns an Option that sets the "component" tag of the
+// spans of the OpenTracing instrumentation to name, e.g. "grpc-internal",
+// instead of "gRPC".
+func WithComponentName(name string) Option {
+	return func(o *options) {
+		o.componentName = name
+	}
+}
+
+// WithStaticTags returns an Option that sets tags, e.g.
+// "deployment.environment" or "service.version", on every span of the
+// OpenTracing instrumentation right after it is started. Tags set later, e.g.
+// by a SpanDecoratorFunc, take precedence. It may be given several times, in
+// which case the tags are merged, the later ones winning.
+func WithStaticTags(tags opentracing.Tags) Option {
+	return func(o *options) {
+		// Copied, as WithMethodOverrides shares the map of o.
+		m := make(opentracing.Tags, len(o.staticTags)+len(tags))
+		for k, v := range o.staticTags {
+			m[k] = v
+		}
+		for k, v := range tags {
+			m[k] = v
+		}
+		o.staticTags = m
+	}
+}
+
+// ErrorClassifierFunc decides whether the error returned by an RPC should flag
+// its Span as failed. The returned class, e.g. the name of the gRPC status
+// code, is recorded in the "error.class" tag when non-empty.
+type ErrorClassifierFunc func(err error) (isError bool, class string)
+
+// WithErrorClassifier binds a function that replaces the default error
+// tagging performed by SetSpanTags when LogError is enabled, e.g. to keep
+// routine NotFound responses from being reported as errors.
+func WithErrorClassifier(classifier ErrorClassifierFunc) Option {
+	return func(o *options) {
+		o.errorClassifier = classifier
+	}
+}
+
+// WithNonErrorCodes returns an Option that keeps the OpenTracing
+// instrumentation from flagging spans as failed with ext.Error when their RPC
+// fails with one of the given gRPC status codes, e.g. codes.NotFound or
+// codes.AlreadyExists for RPCs whose callers expect them. Such errors are
+// still tagged and logged as usual when LogError is enabled. It applies to
+// the default error tagging and to the ErrorClassifierFunc, but not to the
+// ErrorTaggerFunc, if any. It may be given several times, in which case the
+// codes add up.
+func WithNonErrorCodes(nonErrorCodes ...codes.Code) Option {
+	return func(o *options) {
+		// Copied, as WithMethodOverrides shares the map of o.
+		m := make(map[codes.Code]struct{}, len(o.nonErrorCodes)+len(nonErrorCodes))
+		for code := range o.nonErrorCodes {
+			m[code] = struct{}{}
+		}
+		for _, code := range nonErrorCodes {
+			m[code] = struct{}{}
+		}
+		o.nonErrorCodes = m
+	}
+}
+
+// ErrorTaggerFunc tags span according to the error returned by an RPC, e.g.
+// with "error.kind" and "error.object" tags.
+type ErrorTaggerFunc func(span opentracing.Span, err error, isClient bool)
+
+// WithErrorTagger binds a function that replaces the default error tagging
+// performed by SetSpanTags when LogError is enabled. It takes precedence over
+// the ErrorClassifierFunc bound by WithErrorClassifier.
+func WithErrorTagger(tagger ErrorTaggerFunc) Option {
+	return func(o *options) {
+		o.errorTagger = tagger
+	}
+}
+
+// WithMessageSizeTags returns an Option that tells the OpenTracing
+// instrumentation of unary RPCs to tag spans with the serialized size in bytes
+// of the request, under "grpc.request.size", and of the response on success,
+// under "grpc.response.size". Messages that are not protocol buffers are not
+// tagged.
+//
+// Stream spans are tagged with the total size of the messages sent and
+// received on the stream instead, under "grpc.stream.bytes_sent" and
+// "grpc.stream.bytes_received". Messages that are not protocol buffers are
+// not counted.
+func WithMessageSizeTags() Option {
+	return func(o *options) {
+		o.messageSizeTags = true
+	}
+}
+
+// WithAuthorityTag returns an Option that tells the OpenTracing server
+// instrumentation to tag server spans with the ":authority" header of the RPC,
+// i.e. the virtual host it targeted, under "grpc.authority".
+func WithAuthorityTag() Option {
+	return func(o *options) {
+		o.authorityTag = true
+	}
+}
+
+// WithStreamFinishOnLastSend returns an Option that tells the OpenTracing
+// server instrumentation to finish stream spans at the time the handler last
+// sent a message successfully, rather than when it returns, and to log a
+// "last_send" event at that time. Streams that sent no message are finished
+// as usual.
+//
+// Note that grpc.ServerStream.SendMsg returns once the message is queued for
+// the transport, not once the client receives it, so neither time tells when
+// the stream is drained. Finishing at the last send leaves out of the span
+// whatever the handler does afterwards, including its error handling; events
+// logged then, like errors or "stream.close", fall after the span's end.
+func WithStreamFinishOnLastSend() Option {
+	return func(o *options) {
+		o.finishOnLastSend = true
+	}
+}
+
+// RequestTagsFunc returns the tags to set on the span of a unary RPC from its
+// request message.
+type RequestTagsFunc func(req interface{}) map[string]interface{}
+
+// WithTagFromRequest returns an Option that tells the OpenTracing
+// instrumentation to tag the spans of the unary RPCs of the gRPC method
+// fullMethod, e.g. "/pkg.Users/GetUser", with the tags extractor returns for
+// their request, e.g. a user ID. This captures a few business identifiers
+// without logging the whole payload. The tags are set right after the span is
+// started.
+func WithTagFromRequest(fullMethod string, extractor RequestTagsFunc) Option {
+	return func(o *options) {
+		if o.requestTags == nil {
+			o.requestTags = make(map[string][]RequestTagsFunc)
+		}
+		o.requestTags[fullMethod] = append(o.requestTags[fullMethod], extractor)
+	}
+}
+
+// SpanTagsFunc returns the tags to set on the span of an RPC of the gRPC
+// method method. req is the request message of unary RPCs and nil for
+// streaming RPCs, whose tags may still be derived from the metadata of ctx.
+// A nil map sets no tags.
+type SpanTagsFunc func(ctx context.Context, method string, req interface{}) opentracing.Tags
+
+// WithSpanTagsFunc binds a function computing tags for the span of each RPC,
+// e.g. a sharding key read from a request field. The OpenTracing interceptors
+// call it once the span is started, before calling the handler or the
+// invoker. A panic inside it is recovered and reported to the
+// TracingErrorHandlerFunc, if any, and does not affect the RPC.
+func WithSpanTagsFunc(f SpanTagsFunc) Option {
+	return func(o *options) {
+		o.spanTagsFunc = f
+	}
+}
+
+// WithMetadataTags returns an Option that tells the OpenTracing
+// instrumentation to tag spans with the metadata headers named in allowlist,
+// e.g. "x-request-id", under "grpc.metadata.<name>". Names are matched
+// case-insensitively and tagged in lower case. The values of a header sent
+// several times are joined with commas, in order. Binary headers, whose name
+// ends with "-bin", are skipped, as are the headers an RPC does not carry.
+//
+// Server spans are tagged from the metadata attached with NewContext, if any,
+// or else from the incoming gRPC metadata; client spans from the outgoing
+// gRPC metadata, if any, or else from the metadata attached with NewContext.
+func WithMetadataTags(allowlist ...string) Option {
+	return func(o *options) {
+		keys := make([]string, 0, len(o.metadataTags)+len(allowlist))
+		keys = append(keys, o.metadataTags...)
+		for _, key := range allowlist {
+			if key = strings.ToLower(key); !strings.HasSuffix(key, binHdrSuffix) {
+				keys = append(keys, key)
+			}
+		}
+		o.metadataTags = keys
+	}
+}
+
+// WithResponseTraceHeader returns an Option that tells the OpenTracing server
+// interceptors to send the SpanContext of server spans back to the client in
+// the response header metadata, in the propagation format of the
+// interceptors, so that clients without tracing can log the trace of their
+// calls. It is sent in the trailer instead if the header was already sent,
+// and failures are reported to the TracingErrorHandlerFunc, if any.
+func WithResponseTraceHeader() Option {
+	return func(o *options) {
+		o.responseTraceHeader = true
+	}
+}
+
+// WithTraceIDResponseHeader returns an Option that tells the OpenTracing
+// server interceptors to send the trace ID of server spans back to the client
+// in the response header metadata under headerName, e.g. for frontends to
+// show it in error dialogs. The trace ID is found with extract, or with
+// SpanContextTraceID if it is nil; CarrierTraceID supports tracers whose
+// SpanContexts do not expose it. As with WithResponseTraceHeader, it is sent
+// in the trailer instead if the header was already sent.
+func WithTraceIDResponseHeader(headerName string, extract TraceIDFunc) Option {
+	return func(o *options) {
+		o.traceIDHeader = strings.ToLower(headerName)
+		o.traceIDFunc = extract
+	}
+}
+
+// WithTraceIDInErrorDetails returns an Option that tells the OpenTracing
+// server interceptors to append an errdetails.RequestInfo whose RequestId is
+// the trace ID of the server span to the details of the status errors that
+// RPCs fail with, so that clients can quote it in support tickets. The code,
+// message and other details of the status are kept, and errors that are not
+// status errors are converted with status.FromError first. The trace ID is
+// found with the function given to WithTraceIDResponseHeader, if any, or
+// else with SpanContextTraceID.
+func WithTraceIDInErrorDetails() Option {
+	return func(o *options) {
+		o.traceIDInErrorDetails = true
+	}
+}
+
+// WithParentPresenceTag returns an Option that tells the OpenTracing server
+// instrumentation to tag server spans with whether the SpanContext of the
+// client was found in the RPC, under "grpc.has_parent", to tell continued
+// traces from new ones when looking for services that drop trace context.
+func WithParentPresenceTag() Option {
+	return func(o *options) {
+		o.parentPresenceTag = true
+	}
+}
+
+// WithDeadlineTag returns an Option that tells the OpenTracing server
+// instrumentation to tag server spans with the deadline of the RPC, if it has
+// one, as an RFC 3339 timestamp under "grpc.deadline", and with the
+// milliseconds left until then when the span starts under
+// "grpc.deadline_remaining_ms". A "deadline.exceeded" event is logged if the
+// handler returns after the deadline.
+func WithDeadlineTag() Option {
+	return func(o *options) {
+		o.deadlineTag = true
+	}
+}
+
+// WithPropagationFormat returns an Option that sets the format in which the
+// SpanContext is injected into, and extracted from, the gRPC metadata. The
+// default is opentracing.HTTPHeaders; opentracing.TextMap may be cheaper for
+// tracers that escape HTTP header values. With opentracing.Binary, the
+// SpanContext is carried in a single "ot-span-context-bin" metadata key.
+func WithPropagationFormat(format opentracing.BuiltinFormat) Option {
+	return func(o *options) {
+		o.propagationFormat = format
+	}
+}
+
+// WithPreserveExistingTraceHeaders returns an Option that tells the
+// OpenTracing client instrumentation to leave alone the tracing headers that
+// the outgoing metadata of an RPC already carries, e.g. because a proxy copied
+// them from the RPC it forwards. The client span is then a child of the
+// SpanContext these headers carry, and its own SpanContext is not injected.
+// RPCs without such headers are traced as usual.
+func WithPreserveExistingTraceHeaders() Option {
+	return func(o *options) {
+		o.preserveTraceHeaders = true
+	}
+}
+
+// WithRetryAttemptSpans returns an Option that tells the OpenTracing client
+// instrumentation to create a child span of the client span for every attempt
+// gRPC makes at the RPC, retries included. Attempt spans are named
+// "<method>/attempt-<n>" and tagged with the attempt number under
+// "grpc.attempt".
+//
+// Attempts are not visible to interceptors, so the spans are created by the
+// stats.Handler returned by RetryAttemptStatsHandler, which must be installed
+// as well:
+//
+//	conn, err := grpc.Dial(
+//	    address,
+//	    grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(
+//	        tracer, otgrpc.WithRetryAttemptSpans())),
+//	    grpc.WithStatsHandler(otgrpc.RetryAttemptStatsHandler()))
+func WithRetryAttemptSpans() Option {
+	return func(o *options) {
+		o.retryAttemptSpans = true
+	}
+}
+
+// WithClientTimingTags returns an Option that tells the OpenTracing client
+// instrumentation to tag client spans with the milliseconds the call took in
+// total, under "grpc.total_ms", and with the milliseconds it waited before
+// its headers were sent, i.e. queued for a ready connection, under
+// "grpc.wait_ms". The total of stream calls runs until their span is
+// finished.
+//
+// Connection readiness is not visible to interceptors, so the wait is tagged
+// by the stats.Handler returned by ClientTimingStatsHandler, which must be
+// installed as well:
+//
+//	conn, err := grpc.Dial(
+//	    address,
+//	    grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(
+//	        tracer, otgrpc.WithClientTimingTags())),
+//	    grpc.WithStatsHandler(otgrpc.ClientTimingStatsHandler()))
+func WithClientTimingTags() Option {
+	return func(o *options) {
+		o.clientTimingTags = true
+	}
+}
+
+// WithReferenceType returns an Option that sets the type of the reference
+// from server spans to the SpanContext of the client, e.g.
+// opentracing.FollowsFromRef for fire-and-forget RPCs whose callers do not
+// wait for the callee. The default is opentracing.ChildOfRef.
+func WithReferenceType(refType opentracing.SpanReferenceType) Option {
+	return func(o *options) {
+		o.referenceType = refType
+	}
+}
+
+// WithLocalParentPreference returns an Option that tells the OpenTracing
+// server interceptors to make server spans children of the span in the
+// context of the RPC, if any, e.g. for in-process calls through a loopback
+// connection whose caller's span is already in the context. The SpanContext
+// sent by the client, if any and if it is not the same one, is then only
+// referenced with FollowsFrom. By default, only the SpanContext sent by the
+// client is looked at.
+func WithLocalParentPreference() Option {
+	return func(o *options) {
+		o.localParentPreference = true
+	}
+}
+
+// WithClientReferenceType returns an Option that sets the type of the
+// reference from client spans to the span found in the context of the call,
+// if any, e.g. opentracing.FollowsFromRef for fire-and-forget notifications
+// that do not hold up their caller. The default is opentracing.ChildOfRef.
+// Server spans are not affected; see WithReferenceType.
+func WithClientReferenceType(refType opentracing.SpanReferenceType) Option {
+	return func(o *options) {
+		o.clientReferenceType = refType
+	}
+}
+
+// WithExtractFallbacks returns an Option that tells the OpenTracing server
+// instrumentation to try extracting the parent SpanContext of an RPC with each
+// of tracers, in order, whenever the interceptor's own tracer cannot find one.
+// This eases migrations between tracers that only understand their own
+// propagation headers, e.g. B3 and Jaeger.
+//
+// The server span is a root span only if no tracer finds a SpanContext. A
+// genuine extraction error from any tracer is reported to the tracing error
+// handler.
+func WithExtractFallbacks(tracers ...opentracing.Tracer) Option {
+	return func(o *options) {
+		o.extractFallbacks = tracers
+	}
+}
+
+// WithTracerProvider binds a function returning the Tracer to use, which is
+// called once per RPC instead of using the Tracer given to the interceptor
+// constructor. This is useful when the Tracer is only set up after the
+// interceptors are built, e.g.:
+//
+//	otgrpc.OpenTracingServerInterceptor(nil,
+//		otgrpc.WithTracerProvider(opentracing.GlobalTracer))
+//
+// A nil Tracer returned by provider stands for the NoopTracer.
+func WithTracerProvider(provider func() opentracing.Tracer) Option {
+	return func(o *options) {
+		o.tracerProvider = provider
+	}
+}
+
+// WithSpanFactory binds the SpanFactoryFunc with which the spans of the
+// interceptor or stats handler are started, e.g. to wrap them or to adjust
+// their options, in place of the deprecated StartSpanFactory variable, which
+// affects all of them at once. factory must start the span with tracer, and
+// is given all the options the span would otherwise be started with.
+func WithSpanFactory(factory SpanFactoryFunc) Option {
+	return func(o *options) {
+		o.spanFactory = factory
+	}
+}
+
+// WithStartSpanOptions adds opts to the options with which the spans of RPCs
+// are started, e.g. a StartTime or Tags that a Tracer samples on. They come
+// after the default ones, such as the span.kind and component tags, so they
+// override them. They are not applied to the spans of WithStreamMessageSpans.
+func WithStartSpanOptions(opts ...opentracing.StartSpanOption) Option {
+	return func(o *options) {
+		o.startSpanOptions = append(o.startSpanOptions, opts...)
+	}
+}
+
+// WithTracerFromContext binds a function returning the Tracer to trace an RPC
+// with from its context, e.g. a tenant-specific Tracer that a previous
+// interceptor stored there, so that spans can be routed to different
+// collectors without running several servers. The context is the incoming
+// one on servers and the one of the call on clients. When tracerFromContext
+// returns nil, the Tracer is chosen as if the Option was not given.
+func WithTracerFromContext(tracerFromContext func(ctx context.Context) opentracing.Tracer) Option {
+	return func(o *options) {
+		o.tracerFromContext = tracerFromContext
+	}
+}
+
+// WithTracingToggle binds a TracingToggle through which tracing can be
+// switched off and on at runtime. A single TracingToggle can be shared by
+// several interceptors, client and server, unary and stream.
+func WithTracingToggle(toggle *TracingToggle) Option {
+	return func(o *options) {
+		o.toggle = toggle
+	}
+}
+
+// IncomingKeyMapperFunc maps the key of an incoming metadata entry to the key
+// the Tracer expects, or returns false to hide the entry from the Tracer.
+type IncomingKeyMapperFunc func(key string) (string, bool)
+
+// WithIncomingKeyMapper binds a function rewriting the metadata keys seen by
+// the Tracer when the server interceptors extract the SpanContext of an RPC,
+// e.g. to strip the prefix legacy services put on trace headers:
+//
+//	otgrpc.WithIncomingKeyMapper(func(key string) (string, bool) {
+//		return strings.TrimPrefix(key, "legacy-"), true
+//	})
+//
+// It does not apply to the opentracing.Binary propagation format.
+func WithIncomingKeyMapper(mapper IncomingKeyMapperFunc) Option {
+	return func(o *options) {
+		o.incomingKeyMapper = mapper
+	}
+}
+
+// MetricsObserverFunc is called once per RPC, when it ends, with its full
+// method name, its gRPC status code, its duration, and whether it is a
+// streaming RPC, e.g. to feed RED metrics.
+type MetricsObserverFunc func(method string, code codes.Code, duration time.Duration, isStream bool)
+
+// WithMetricsObserver binds a function observing the outcome of the RPCs
+// traced by the OpenTracing interceptors, so that a single interceptor can
+// both trace RPCs and measure them. Streaming RPCs are observed when their
+// stream ends. Context errors map to the Canceled and DeadlineExceeded codes.
+//
+// The observer runs inline; a panic inside it is recovered and does not
+// affect the RPC. RPCs excluded by inclusion functions are only observed with
+// ObserveExcludedRPCs, and RPCs passed through while a TracingToggle is
+// disabled are not observed.
+func WithMetricsObserver(observer MetricsObserverFunc) Option {
+	return func(o *options) {
+		o.metricsObserver = observer
+	}
+}
+
+// SpanFinishHookFunc is called with the full method name, the duration and
+// the error of an RPC right before its server span is finished.
+type SpanFinishHookFunc func(fullMethod string, duration time.Duration, err error)
+
+// WithSpanFinishHook binds a function called by the OpenTracing server
+// interceptors right before they finish a server span, e.g. to feed a
+// Prometheus histogram of the durations of the RPCs they trace. Unlike the
+// MetricsObserverFunc, it gets the error of the RPC itself.
+//
+// The hook runs inline, delaying the end of the RPC by as long as it takes;
+// a panic inside it is recovered and does not affect the RPC. RPCs that are
+// not traced, e.g. because they are excluded, do not reach the hook.
+func WithSpanFinishHook(hook SpanFinishHookFunc) Option {
+	return func(o *options) {
+		o.spanFinishHook = hook
+	}
+}
+
+// ObserveExcludedRPCs returns an Option that has the MetricsObserverFunc
+// bound with WithMetricsObserver also observe the RPCs excluded from tracing
+// by the SpanInclusionFuncs, ExtractErrorInclusionFunc or
+// MetadataInclusionFunc.
+func ObserveExcludedRPCs() Option {
+	return func(o *options) {
+		o.observeExcluded = true
+	}
+}
+
+// TracingErrorHandlerFunc is called with the errors returned by
+// Tracer.Extract and Tracer.Inject, along with the full name of the gRPC
+// method being traced.
+type TracingErrorHandlerFunc func(err error, method string)
+
+// WithTracingErrorHandler binds a function that is notified whenever the
+// SpanContext of an RPC cannot be extracted (on the server) or injected (on
+// the client), e.g. because the incoming tracing headers are corrupt.
+// opentracing.ErrSpanContextNotFound is not reported since it merely means
+// the RPC has no parent span.
+//
+// The handler is called at most once per RPC for each of these operations.
+// It runs inline; a panic inside it is recovered and does not affect the RPC.
+func WithTracingErrorHandler(handler TracingErrorHandlerFunc) Option {
+	return func(o *options) {
+		o.tracingErrorHandler = handler
+	}
+}
+
+// WithExtractErrorHandler binds a function that is notified whenever the
+// server interceptors fail to extract the SpanContext of an RPC for a reason
+// other than opentracing.ErrSpanContextNotFound, e.g. to count corrupt
+// tracing headers. Without it, such errors are silently ignored and the RPC
+// gets a root span.
+//
+// It is called in addition to the TracingErrorHandlerFunc, if any, and is
+// likewise shielded from panics.
+func WithExtractErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.extractErrorHandler = handler
+	}
+}
+
+// WithBaggageToContext returns an Option that tells the OpenTracing server
+// instrumentation to copy the named baggage items of the server span into the
+// context.Context handed to the application handler, where they can be read
+// with BaggageValue without depending on the span.
+func WithBaggageToContext(keys []string) Option {
+	return func(o *options) {
+		o.baggageToContext = keys
+	}
+}
+
+// WithBaggageToMetadata returns an Option that tells the OpenTracing client
+// instrumentation to copy baggage items of the client span into the outgoing
+// gRPC metadata of the RPC, for services that read plain headers rather than
+// baggage. mapping maps baggage item names to header names, e.g.
+// {"tenant-id": "x-tenant-id"}. Headers already set on the RPC are kept unless
+// OverwriteBaggageMetadata is given.
+func WithBaggageToMetadata(mapping map[string]string) Option {
+	return func(o *options) {
+		o.baggageToMetadata = make(map[string]string, len(mapping))
+		for item, key := range mapping {
+			o.baggageToMetadata[item] = strings.ToLower(key)
+		}
+	}
+}
+
+// WithMetadataToBaggage returns an Option that tells the OpenTracing server
+// instrumentation to set baggage items on the server span from the metadata
+// headers of the RPC, e.g. those a client set with WithBaggageToMetadata.
+// mapping maps header names, matched case-insensitively, to baggage item
+// names, e.g. {"x-tenant-id": "tenant-id"}. Baggage items the span already
+// carries are kept unless OverwriteBaggageMetadata is given.
+func WithMetadataToBaggage(mapping map[string]string) Option {
+	return func(o *options) {
+		o.metadataToBaggage = make(map[string]string, len(mapping))
+		for key, item := range mapping {
+			o.metadataToBaggage[strings.ToLower(key)] = item
+		}
+	}
+}
+
+// OverwriteBaggageMetadata returns an Option that has WithBaggageToMetadata
+// and WithMetadataToBaggage overwrite the headers and baggage items that are
+// already set, respectively.
+func OverwriteBaggageMetadata() Option {
+	return func(o *options) {
+		o.overwriteBaggageMetadata = true
+	}
+}
+
 // SpanInclusionFunc provides an optional mechanism to decide whether or not
 // to trace a given gRPC call. Return true to create a Span and initiate
 // tracing, false to not create a Span and not trace.
 //
 // parentSpanCtx may be nil if no parent could be extraction from either the Go
 // context.Context (on the client) or the RPC (on the server).
+//
+// Both the client and the server interceptors honor the SpanInclusionFunc.
+// When it returns false on the client, the RPC is invoked without starting a
+// Span and without injecting any tracing headers into its metadata. req and
+// resp are only available for unary RPCs and are nil for streaming ones.
 type SpanInclusionFunc func(
 	parentSpanCtx opentracing.SpanContext,
 	method string,
 	req, resp interface{}) bool
 
-// IncludingSpans binds a IncludeSpanFunc to the options
+// IncludingSpans binds a IncludeSpanFunc to the options. It may be given
+// several times: the gRPC call is then traced only if every bound
+// SpanInclusionFunc returns true. They are evaluated in the order they were
+// bound, and evaluation stops at the first one that excludes the call.
 func IncludingSpans(inclusionFunc SpanInclusionFunc) Option {
 	return func(o *options) {
-		o.inclusionFunc = inclusionFunc
+		o.inclusionFuncs = append(o.inclusionFuncs, inclusionFunc)
+	}
+}
+
+// ExtractErrorInclusionFunc is a variant of SpanInclusionFunc that also sees
+// the error, if any, returned when extracting the parent SpanContext from the
+// RPC on the server. This allows skipping tracing when the incoming tracing
+// headers are malformed.
+//
+// extractErr is opentracing.ErrSpanContextNotFound when the RPC carries no
+// SpanContext, and always nil on the client, which has nothing to extract.
+type ExtractErrorInclusionFunc func(
+	parentSpanCtx opentracing.SpanContext,
+	method string,
+	req interface{},
+	extractErr error) bool
+
+// IncludingSpansOnExtractError binds an ExtractErrorInclusionFunc to the
+// options. It is evaluated in addition to the SpanInclusionFunc bound by
+// IncludingSpans, and the gRPC call is traced only if both return true.
+func IncludingSpansOnExtractError(inclusionFunc ExtractErrorInclusionFunc) Option {
+	return func(o *options) {
+		o.extractErrInclusionFunc = inclusionFunc
+	}
+}
+
+// WithRespectUpstreamSampling returns an Option that tells the OpenTracing
+// instrumentation not to trace a gRPC call, like a SpanInclusionFunc returning
+// false, if isSampled reports that its parent SpanContext is not sampled, e.g.
+// because an upstream service sent "x-b3-sampled: 0". isSampled is not called
+// for calls without a parent, i.e. when none is in the context on the client
+// and none could be extracted on the server, nor preferred there because of
+// WithLocalParentPreference. See SpanContextIsSampled and
+// SpanContextFlagsSampled for built-in predicates.
+//
+// The parent is still propagated so that the calls it leads to do not start
+// new traces: the server puts a Span that records nothing but carries it in
+// the context of the handler, and the client sends it in the metadata of the
+// call.
+func WithRespectUpstreamSampling(isSampled func(opentracing.SpanContext) bool) Option {
+	return func(o *options) {
+		o.upstreamSampled = isSampled
+	}
+}
+
+// MetadataInclusionFunc decides whether a gRPC call received by a server
+// should be traced based on its gRPC metadata, e.g. an "x-debug" header. md is
+// nil if the RPC carries no metadata.
+type MetadataInclusionFunc func(md metadata.MD, fullMethod string) bool
+
+// WithMetadataInclusionFunc binds a MetadataInclusionFunc to the options. It
+// is evaluated by the server interceptors in addition to the SpanInclusionFunc
+// bound by IncludingSpans, and the gRPC call is traced only if both return
+// true.
+func WithMetadataInclusionFunc(inclusionFunc MetadataInclusionFunc) Option {
+	return func(o *options) {
+		o.mdInclusionFunc = inclusionFunc
+	}
+}
+
+// WithForceSampleHeader returns an Option that tells the OpenTracing server
+// instrumentation to force the sampling of server spans, by setting their
+// sampling.priority to 1, when the RPC carries the given gRPC metadata header
+// with a truthy value, e.g. "x-b3-sampled: 1" or any "jaeger-debug-id".
+func WithForceSampleHeader(name string) Option {
+	return func(o *options) {
+		o.forceSampleHeader = name
+	}
+}
+
+// WithPanicRecovery returns an Option that tells the OpenTracing server
+// instrumentation to recover panics in handlers in order to flag the server
+// span as failed and log the panic value and stack trace on it before the
+// span is finished. The panic is then resumed, unless WithPanicsAsInternal is
+// also given.
+func WithPanicRecovery() Option {
+	return func(o *options) {
+		o.panicRecovery = true
+	}
+}
+
+// WithPanicsAsInternal returns an Option that tells the OpenTracing server
+// instrumentation to recover panics in handlers like WithPanicRecovery does,
+// and to fail the RPC with a codes.Internal error instead of resuming the
+// panic.
+func WithPanicsAsInternal() Option {
+	return func(o *options) {
+		o.panicRecovery = true
+		o.panicsAsInternal = true
 	}
 }
 
 // SpanDecoratorFunc provides an (optional) mechanism for otgrpc users to add
 // arbitrary tags/logs/etc to the opentracing.Span associated with client
 // and/or server RPCs.
+//
+// It is called once the RPC has completed but always before the Span is
+// finished, so it may also rename the Span with SetOperationName, e.g. based
+// on resp or grpcError.
 type SpanDecoratorFunc func(
 	ctx context.Context,
 	span opentracing.Span,
@@ -58,10 +884,26 @@ type SpanDecoratorFunc func(
 	req, resp interface{},
 	grpcError error)
 
-// SpanDecorator binds a function that decorates gRPC Spans.
+// SpanDecorator binds a function that decorates gRPC Spans. It may be given
+// several times, in which case every bound SpanDecoratorFunc is called, in
+// the order they were bound.
 func SpanDecorator(decorator SpanDecoratorFunc) Option {
 	return func(o *options) {
-		o.decorator = decorator
+		o.decorators = append(o.decorators, decorator)
+	}
+}
+
+// SpanObserverFunc is called with a server span as soon as it is started,
+// before the handler runs, along with the gRPC metadata of the RPC. md is nil
+// if the RPC carries no metadata.
+type SpanObserverFunc func(span opentracing.Span, fullMethod string, md metadata.MD)
+
+// WithSpanObserver binds a function that observes server spans right after
+// they are started, e.g. to tag them from custom request headers. Unlike the
+// SpanDecoratorFunc, it runs before the handler.
+func WithSpanObserver(observer SpanObserverFunc) Option {
+	return func(o *options) {
+		o.spanObserver = observer
 	}
 }
 
@@ -79,33 +921,473 @@ func WithStreamServerInterceptor(streamServerInterceptor grpc.StreamServerInterc
 	}
 }
 
+// WithMethodOverrides binds Options that apply only to some gRPC methods, keyed
+// by full method name, e.g. "/pkg.Service/Method". They are applied over the
+// other Options, whatever their order, and thus take precedence for these
+// methods. For example, to log the payloads of a single method:
+//
+//	otgrpc.OpenTracingServerInterceptor(tracer, otgrpc.WithMethodOverrides(
+//		map[string][]otgrpc.Option{
+//			"/pkg.Service/Debug": {otgrpc.LogPayloads()},
+//		}))
+//
+// WithMethodOverrides nested in the overrides are ignored.
+func WithMethodOverrides(overrides map[string][]Option) Option {
+	return func(o *options) {
+		if o.methodOverrides == nil {
+			o.methodOverrides = make(map[string][]Option, len(overrides))
+		}
+		for method, opts := range overrides {
+			o.methodOverrides[method] = append(o.methodOverrides[method], opts...)
+		}
+	}
+}
+
 // The internal-only options struct. Obviously overkill at the moment; but will
 // scale well as production use dictates other configuration and tuning
 // parameters.
 type options struct {
-	logPayloads bool
 	logError    bool
-	decorator   SpanDecoratorFunc
+	tagTarget   bool
+	deadlineTag bool
+	decorators  []SpanDecoratorFunc
+
+	// authorityTag enables the grpc.authority tag.
+	authorityTag bool
+	// parentPresenceTag enables the grpc.has_parent tag.
+	parentPresenceTag bool
+
+	// requestTags holds the RequestTagsFuncs by full method name.
+	requestTags map[string][]RequestTagsFunc
+
+	// messageSizeTags enables the grpc.request.size and grpc.response.size tags.
+	messageSizeTags bool
+
+	// spanObserver can be nil
+	spanObserver SpanObserverFunc
+
+	// tagServiceMethod enables the grpc.service and grpc.method tags.
+	tagServiceMethod bool
+
+	// logRequests and logResponses enable payload logging per direction.
+	logRequests  bool
+	logResponses bool
+	// logPayloadsOnError logs unary requests of failed RPCs.
+	logPayloadsOnError bool
+
+	// maxPayloadLogSize is the maximum logged payload size; <= 0 means
+	// unlimited.
+	maxPayloadLogSize int
+	// maxStreamPayloadLogs is the maximum number of messages logged per
+	// stream; <= 0 means unlimited.
+	maxStreamPayloadLogs int
+
+	// payloadRedactor can be nil
+	payloadRedactor PayloadRedactorFunc
+
+	// streamMessageSpans enables per-message child spans on streams.
+	streamMessageSpans bool
+	// streamLifecycleEvents enables the stream.open/close events.
+	streamLifecycleEvents bool
+	// finishOnLastSend finishes stream spans at the last send.
+	finishOnLastSend bool
+
+	// retryAttemptSpans enables a child span per client call attempt.
+	retryAttemptSpans bool
+	// clientTimingTags enables the grpc.wait_ms and grpc.total_ms tags.
+	clientTimingTags bool
+	// preserveTraceHeaders keeps the tracing headers already in the
+	// outgoing metadata.
+	preserveTraceHeaders bool
+
+	// forceSampleHeader is the header forcing sampling; empty means none.
+	forceSampleHeader string
+
+	// panicRecovery enables the recovery of panics in server handlers, which
+	// are resumed unless panicsAsInternal is set.
+	panicRecovery    bool
+	panicsAsInternal bool
+
+	// errorClassifier can be nil
+	errorClassifier ErrorClassifierFunc
+	// errorTagger can be nil
+	errorTagger ErrorTaggerFunc
+	// nonErrorCodes holds the codes of WithNonErrorCodes.
+	nonErrorCodes map[codes.Code]struct{}
+
+	// propagationFormat is the format of the SpanContext in the metadata.
+	propagationFormat opentracing.BuiltinFormat
+	// toggle can be nil
+	toggle *TracingToggle
+	// tracerProvider can be nil
+	tracerProvider func() opentracing.Tracer
+	// tracerSelector can be nil
+	tracerSelector TracerSelectorFunc
+	// spanFactory can be nil
+	spanFactory SpanFactoryFunc
+	// startSpanOptions are added to those of the spans of RPCs.
+	startSpanOptions []opentracing.StartSpanOption
+	// tracerFromContext can be nil
+	tracerFromContext func(ctx context.Context) opentracing.Tracer
+	// incomingKeyMapper can be nil
+	incomingKeyMapper IncomingKeyMapperFunc
+	// extractFallbacks are tried in order when extraction finds nothing.
+	extractFallbacks []opentracing.Tracer
+	// referenceType is the type of the reference to the client span.
+	referenceType opentracing.SpanReferenceType
+	// localParentPreference prefers the span in the context of an RPC over
+	// the SpanContext of its client as the parent of server spans.
+	localParentPreference bool
+	// clientReferenceType is the type of the reference from client spans to
+	// the span of their caller.
+	clientReferenceType opentracing.SpanReferenceType
+
+	// baggageToContext lists the baggage items copied into the handler
+	// context.
+	baggageToContext []string
+
+	// metricsObserver can be nil
+	metricsObserver MetricsObserverFunc
+	// observeExcluded has metricsObserver observe excluded RPCs.
+	observeExcluded bool
+	// spanFinishHook can be nil
+	spanFinishHook SpanFinishHookFunc
+	// spanTagsFunc can be nil
+	spanTagsFunc SpanTagsFunc
+	// metadataTags holds the lower-case header names of WithMetadataTags.
+	metadataTags []string
+	// baggageToMetadata maps baggage item names to lower-case header names,
+	// and metadataToBaggage the other way round.
+	baggageToMetadata        map[string]string
+	metadataToBaggage        map[string]string
+	overwriteBaggageMetadata bool
+	// responseTraceHeader enables sending the SpanContext of server spans
+	// back to clients.
+	responseTraceHeader bool
+	// traceIDHeader is the lower-case name of the header in which the trace
+	// ID of server spans is sent back to clients, if any. traceIDFunc can be
+	// nil.
+	traceIDHeader string
+	traceIDFunc   TraceIDFunc
+	// traceIDInErrorDetails enables adding the trace ID of server spans to
+	// the details of status errors.
+	traceIDInErrorDetails bool
+
+	// tracingErrorHandler can be nil
+	tracingErrorHandler TracingErrorHandlerFunc
+	// extractErrorHandler can be nil
+	extractErrorHandler func(err error)
+
+	// opNameFunc can be nil
+	opNameFunc OperationNameFunc
+
+	// componentName, if not empty, replaces "gRPC" as the component tag.
+	componentName string
+	staticTags    opentracing.Tags
+
+	inclusionFuncs []SpanInclusionFunc
+	// May be nil.
+	extractErrInclusionFunc ExtractErrorInclusionFunc
+	// May be nil.
+	upstreamSampled func(opentracing.SpanContext) bool
+
 	// May be nil.
-	inclusionFunc SpanInclusionFunc
+	mdInclusionFunc MetadataInclusionFunc
 
 	// serverInterceptor can be nil
 	serverInterceptor grpc.UnaryServerInterceptor
 
 	// streamServerInterceptor can be nil
 	streamServerInterceptor grpc.StreamServerInterceptor
+
+	// methodOverrides holds the Options of WithMethodOverrides, and
+	// methodOptions the options they result in, by full method name.
+	methodOverrides map[string][]Option
+	methodOptions   map[string]*options
 }
 
 // newOptions returns the default options.
 func newOptions() *options {
 	return &options{
-		logPayloads:   false,
-		inclusionFunc: nil,
+		propagationFormat: opentracing.HTTPHeaders,
+	}
+}
+
+// include reports whether the gRPC call described by its arguments should be
+// traced according to the configured inclusion functions.
+func (o *options) include(
+	parentSpanCtx opentracing.SpanContext,
+	method string,
+	req, resp interface{},
+	extractErr error) bool {
+	for _, inclusionFunc := range o.inclusionFuncs {
+		if !inclusionFunc(parentSpanCtx, method, req, resp) {
+			return false
+		}
+	}
+	if o.extractErrInclusionFunc != nil &&
+		!o.extractErrInclusionFunc(parentSpanCtx, method, req, extractErr) {
+		return false
+	}
+	return true
+}
+
+// unsampledParent reports whether the function given to
+// WithRespectUpstreamSampling, if any, says that parent, which may be nil, is
+// not sampled.
+func (o *options) unsampledParent(parent opentracing.SpanContext) bool {
+	return o.upstreamSampled != nil && parent != nil && !o.upstreamSampled(parent)
+}
+
+// decorate calls the configured SpanDecoratorFuncs in order.
+func (o *options) decorate(
+	ctx context.Context,
+	span opentracing.Span,
+	method string,
+	req, resp interface{},
+	grpcError error) {
+	for _, decorator := range o.decorators {
+		decorator(ctx, span, method, req, resp, grpcError)
+	}
+}
+
+// includeMetadata reports whether the MetadataInclusionFunc, if any, includes
+// the gRPC call with the metadata attached to ctx, or else the incoming gRPC
+// metadata.
+func (o *options) includeMetadata(ctx context.Context, method string) bool {
+	if o.mdInclusionFunc == nil {
+		return true
+	}
+	return o.mdInclusionFunc(serverMetadata(ctx), method)
+}
+
+// logPayloadsOnFailure reports whether the payloads of a unary RPC that
+// returned err should be logged because of LogPayloadsOnError.
+func (o *options) logPayloadsOnFailure(err error) bool {
+	if err == nil || o.logRequests || o.logResponses || !o.logPayloadsOnError {
+		return false
+	}
+	if _, nonError := o.nonErrorCodes[status.Code(err)]; nonError {
+		return false
+	}
+	if o.errorClassifier != nil {
+		isError, _ := o.errorClassifier(err)
+		return isError
+	}
+	return true
+}
+
+// reportTracingError passes err to the configured TracingErrorHandlerFunc, if
+// any, shielding the RPC from panics inside it.
+func (o *options) reportTracingError(err error, method string) {
+	if o.tracingErrorHandler == nil {
+		return
 	}
+	defer func() {
+		recover()
+	}()
+	o.tracingErrorHandler(err, method)
+}
+
+// reportExtractError reports an error returned by Tracer.Extract to both the
+// TracingErrorHandlerFunc and the extract error handler, if any.
+func (o *options) reportExtractError(err error, method string) {
+	o.reportTracingError(err, method)
+	if o.extractErrorHandler == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	o.extractErrorHandler(err)
+}
+
+// tagFromRequest sets on span the tags the RequestTagsFuncs of method return
+// for req.
+func (o *options) tagFromRequest(span opentracing.Span, method string, req interface{}) {
+	for _, extractor := range o.requestTags[method] {
+		for k, v := range extractor(req) {
+			span.SetTag(k, v)
+		}
+	}
+}
+
+// setSpanTagsFromFunc sets on span the tags the SpanTagsFunc, if any, returns
+// for the RPC, reporting a panic inside it as a tracing error.
+func (o *options) setSpanTagsFromFunc(ctx context.Context, span opentracing.Span, method string, req interface{}) {
+	if o.spanTagsFunc == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			o.reportTracingError(fmt.Errorf("otgrpc: SpanTagsFunc panicked: %v", r), method)
+		}
+	}()
+	for k, v := range o.spanTagsFunc(ctx, method, req) {
+		span.SetTag(k, v)
+	}
+}
+
+// hasCallWork reports whether the interceptors have work to do for each RPC
+// even if their Tracer is a NoopTracer, i.e. calling a tracer provider or a
+// metrics observer, for all methods or through WithMethodOverrides.
+func (o *options) hasCallWork() bool {
+	if o.tracerSelector != nil || o.tracerProvider != nil || o.tracerFromContext != nil || o.metricsObserver != nil {
+		return true
+	}
+	for _, m := range o.methodOptions {
+		if m.tracerProvider != nil || m.tracerFromContext != nil || m.metricsObserver != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// observeMetrics passes the outcome of an RPC that started at start and
+// ended with err to the configured MetricsObserverFunc, if any, shielding the
+// RPC from panics inside it.
+func (o *options) observeMetrics(method string, err error, start time.Time, isStream bool) {
+	if o.metricsObserver == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	o.metricsObserver(method, rpcCode(err), time.Since(start), isStream)
+}
+
+// callSpanFinishHook passes the outcome of an RPC whose server span is about
+// to be finished to the configured SpanFinishHookFunc, if any, shielding the
+// RPC from panics inside it.
+func (o *options) callSpanFinishHook(method string, duration time.Duration, err error) {
+	if o.spanFinishHook == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	o.spanFinishHook(method, duration, err)
+}
+
+// metricsOnly returns the options of the RPCs that are excluded from tracing
+// but still observed by the MetricsObserverFunc.
+func (o *options) metricsOnly() *options {
+	m := newOptions()
+	m.metricsObserver = o.metricsObserver
+	return m
+}
+
+// tracingDisabled reports whether tracing is switched off through the
+// configured TracingToggle.
+func (o *options) tracingDisabled() bool {
+	return o.toggle != nil && !o.toggle.Enabled()
+}
+
+// callTracer returns the Tracer of a single call of the gRPC method
+// fullMethod with context ctx: the one returned for ctx by the
+// WithTracerFromContext function, if any, or else the one chosen by the tracer
+// selector, if any, or else the one returned by the tracer provider, if any,
+// or tracer otherwise.
+func (o *options) callTracer(ctx context.Context, tracer opentracing.Tracer, fullMethod string) opentracing.Tracer {
+	if o.tracerFromContext != nil {
+		if ctxTracer := o.tracerFromContext(ctx); ctxTracer != nil {
+			return ctxTracer
+		}
+	}
+	if o.tracerSelector != nil {
+		if tracer = o.tracerSelector(fullMethod); tracer == nil {
+			tracer = opentracing.GlobalTracer()
+		}
+	} else if o.tracerProvider != nil {
+		tracer = o.tracerProvider()
+	}
+	if tracer == nil {
+		return opentracing.NoopTracer{}
+	}
+	return tracer
+}
+
+// startSpan starts a span with the SpanFactoryFunc given to WithSpanFactory,
+// if any, or else with StartSpanFactory.
+func (o *options) startSpan(
+	parent opentracing.SpanContext,
+	tracer opentracing.Tracer,
+	operationName string,
+	opts ...opentracing.StartSpanOption) opentracing.Span {
+	if o.spanFactory != nil {
+		return o.spanFactory(parent, tracer, operationName, opts...)
+	}
+	return StartSpanFactory(parent, tracer, operationName, opts...)
+}
+
+// startRPCSpan starts the span of an RPC with startSpan, adding the
+// StartSpanOptions given to WithStartSpanOptions after opts.
+func (o *options) startRPCSpan(
+	parent opentracing.SpanContext,
+	tracer opentracing.Tracer,
+	operationName string,
+	opts ...opentracing.StartSpanOption) opentracing.Span {
+	return o.startSpan(parent, tracer, operationName, append(opts, o.startSpanOptions...)...)
+}
+
+// componentTag returns the component tag of the spans.
+func (o *options) componentTag() opentracing.Tag {
+	if o.componentName == "" {
+		return gRPCComponentTag
+	}
+	return opentracing.Tag{Key: string(ext.Component), Value: o.componentName}
+}
+
+// setStaticTags sets the tags of WithStaticTags on span.
+func (o *options) setStaticTags(span opentracing.Span) {
+	for k, v := range o.staticTags {
+		span.SetTag(k, v)
+	}
+}
+
+// operationName returns the Span operation name for the given full method.
+func (o *options) operationName(fullMethod string) string {
+	if o.opNameFunc == nil {
+		return fullMethod
+	}
+	return o.opNameFunc(fullMethod)
 }
 
 func (o *options) apply(opts ...Option) {
 	for _, opt := range opts {
 		opt(o)
 	}
+	o.methodOptions = nil
+	for method, overrides := range o.methodOverrides {
+		m := *o
+		m.methodOverrides, m.methodOptions = nil, nil
+		// Keep the Options appending to slices or maps from writing to
+		// those of o.
+		m.decorators = m.decorators[:len(m.decorators):len(m.decorators)]
+		m.inclusionFuncs = m.inclusionFuncs[:len(m.inclusionFuncs):len(m.inclusionFuncs)]
+		m.startSpanOptions = m.startSpanOptions[:len(m.startSpanOptions):len(m.startSpanOptions)]
+		if m.requestTags != nil {
+			m.requestTags = make(map[string][]RequestTagsFunc, len(o.requestTags))
+			for method, extractors := range o.requestTags {
+				m.requestTags[method] = extractors[:len(extractors):len(extractors)]
+			}
+		}
+		for _, opt := range overrides {
+			opt(&m)
+		}
+		m.methodOverrides = nil
+		if o.methodOptions == nil {
+			o.methodOptions = make(map[string]*options, len(o.methodOverrides))
+		}
+		o.methodOptions[method] = &m
+	}
+}
+
+// forMethod returns the options of the gRPC method fullMethod, which differ
+// from o if WithMethodOverrides has Options for it.
+func (o *options) forMethod(fullMethod string) *options {
+	if m, ok := o.methodOptions[fullMethod]; ok {
+		return m
+	}
+	return o
 }
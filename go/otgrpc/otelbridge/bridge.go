@@ -0,0 +1,391 @@
+// Package otelbridge adapts an OpenTelemetry TracerProvider to the
+// opentracing.Tracer interface so that the otgrpc interceptors can report to
+// OpenTelemetry without any change to how they are installed.
+//
+// For example:
+//
+//	tracer := otelbridge.NewTracer(tracerProvider, propagation.TraceContext{})
+//	s := grpc.NewServer(
+//	    grpc.UnaryInterceptor(otgrpc.OpenTracingServerInterceptor(tracer)))
+package otelbridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+
+// Tracer is an opentracing.Tracer that delegates to an OpenTelemetry
+// TracerProvider.
+//
+// The "span.kind" tag set by the otgrpc interceptors is mapped to the
+// corresponding OpenTelemetry SpanKind, the "error" tag to an Error status,
+// and all other tags to attributes. Only the opentracing.HTTPHeaders and
+// opentracing.TextMap formats are supported by Inject and Extract.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns a Tracer whose Spans are created by tp and whose
+// SpanContexts are propagated by propagator. A nil propagator defaults to the
+// W3C Trace Context and Baggage propagators.
+func NewTracer(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	if propagator == nil {
+		propagator = propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{}, propagation.Baggage{})
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+// StartSpan belongs to the opentracing.Tracer interface.
+func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sso := opentracing.StartSpanOptions{}
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+
+	ctx := context.Background()
+	var links []trace.Link
+	var bag map[string]string
+	hasParent := false
+	for _, ref := range sso.References {
+		sc, ok := ref.ReferencedContext.(spanContext)
+		if !ok {
+			continue
+		}
+		if ref.Type == opentracing.ChildOfRef && !hasParent {
+			hasParent = true
+			ctx = trace.ContextWithSpanContext(ctx, sc.otel)
+		} else {
+			links = append(links, trace.Link{SpanContext: sc.otel})
+		}
+		for k, v := range sc.baggage {
+			if bag == nil {
+				bag = map[string]string{}
+			}
+			bag[k] = v
+		}
+	}
+
+	startOpts := []trace.SpanStartOption{trace.WithLinks(links...)}
+	if !sso.StartTime.IsZero() {
+		startOpts = append(startOpts, trace.WithTimestamp(sso.StartTime))
+	}
+	if kind, ok := sso.Tags[string(ext.SpanKind)]; ok {
+		startOpts = append(startOpts, trace.WithSpanKind(spanKind(kind)))
+	}
+	_, otelSpan := t.tracer.Start(ctx, operationName, startOpts...)
+
+	s := &span{tracer: t, otel: otelSpan, baggage: bag}
+	for k, v := range sso.Tags {
+		if k != string(ext.SpanKind) {
+			s.SetTag(k, v)
+		}
+	}
+	return s
+}
+
+// Inject belongs to the opentracing.Tracer interface.
+func (t *Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	sc, ok := sm.(spanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return opentracing.ErrUnsupportedFormat
+	}
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	ctx := trace.ContextWithSpanContext(context.Background(), sc.otel)
+	if len(sc.baggage) > 0 {
+		var members []baggage.Member
+		for k, v := range sc.baggage {
+			// Items that are not valid W3C baggage cannot be propagated.
+			if m, err := baggage.NewMember(k, v); err == nil {
+				members = append(members, m)
+			}
+		}
+		if bag, err := baggage.New(members...); err == nil {
+			ctx = baggage.ContextWithBaggage(ctx, bag)
+		}
+	}
+	t.propagator.Inject(ctx, textMapWriterCarrier{writer})
+	return nil
+}
+
+// Extract belongs to the opentracing.Tracer interface.
+func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	if format != opentracing.HTTPHeaders && format != opentracing.TextMap {
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+
+	// Header names are case-insensitive, and the propagators look for their
+	// keys in lowercase.
+	mapCarrier := propagation.MapCarrier{}
+	err := reader.ForeachKey(func(key, val string) error {
+		mapCarrier[strings.ToLower(key)] = val
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := t.propagator.Extract(context.Background(), mapCarrier)
+	otelSC := trace.SpanContextFromContext(ctx)
+	if !otelSC.IsValid() {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	sc := spanContext{otel: otelSC}
+	for _, m := range baggage.FromContext(ctx).Members() {
+		if sc.baggage == nil {
+			sc.baggage = map[string]string{}
+		}
+		sc.baggage[m.Key()] = m.Value()
+	}
+	return sc, nil
+}
+
+// spanKind maps the value of an OpenTracing "span.kind" tag to an
+// OpenTelemetry SpanKind.
+func spanKind(kind interface{}) trace.SpanKind {
+	switch fmt.Sprint(kind) {
+	case string(ext.SpanKindRPCClientEnum):
+		return trace.SpanKindClient
+	case string(ext.SpanKindRPCServerEnum):
+		return trace.SpanKindServer
+	case string(ext.SpanKindProducerEnum):
+		return trace.SpanKindProducer
+	case string(ext.SpanKindConsumerEnum):
+		return trace.SpanKindConsumer
+	default:
+		return trace.SpanKindInternal
+	}
+}
+
+// attributeFor converts an OpenTracing tag or log field to an OpenTelemetry
+// attribute.
+func attributeFor(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case bool:
+		return attribute.Bool(key, v)
+	case string:
+		return attribute.String(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int8:
+		return attribute.Int(key, int(v))
+	case int16:
+		return attribute.Int(key, int(v))
+	case int32:
+		return attribute.Int64(key, int64(v))
+	case int64:
+		return attribute.Int64(key, v)
+	case uint8:
+		return attribute.Int(key, int(v))
+	case uint16:
+		return attribute.Int(key, int(v))
+	case uint32:
+		return attribute.Int64(key, int64(v))
+	case uint64:
+		return attribute.Int64(key, int64(v))
+	case float32:
+		return attribute.Float64(key, float64(v))
+	case float64:
+		return attribute.Float64(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+// spanContext is the opentracing.SpanContext of a span.
+type spanContext struct {
+	otel    trace.SpanContext
+	baggage map[string]string
+}
+
+// ForeachBaggageItem belongs to the opentracing.SpanContext interface.
+func (sc spanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range sc.baggage {
+		if !handler(k, v) {
+			break
+		}
+	}
+}
+
+// IsSampled reports whether the span is sampled, e.g. for
+// otgrpc.SpanContextIsSampled.
+func (sc spanContext) IsSampled() bool {
+	return sc.otel.IsSampled()
+}
+
+// span is the opentracing.Span wrapper of an OpenTelemetry Span.
+type span struct {
+	tracer *Tracer
+	otel   trace.Span
+
+	// mu guards baggage, which is copied on write since it is shared with
+	// the SpanContexts handed out by Context.
+	mu      sync.Mutex
+	baggage map[string]string
+}
+
+// Finish belongs to the opentracing.Span interface.
+func (s *span) Finish() {
+	s.otel.End()
+}
+
+// FinishWithOptions belongs to the opentracing.Span interface.
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	for _, lr := range opts.LogRecords {
+		s.logFields(lr.Timestamp, lr.Fields...)
+	}
+	for _, ld := range opts.BulkLogData {
+		lr := ld.ToLogRecord()
+		s.logFields(lr.Timestamp, lr.Fields...)
+	}
+	if opts.FinishTime.IsZero() {
+		s.otel.End()
+	} else {
+		s.otel.End(trace.WithTimestamp(opts.FinishTime))
+	}
+}
+
+// Context belongs to the opentracing.Span interface.
+func (s *span) Context() opentracing.SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return spanContext{otel: s.otel.SpanContext(), baggage: s.baggage}
+}
+
+// SetOperationName belongs to the opentracing.Span interface.
+func (s *span) SetOperationName(operationName string) opentracing.Span {
+	s.otel.SetName(operationName)
+	return s
+}
+
+// SetTag belongs to the opentracing.Span interface.
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	if key == string(ext.Error) {
+		if isError, ok := value.(bool); ok {
+			if isError {
+				s.otel.SetStatus(codes.Error, "")
+			}
+			return s
+		}
+	}
+	s.otel.SetAttributes(attributeFor(key, value))
+	return s
+}
+
+// LogFields belongs to the opentracing.Span interface.
+func (s *span) LogFields(fields ...log.Field) {
+	s.logFields(time.Time{}, fields...)
+}
+
+// LogKV belongs to the opentracing.Span interface.
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.LogFields(log.Error(err), log.String("function", "LogKV"))
+		return
+	}
+	s.LogFields(fields...)
+}
+
+// logFields records fields as an OpenTelemetry event named after the "event"
+// field, if any.
+func (s *span) logFields(timestamp time.Time, fields ...log.Field) {
+	name := "log"
+	attrs := make([]attribute.KeyValue, 0, len(fields))
+	for _, field := range fields {
+		if field.Key() == "event" {
+			name = fmt.Sprint(field.Value())
+			continue
+		}
+		attrs = append(attrs, attributeFor(field.Key(), field.Value()))
+	}
+	opts := []trace.EventOption{trace.WithAttributes(attrs...)}
+	if !timestamp.IsZero() {
+		opts = append(opts, trace.WithTimestamp(timestamp))
+	}
+	s.otel.AddEvent(name, opts...)
+}
+
+// SetBaggageItem belongs to the opentracing.Span interface.
+func (s *span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bag := make(map[string]string, len(s.baggage)+1)
+	for k, v := range s.baggage {
+		bag[k] = v
+	}
+	bag[restrictedKey] = value
+	s.baggage = bag
+	return s
+}
+
+// BaggageItem belongs to the opentracing.Span interface.
+func (s *span) BaggageItem(restrictedKey string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.baggage[restrictedKey]
+}
+
+// Tracer belongs to the opentracing.Span interface.
+func (s *span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+// LogEvent belongs to the opentracing.Span interface.
+func (s *span) LogEvent(event string) {
+	s.LogFields(log.String("event", event))
+}
+
+// LogEventWithPayload belongs to the opentracing.Span interface.
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(log.String("event", event), log.Object("payload", payload))
+}
+
+// Log belongs to the opentracing.Span interface.
+func (s *span) Log(ld opentracing.LogData) {
+	lr := ld.ToLogRecord()
+	s.logFields(lr.Timestamp, lr.Fields...)
+}
+
+// textMapWriterCarrier adapts an opentracing.TextMapWriter to the
+// propagation.TextMapCarrier interface for injection.
+type textMapWriterCarrier struct {
+	opentracing.TextMapWriter
+}
+
+func (c textMapWriterCarrier) Get(key string) string {
+	return ""
+}
+
+func (c textMapWriterCarrier) Keys() []string {
+	return nil
+}
@@ -0,0 +1,95 @@
+package otelbridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/opentracing/opentracing-go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func newTestTracer() (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return NewTracer(tp, nil), recorder
+}
+
+func TestInjectExtract(t *testing.T) {
+	tracer, _ := newTestTracer()
+	span := tracer.StartSpan("parent")
+	span.SetBaggageItem("tenant", "acme")
+	defer span.Finish()
+
+	carrier := opentracing.HTTPHeadersCarrier{}
+	assert.NoError(t, tracer.Inject(span.Context(), opentracing.HTTPHeaders, carrier))
+
+	sc, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
+	assert.NoError(t, err)
+	assert.Equal(t, span.Context().(spanContext).otel.TraceID(), sc.(spanContext).otel.TraceID())
+	assert.Equal(t, span.Context().(spanContext).otel.SpanID(), sc.(spanContext).otel.SpanID())
+	assert.Equal(t, map[string]string{"tenant": "acme"}, sc.(spanContext).baggage)
+
+	_, err = tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier{})
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
+
+func TestInterceptors(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	server := otgrpc.OpenTracingServerInterceptor(tracer)
+	client := otgrpc.OpenTracingClientInterceptor(tracer)
+
+	// The invoker hands the outgoing metadata of the client straight to the
+	// server interceptor.
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		_, err := server(ctx, req, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return req, nil
+			})
+		return err
+	}
+	err := client(context.Background(), "/pkg.Service/Method", nil, nil, nil, invoker)
+	assert.NoError(t, err)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	serverSpan, clientSpan := spans[0], spans[1]
+	assert.Equal(t, "/pkg.Service/Method", serverSpan.Name())
+	assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind())
+	assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind())
+	assert.Equal(t, clientSpan.SpanContext().TraceID(), serverSpan.SpanContext().TraceID())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+}
+
+func TestRespectUpstreamSampling(t *testing.T) {
+	respect := otgrpc.WithRespectUpstreamSampling(otgrpc.SpanContextIsSampled)
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+	for _, tc := range []struct {
+		traceparent string
+		spans       int
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", 1},
+	} {
+		// The tracer samples every span, so only the Option keeps it from
+		// recording those of unsampled parents.
+		recorder := tracetest.NewSpanRecorder()
+		tracer := NewTracer(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.AlwaysSample()),
+			sdktrace.WithSpanProcessor(recorder)), nil)
+		ctx := otgrpc.NewContext(context.Background(), otgrpc.New(map[string]string{"traceparent": tc.traceparent}))
+		_, err := otgrpc.OpenTracingServerInterceptor(tracer, respect)(ctx, nil, info, handler)
+		assert.NoError(t, err)
+		assert.Len(t, recorder.Ended(), tc.spans, tc.traceparent)
+	}
+}
@@ -0,0 +1,42 @@
+// Package prommetrics feeds the outcome of the RPCs observed by the otgrpc
+// interceptors to a Prometheus histogram, so that a single interceptor both
+// traces RPCs and provides their RED metrics.
+//
+// For example:
+//
+//	histogram := prommetrics.NewHistogram()
+//	prometheus.MustRegister(histogram)
+//	s := grpc.NewServer(otgrpc.ServerOptions(tracer,
+//	    otgrpc.WithMetricsObserver(prommetrics.Observer(histogram)))...)
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// NewHistogram returns a histogram of RPC durations, in seconds, labelled with
+// the full gRPC method name, the gRPC status code and the type of the RPC,
+// "unary" or "stream".
+func NewHistogram() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_rpc_duration_seconds",
+		Help:    "Duration of gRPC RPCs, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_method", "grpc_code", "grpc_type"})
+}
+
+// Observer returns an otgrpc.MetricsObserverFunc that observes the RPCs in
+// histogram, which must have the labels of the histograms of NewHistogram.
+func Observer(histogram *prometheus.HistogramVec) otgrpc.MetricsObserverFunc {
+	return func(method string, code codes.Code, duration time.Duration, isStream bool) {
+		rpcType := "unary"
+		if isStream {
+			rpcType = "stream"
+		}
+		histogram.WithLabelValues(method, code.String(), rpcType).Observe(duration.Seconds())
+	}
+}
@@ -0,0 +1,38 @@
+package prommetrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestObserver(t *testing.T) {
+	histogram := NewHistogram()
+	interceptor := otgrpc.OpenTracingServerInterceptor(mocktracer.New(),
+		otgrpc.WithMetricsObserver(Observer(histogram)))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	for _, err := range []error{nil, nil, status.Error(codes.NotFound, "")} {
+		interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+
+	assert.Equal(t, 2, testutil.CollectAndCount(histogram))
+	for code, expected := range map[string]uint64{"OK": 2, "NotFound": 1} {
+		observer, err := histogram.GetMetricWithLabelValues("/pkg.Service/Method", code, "unary")
+		assert.NoError(t, err)
+		metric := &dto.Metric{}
+		assert.NoError(t, observer.(prometheus.Metric).Write(metric))
+		assert.Equal(t, expected, metric.GetHistogram().GetSampleCount(), code)
+	}
+}
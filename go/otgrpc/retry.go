@@ -0,0 +1,88 @@
+package otgrpc
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+type callAttemptsKey struct{}
+
+type attemptSpanKey struct{}
+
+// callAttempts tracks the attempts gRPC makes at a single client call.
+type callAttempts struct {
+	tracer     opentracing.Tracer
+	otgrpcOpts *options
+	span       opentracing.Span
+	method     string
+	count      int32
+}
+
+// withCallAttempts returns a copy of ctx through which
+// RetryAttemptStatsHandler can find the span of the client call.
+func withCallAttempts(ctx context.Context, tracer opentracing.Tracer, otgrpcOpts *options, clientSpan opentracing.Span, method string) context.Context {
+	return context.WithValue(ctx, callAttemptsKey{}, &callAttempts{
+		tracer:     tracer,
+		otgrpcOpts: otgrpcOpts,
+		span:       clientSpan,
+		method:     method,
+	})
+}
+
+// RetryAttemptStatsHandler returns a stats.Handler that creates the attempt
+// spans enabled by WithRetryAttemptSpans. It ignores RPCs whose client
+// interceptor was not given that Option.
+func RetryAttemptStatsHandler() stats.Handler {
+	return retryAttemptStatsHandler{}
+}
+
+type retryAttemptStatsHandler struct{}
+
+func (retryAttemptStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	attempts, ok := ctx.Value(callAttemptsKey{}).(*callAttempts)
+	if !ok {
+		return ctx
+	}
+	attempt := atomic.AddInt32(&attempts.count, 1)
+	attemptSpan := attempts.otgrpcOpts.startSpan(
+		attempts.span.Context(),
+		attempts.tracer,
+		fmt.Sprintf("%s/attempt-%d", attempts.method, attempt),
+		opentracing.ChildOf(attempts.span.Context()),
+		opentracing.Tag{Key: "grpc.attempt", Value: int(attempt)},
+		ext.SpanKindRPCClient,
+		attempts.otgrpcOpts.componentTag(),
+	)
+	attempts.otgrpcOpts.setStaticTags(attemptSpan)
+	return context.WithValue(ctx, attemptSpanKey{}, attemptSpan)
+}
+
+func (retryAttemptStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	attemptSpan, ok := ctx.Value(attemptSpanKey{}).(opentracing.Span)
+	if !ok {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		if s.IsTransparentRetryAttempt {
+			attemptSpan.SetTag("grpc.transparent_retry", true)
+		}
+	case *stats.End:
+		setCodeTag(attemptSpan, s.Error)
+		if s.Error != nil {
+			ext.Error.Set(attemptSpan, true)
+		}
+		attemptSpan.Finish()
+	}
+}
+
+func (retryAttemptStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (retryAttemptStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
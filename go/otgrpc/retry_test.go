@@ -0,0 +1,87 @@
+package otgrpc
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const retryServiceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "pkg.Service"}],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.01s",
+			"maxBackoff": "0.01s",
+			"backoffMultiplier": 1,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+func TestRetryAttemptSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	// The server fails the first attempt so that the call is retried once.
+	var attempts int32
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+		if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return ss.SendMsg(&emptypb.Empty{})
+	}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithDefaultServiceConfig(retryServiceConfig),
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, WithRetryAttemptSpans())),
+		grpc.WithStatsHandler(RetryAttemptStatsHandler()))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+	err = cc.Invoke(context.Background(), "/pkg.Service/Method", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	callSpan := spans[2]
+	assert.Equal(t, "/pkg.Service/Method", callSpan.OperationName)
+	for i, code := range []string{"Unavailable", "OK"} {
+		assert.Equal(t, fmt.Sprintf("/pkg.Service/Method/attempt-%d", i+1), spans[i].OperationName)
+		assert.Equal(t, i+1, spans[i].Tag("grpc.attempt"))
+		assert.Equal(t, code, spans[i].Tag("grpc.code"))
+		assert.Equal(t, callSpan.SpanContext.SpanID, spans[i].ParentID)
+	}
+	assert.Equal(t, true, spans[0].Tag("error"))
+	assert.Nil(t, spans[1].Tag("error"))
+}
+
+func TestRetryAttemptStatsHandlerWithoutOption(t *testing.T) {
+	// RPCs whose interceptor lacks WithRetryAttemptSpans are left alone.
+	handler := RetryAttemptStatsHandler()
+	ctx := context.Background()
+	assert.Equal(t, ctx, handler.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Service/Method"}))
+	handler.HandleRPC(ctx, &stats.End{})
+}
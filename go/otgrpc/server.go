@@ -1,11 +1,25 @@
 package otgrpc
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 // OpenTracingServerInterceptor returns a grpc.UnaryServerInterceptor suitable
@@ -23,61 +37,174 @@ import (
 //
 // Root or not, the server Span will be embedded in the context.Context for the
 // application-specific gRPC handler(s) to access.
+//
+// If tracer is nil or an opentracing.NoopTracer, the interceptor only calls
+// the handler, through WithServerInterceptor if set, at no per-call cost.
 func OpenTracingServerInterceptor(tracer opentracing.Tracer, optFuncs ...Option) grpc.UnaryServerInterceptor {
 	otgrpcOpts := newOptions()
 	otgrpcOpts.apply(optFuncs...)
+	return openTracingServerInterceptor(tracer, otgrpcOpts)
+}
+
+func openTracingServerInterceptor(tracer opentracing.Tracer, otgrpcOpts *options) grpc.UnaryServerInterceptor {
+	passThrough := func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if serverInterceptor := otgrpcOpts.forMethod(info.FullMethod).serverInterceptor; serverInterceptor != nil {
+			return serverInterceptor(ctx, req, info, handler)
+		}
+		return handler(ctx, req)
+	}
+	if isNoopTracer(tracer) && !otgrpcOpts.hasCallWork() {
+		return passThrough
+	}
 	return func(
 		ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (resp interface{}, err error) {
-		spanContext, err := extractSpanContext(ctx, tracer)
+		if otgrpcOpts.tracingDisabled() {
+			return passThrough(ctx, req, info, handler)
+		}
+		start := time.Now()
+		otgrpcOpts := otgrpcOpts.forMethod(info.FullMethod)
+		tracer := otgrpcOpts.callTracer(ctx, tracer, info.FullMethod)
+		spanContext, err := extractSpanContext(ctx, tracer, info.FullMethod, otgrpcOpts)
 		if err != nil && err != opentracing.ErrSpanContextNotFound {
-			// TODO: establish some sort of error reporting mechanism here. We
-			// don't know where to put such an error and must rely on Tracer
-			// implementations to do something appropriate for the time being.
+			otgrpcOpts.reportExtractError(err, info.FullMethod)
 		}
-		if otgrpcOpts.inclusionFunc != nil &&
-			!otgrpcOpts.inclusionFunc(spanContext, info.FullMethod, req, nil) {
+		if err == nil {
+			ctx = context.WithValue(ctx, ParentSpanContextKey{}, spanContext)
+		}
+		parentCtx, spanOption := serverSpanParent(ctx, spanContext, err, otgrpcOpts)
+		unsampled := otgrpcOpts.unsampledParent(parentCtx)
+		if unsampled || !otgrpcOpts.include(parentCtx, info.FullMethod, req, nil, err) ||
+			!otgrpcOpts.includeMetadata(ctx, info.FullMethod) {
+			if unsampled {
+				ctx = withUnsampledParent(ctx, tracer, parentCtx)
+			}
+			if otgrpcOpts.observeExcluded {
+				defer func() { otgrpcOpts.observeMetrics(info.FullMethod, err, start, false) }()
+			}
 			if otgrpcOpts.serverInterceptor != nil {
 				return otgrpcOpts.serverInterceptor(ctx, req, info, handler)
 			}
 			return handler(ctx, req)
 		}
-		serverSpan := StartSpanFactory(
-			spanContext,
+		serverSpan := otgrpcOpts.startRPCSpan(
+			parentCtx,
 			tracer,
-			info.FullMethod,
-			ext.RPCServerOption(spanContext),
-			gRPCComponentTag,
+			otgrpcOpts.operationName(info.FullMethod),
+			spanOption,
+			otgrpcOpts.componentTag(),
 		)
+		otgrpcOpts.setStaticTags(serverSpan)
+		if otgrpcOpts.parentPresenceTag {
+			setParentPresenceTag(serverSpan, spanContext, err)
+		}
 		defer serverSpan.Finish()
+		defer func() { otgrpcOpts.callSpanFinishHook(info.FullMethod, time.Since(start), err) }()
+		defer func() { otgrpcOpts.observeMetrics(info.FullMethod, err, start, false) }()
+		if otgrpcOpts.forceSampleHeader != "" {
+			setSamplingPriority(serverSpan, ctx, otgrpcOpts.forceSampleHeader)
+		}
+		if otgrpcOpts.panicRecovery {
+			defer func() {
+				if r := recover(); r != nil {
+					err = handlePanic(serverSpan, r, otgrpcOpts)
+				}
+			}()
+		}
+		if otgrpcOpts.tagServiceMethod {
+			setServiceMethodTags(serverSpan, info.FullMethod)
+		}
+		otgrpcOpts.tagFromRequest(serverSpan, info.FullMethod, req)
+		otgrpcOpts.setSpanTagsFromFunc(ctx, serverSpan, info.FullMethod, req)
+		if otgrpcOpts.spanObserver != nil {
+			otgrpcOpts.spanObserver(serverSpan, info.FullMethod, serverMetadata(ctx))
+		}
+		setPeerTags(serverSpan, ctx)
+		if len(otgrpcOpts.metadataTags) > 0 {
+			setServerMetadataTags(serverSpan, ctx, otgrpcOpts.metadataTags)
+		}
+		if len(otgrpcOpts.metadataToBaggage) > 0 {
+			metadataToBaggage(serverSpan, ctx, otgrpcOpts.metadataToBaggage, otgrpcOpts.overwriteBaggageMetadata)
+		}
+		if otgrpcOpts.authorityTag {
+			setAuthorityTag(serverSpan, ctx)
+		}
+		if otgrpcOpts.deadlineTag {
+			setDeadlineTag(serverSpan, ctx)
+		}
+
+		if otgrpcOpts.responseTraceHeader || otgrpcOpts.traceIDHeader != "" {
+			sendResponseTraceHeader(serverSpan, tracer, info.FullMethod, otgrpcOpts,
+				func(md metadata.MD) error { return grpc.SetHeader(ctx, md) },
+				func(md metadata.MD) error { return grpc.SetTrailer(ctx, md) })
+		}
 
 		ctx = opentracing.ContextWithSpan(ctx, serverSpan)
-		if otgrpcOpts.logPayloads {
-			serverSpan.LogFields(log.Object("gRPC request", req))
+		ctx = contextWithBaggage(ctx, serverSpan, otgrpcOpts.baggageToContext)
+		if otgrpcOpts.logRequests {
+			logPayload(serverSpan, info.FullMethod, RequestPayload, req, otgrpcOpts)
+		}
+		if otgrpcOpts.messageSizeTags {
+			setMessageSizeTag(serverSpan, "grpc.request.size", req)
 		}
 		if otgrpcOpts.serverInterceptor != nil {
 			resp, err = otgrpcOpts.serverInterceptor(ctx, req, info, handler)
 		} else {
 			resp, err = handler(ctx, req)
 		}
+		setCodeTag(serverSpan, err)
+		if otgrpcOpts.deadlineTag {
+			logDeadlineExceeded(serverSpan, ctx)
+		}
+		logClientCancelled(serverSpan, ctx, start)
 		if err == nil {
-			if otgrpcOpts.logPayloads {
-				serverSpan.LogFields(log.Object("gRPC response", resp))
+			if otgrpcOpts.logResponses {
+				logPayload(serverSpan, info.FullMethod, ResponsePayload, resp, otgrpcOpts)
+			}
+			if otgrpcOpts.messageSizeTags {
+				setMessageSizeTag(serverSpan, "grpc.response.size", resp)
 			}
 		} else if otgrpcOpts.logError {
-			SetSpanTags(serverSpan, err, false)
+			setErrorTags(serverSpan, err, false, otgrpcOpts)
 			serverSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
 		}
-		if otgrpcOpts.decorator != nil {
-			otgrpcOpts.decorator(ctx, serverSpan, info.FullMethod, req, resp, err)
+		if otgrpcOpts.logPayloadsOnFailure(err) {
+			logPayload(serverSpan, info.FullMethod, RequestPayload, req, otgrpcOpts)
+			if resp != nil {
+				logPayload(serverSpan, info.FullMethod, ResponsePayload, resp, otgrpcOpts)
+			}
+		}
+		otgrpcOpts.decorate(ctx, serverSpan, info.FullMethod, req, resp, err)
+		if err != nil && otgrpcOpts.traceIDInErrorDetails {
+			err = errorWithTraceID(err, serverSpan, otgrpcOpts)
 		}
 		return resp, err
 	}
 }
 
+// TracerSelectorFunc returns the Tracer to trace the RPCs of the gRPC method
+// fullMethod with, or nil for the global Tracer.
+type TracerSelectorFunc func(fullMethod string) opentracing.Tracer
+
+// OpenTracingServerInterceptorFunc is like OpenTracingServerInterceptor, but
+// traces each RPC with the Tracer that selector chooses for its method, e.g.
+// to move methods one at a time from a tracing backend to another. The
+// SpanContext of the RPC is extracted with that same Tracer.
+func OpenTracingServerInterceptorFunc(selector TracerSelectorFunc, optFuncs ...Option) grpc.UnaryServerInterceptor {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.tracerSelector = selector
+	otgrpcOpts.apply(optFuncs...)
+	return openTracingServerInterceptor(nil, otgrpcOpts)
+}
+
 // OpenTracingStreamServerInterceptor returns a grpc.StreamServerInterceptor suitable
 // for use in a grpc.NewServer call. The interceptor instruments streaming RPCs by
 // creating a single span to correspond to the lifetime of the RPC's stream.
@@ -97,65 +224,639 @@ func OpenTracingServerInterceptor(tracer opentracing.Tracer, optFuncs ...Option)
 func OpenTracingStreamServerInterceptor(tracer opentracing.Tracer, optFuncs ...Option) grpc.StreamServerInterceptor {
 	otgrpcOpts := newOptions()
 	otgrpcOpts.apply(optFuncs...)
-	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		spanContext, err := extractSpanContext(ss.Context(), tracer)
+	return openTracingStreamServerInterceptor(tracer, otgrpcOpts)
+}
+
+// OpenTracingStreamServerInterceptorFunc is like
+// OpenTracingStreamServerInterceptor, but traces each RPC with the Tracer that
+// selector chooses for its method, as OpenTracingServerInterceptorFunc does.
+func OpenTracingStreamServerInterceptorFunc(selector TracerSelectorFunc, optFuncs ...Option) grpc.StreamServerInterceptor {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.tracerSelector = selector
+	otgrpcOpts.apply(optFuncs...)
+	return openTracingStreamServerInterceptor(nil, otgrpcOpts)
+}
+
+func openTracingStreamServerInterceptor(tracer opentracing.Tracer, otgrpcOpts *options) grpc.StreamServerInterceptor {
+	passThrough := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if streamServerInterceptor := otgrpcOpts.forMethod(info.FullMethod).streamServerInterceptor; streamServerInterceptor != nil {
+			return streamServerInterceptor(srv, ss, info, handler)
+		}
+		return handler(srv, ss)
+	}
+	if isNoopTracer(tracer) && !otgrpcOpts.hasCallWork() {
+		return passThrough
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		if otgrpcOpts.tracingDisabled() {
+			return passThrough(srv, ss, info, handler)
+		}
+		start := time.Now()
+		otgrpcOpts := otgrpcOpts.forMethod(info.FullMethod)
+		tracer := otgrpcOpts.callTracer(ss.Context(), tracer, info.FullMethod)
+		spanContext, err := extractSpanContext(ss.Context(), tracer, info.FullMethod, otgrpcOpts)
 		if err != nil && err != opentracing.ErrSpanContextNotFound {
-			// TODO: establish some sort of error reporting mechanism here. We
-			// don't know where to put such an error and must rely on Tracer
-			// implementations to do something appropriate for the time being.
+			otgrpcOpts.reportExtractError(err, info.FullMethod)
 		}
-		if otgrpcOpts.inclusionFunc != nil &&
-			!otgrpcOpts.inclusionFunc(spanContext, info.FullMethod, nil, nil) {
+		if err == nil {
+			ss = WrapServerStream(ss, context.WithValue(ss.Context(), ParentSpanContextKey{}, spanContext))
+		}
+		parentCtx, spanOption := serverSpanParent(ss.Context(), spanContext, err, otgrpcOpts)
+		unsampled := otgrpcOpts.unsampledParent(parentCtx)
+		if unsampled || !otgrpcOpts.include(parentCtx, info.FullMethod, nil, nil, err) ||
+			!otgrpcOpts.includeMetadata(ss.Context(), info.FullMethod) {
+			if unsampled {
+				ss = WrapServerStream(ss, withUnsampledParent(ss.Context(), tracer, parentCtx))
+			}
+			if otgrpcOpts.observeExcluded {
+				defer func() { otgrpcOpts.observeMetrics(info.FullMethod, err, start, true) }()
+			}
 			if otgrpcOpts.streamServerInterceptor != nil {
 				return otgrpcOpts.streamServerInterceptor(srv, ss, info, handler)
 			}
 			return handler(srv, ss)
 		}
 
-		serverSpan := StartSpanFactory(
-			spanContext,
+		serverSpan := otgrpcOpts.startRPCSpan(
+			parentCtx,
 			tracer,
-			info.FullMethod,
-			ext.RPCServerOption(spanContext),
-			gRPCComponentTag,
+			otgrpcOpts.operationName(info.FullMethod),
+			spanOption,
+			otgrpcOpts.componentTag(),
 		)
-		defer serverSpan.Finish()
+		otgrpcOpts.setStaticTags(serverSpan)
+		if otgrpcOpts.parentPresenceTag {
+			setParentPresenceTag(serverSpan, spanContext, err)
+		}
+		var finishOpts opentracing.FinishOptions
+		defer func() {
+			if finishOpts.FinishTime.IsZero() {
+				otgrpcOpts.callSpanFinishHook(info.FullMethod, time.Since(start), err)
+				serverSpan.Finish()
+				return
+			}
+			otgrpcOpts.callSpanFinishHook(info.FullMethod, finishOpts.FinishTime.Sub(start), err)
+			serverSpan.FinishWithOptions(finishOpts)
+		}()
+		defer func() { otgrpcOpts.observeMetrics(info.FullMethod, err, start, true) }()
+		if otgrpcOpts.forceSampleHeader != "" {
+			setSamplingPriority(serverSpan, ss.Context(), otgrpcOpts.forceSampleHeader)
+		}
+		if otgrpcOpts.panicRecovery {
+			defer func() {
+				if r := recover(); r != nil {
+					err = handlePanic(serverSpan, r, otgrpcOpts)
+				}
+			}()
+		}
+		if otgrpcOpts.tagServiceMethod {
+			setServiceMethodTags(serverSpan, info.FullMethod)
+		}
+		otgrpcOpts.setSpanTagsFromFunc(ss.Context(), serverSpan, info.FullMethod, nil)
+		if otgrpcOpts.spanObserver != nil {
+			otgrpcOpts.spanObserver(serverSpan, info.FullMethod, serverMetadata(ss.Context()))
+		}
+		if otgrpcOpts.streamLifecycleEvents {
+			serverSpan.LogFields(log.String("event", "stream.open"))
+			defer serverSpan.LogFields(log.String("event", "stream.close"))
+		}
+		setPeerTags(serverSpan, ss.Context())
+		if len(otgrpcOpts.metadataTags) > 0 {
+			setServerMetadataTags(serverSpan, ss.Context(), otgrpcOpts.metadataTags)
+		}
+		if len(otgrpcOpts.metadataToBaggage) > 0 {
+			metadataToBaggage(serverSpan, ss.Context(), otgrpcOpts.metadataToBaggage, otgrpcOpts.overwriteBaggageMetadata)
+		}
+		if otgrpcOpts.authorityTag {
+			setAuthorityTag(serverSpan, ss.Context())
+		}
+		if otgrpcOpts.deadlineTag {
+			setDeadlineTag(serverSpan, ss.Context())
+		}
 		newCtx := opentracing.ContextWithSpan(ss.Context(), serverSpan)
-		ss = &openTracingServerStream{
-			ServerStream: ss,
-			ctx:          newCtx,
+		newCtx = contextWithBaggage(newCtx, serverSpan, otgrpcOpts.baggageToContext)
+		if otgrpcOpts.responseTraceHeader || otgrpcOpts.traceIDHeader != "" {
+			sendResponseTraceHeader(serverSpan, tracer, info.FullMethod, otgrpcOpts, ss.SetHeader,
+				func(md metadata.MD) error {
+					ss.SetTrailer(md)
+					return nil
+				})
 		}
+		otss := &openTracingServerStream{
+			counts:        messageCounts{sizes: otgrpcOpts.messageSizeTags},
+			ServerStream:  ss,
+			ctx:           newCtx,
+			payloads:      newStreamPayloadLogger(serverSpan, info.FullMethod, otgrpcOpts, false),
+			messageSpans:  otgrpcOpts.streamMessageSpans,
+			otgrpcOpts:    otgrpcOpts,
+			tracer:        tracer,
+			span:          serverSpan,
+			method:        info.FullMethod,
+			trackLastSend: otgrpcOpts.finishOnLastSend,
+		}
+		ss = otss
 
 		if otgrpcOpts.streamServerInterceptor != nil {
 			err = otgrpcOpts.streamServerInterceptor(srv, ss, info, handler)
 		} else {
 			err = handler(srv, ss)
 		}
+		setCodeTag(serverSpan, err)
+		if otgrpcOpts.deadlineTag {
+			logDeadlineExceeded(serverSpan, newCtx)
+		}
+		detected := "after_recv"
+		if atomic.LoadUint32(&otss.cancelledInRecv) != 0 {
+			detected = "recv"
+		}
+		logClientCancelled(serverSpan, newCtx, start, log.String("detected", detected))
+		otss.counts.setTags(serverSpan)
+		if otgrpcOpts.streamMessageSpans {
+			serverSpan.SetTag("grpc.message.count", atomic.LoadUint64(&otss.seq))
+		}
 
 		if err != nil && otgrpcOpts.logError {
-			SetSpanTags(serverSpan, err, false)
+			setErrorTags(serverSpan, err, false, otgrpcOpts)
 			serverSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
 		}
-		if otgrpcOpts.decorator != nil {
-			otgrpcOpts.decorator(newCtx, serverSpan, info.FullMethod, nil, nil, err)
+		otgrpcOpts.decorate(newCtx, serverSpan, info.FullMethod, nil, nil, err)
+		if otgrpcOpts.finishOnLastSend {
+			if lastSend := atomic.LoadInt64(&otss.lastSend); lastSend != 0 {
+				finishOpts.FinishTime = time.Unix(0, lastSend)
+				finishOpts.LogRecords = []opentracing.LogRecord{{
+					Timestamp: finishOpts.FinishTime,
+					Fields:    []log.Field{log.String("event", "last_send")},
+				}}
+			}
+		}
+		if err != nil && otgrpcOpts.traceIDInErrorDetails {
+			err = errorWithTraceID(err, serverSpan, otgrpcOpts)
 		}
 		return err
 	}
 }
 
-type openTracingServerStream struct {
+// TracedStream is implemented by the grpc.ServerStreams that the OpenTracing
+// stream server interceptor hands to the handlers of the RPCs it traces, for
+// middleware to tell them apart.
+type TracedStream interface {
+	// TracingSpan returns the server span of the stream.
+	TracingSpan() opentracing.Span
+}
+
+// SpanFromStream returns the server span of the stream ss, or a no-op span if
+// the stream is not traced, e.g. because it was excluded or tracing is
+// disabled. The span is found even if ss wraps the stream of the interceptor,
+// as long as ss.Context() derives from its context.
+func SpanFromStream(ss grpc.ServerStream) opentracing.Span {
+	if ts, ok := ss.(TracedStream); ok {
+		return ts.TracingSpan()
+	}
+	if span := opentracing.SpanFromContext(ss.Context()); span != nil {
+		return span
+	}
+	return opentracing.NoopTracer{}.StartSpan("")
+}
+
+// WrapServerStream returns a grpc.ServerStream that behaves as ss except that
+// its Context is ctx, for interceptors to hand a context derived from the one
+// of ss, e.g. one holding the server span, to the handlers further down the
+// chain.
+func WrapServerStream(ss grpc.ServerStream, ctx context.Context) grpc.ServerStream {
+	return &contextServerStream{ServerStream: ss, ctx: ctx}
+}
+
+// contextServerStream is a grpc.ServerStream with a different context.
+type contextServerStream struct {
 	grpc.ServerStream
 	ctx context.Context
 }
 
+func (ss *contextServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+type openTracingServerStream struct {
+	// The counters are accessed atomically and kept first for 64-bit
+	// alignment.
+	seq uint64
+	// lastSend is the time, in Unix nanoseconds, the last message was sent
+	// at, if trackLastSend is set.
+	lastSend int64
+	counts   messageCounts
+	// cancelledInRecv is set to 1 when RecvMsg fails because the client
+	// cancelled the RPC.
+	cancelledInRecv uint32
+
+	grpc.ServerStream
+	ctx      context.Context
+	payloads *streamPayloadLogger
+
+	// The fields below are only used when per-message spans are enabled.
+	messageSpans bool
+	otgrpcOpts   *options
+	tracer       opentracing.Tracer
+	span         opentracing.Span
+	method       string
+
+	trackLastSend bool
+}
+
 func (ss *openTracingServerStream) Context() context.Context {
 	return ss.ctx
 }
 
-func extractSpanContext(ctx context.Context, tracer opentracing.Tracer) (opentracing.SpanContext, error) {
+// TracingSpan implements TracedStream.
+func (ss *openTracingServerStream) TracingSpan() opentracing.Span {
+	return ss.span
+}
+
+func (ss *openTracingServerStream) SendMsg(m interface{}) (err error) {
+	if ss.messageSpans {
+		msgSpan := startMessageSpan(ss.otgrpcOpts, ss.tracer, ss.span, ss.method, "send", atomic.AddUint64(&ss.seq, 1))
+		// Deferred so that the message span is finished even if SendMsg panics.
+		defer func() { finishMessageSpan(msgSpan, err, false) }()
+	}
+	ss.payloads.log(m, true)
+	err = ss.ServerStream.SendMsg(m)
+	if err == nil {
+		ss.counts.countSent(m)
+		if ss.trackLastSend {
+			atomic.StoreInt64(&ss.lastSend, time.Now().UnixNano())
+		}
+	}
+	return err
+}
+
+func (ss *openTracingServerStream) RecvMsg(m interface{}) (err error) {
+	if ss.messageSpans {
+		msgSpan := startMessageSpan(ss.otgrpcOpts, ss.tracer, ss.span, ss.method, "recv", atomic.AddUint64(&ss.seq, 1))
+		// Deferred so that the message span is finished even if RecvMsg panics.
+		defer func() { finishMessageSpan(msgSpan, err, false) }()
+	}
+	err = ss.ServerStream.RecvMsg(m)
+	if err == nil {
+		ss.counts.countReceived(m)
+		ss.payloads.log(m, false)
+	} else if ss.ctx.Err() == context.Canceled {
+		atomic.StoreUint32(&ss.cancelledInRecv, 1)
+	}
+	return err
+}
+
+// serverSpanOption returns the option making a server span a server-kind
+// span referencing spanContext, the SpanContext of the client, with the
+// reference type configured in otgrpcOpts.
+func serverSpanOption(spanContext opentracing.SpanContext, otgrpcOpts *options) opentracing.StartSpanOption {
+	if otgrpcOpts.referenceType == opentracing.FollowsFromRef {
+		return followsFromServerOption{spanContext}
+	}
+	return ext.RPCServerOption(spanContext)
+}
+
+// serverSpanParent returns the parent of the server span of the RPC of ctx,
+// whose client sent spanContext, unless extracting it failed with err, in
+// which case it is nil, and the option making the server span reference it.
+// With WithLocalParentPreference, the span in ctx, if any, is preferred over
+// spanContext, which is then only followed from.
+func serverSpanParent(ctx context.Context, spanContext opentracing.SpanContext, err error, otgrpcOpts *options) (opentracing.SpanContext, opentracing.StartSpanOption) {
+	if otgrpcOpts.localParentPreference {
+		if local := opentracing.SpanFromContext(ctx); local != nil {
+			if err != nil {
+				spanContext = nil
+			}
+			return local.Context(), localParentServerOption{local.Context(), spanContext}
+		}
+	}
+	parent := spanContext
+	if err != nil {
+		parent = nil
+	}
+	return parent, serverSpanOption(spanContext, otgrpcOpts)
+}
+
+// unsampledParentSpan is a Span that records nothing, standing for the
+// unsampled parent of an RPC that is not traced because of
+// WithRespectUpstreamSampling.
+type unsampledParentSpan struct {
+	opentracing.Span
+	tracer opentracing.Tracer
+	parent opentracing.SpanContext
+}
+
+func (s unsampledParentSpan) Context() opentracing.SpanContext { return s.parent }
+
+func (s unsampledParentSpan) Tracer() opentracing.Tracer { return s.tracer }
+
+// withUnsampledParent returns a copy of ctx holding an unsampledParentSpan
+// for parent, so that the calls made by the handler are children of parent
+// rather than new traces.
+func withUnsampledParent(ctx context.Context, tracer opentracing.Tracer, parent opentracing.SpanContext) context.Context {
+	return opentracing.ContextWithSpan(ctx, unsampledParentSpan{opentracing.NoopTracer{}.StartSpan(""), tracer, parent})
+}
+
+// localParentServerOption makes a server span a child of the span of its
+// caller in the same process, that also follows from the SpanContext sent by
+// the client, if any and unless it is the same one.
+type localParentServerOption struct {
+	localContext, clientContext opentracing.SpanContext
+}
+
+func (o localParentServerOption) Apply(opts *opentracing.StartSpanOptions) {
+	ext.RPCServerOption(o.localContext).Apply(opts)
+	if o.clientContext != nil && !sameSpanContext(o.localContext, o.clientContext) {
+		opentracing.FollowsFrom(o.clientContext).Apply(opts)
+	}
+}
+
+// sameSpanContext reports whether a and b have the same trace and span IDs.
+func sameSpanContext(a, b opentracing.SpanContext) bool {
+	aTrace, aSpan, aOK := SpanContextIDs(a)
+	bTrace, bSpan, bOK := SpanContextIDs(b)
+	return aOK && bOK && aTrace == bTrace && aSpan == bSpan
+}
+
+// followsFromServerOption is the FollowsFrom counterpart of
+// ext.RPCServerOption.
+type followsFromServerOption struct {
+	clientContext opentracing.SpanContext
+}
+
+func (o followsFromServerOption) Apply(opts *opentracing.StartSpanOptions) {
+	if o.clientContext != nil {
+		opentracing.FollowsFrom(o.clientContext).Apply(opts)
+	}
+	ext.SpanKindRPCServer.Apply(opts)
+}
+
+// handlePanic flags serverSpan as failed and logs the value and the stack of
+// the panic r recovered from a handler. It then either re-panics with r or,
+// if panicsAsInternal is set, returns a codes.Internal error for the RPC.
+func handlePanic(serverSpan opentracing.Span, r interface{}, otgrpcOpts *options) error {
+	ext.Error.Set(serverSpan, true)
+	serverSpan.LogFields(
+		log.String("event", "panic"),
+		log.String("message", fmt.Sprint(r)),
+		log.String("stack", string(debug.Stack())),
+	)
+	if !otgrpcOpts.panicsAsInternal {
+		panic(r)
+	}
+	err := status.Errorf(codes.Internal, "panic: %v", r)
+	setCodeTag(serverSpan, err)
+	return err
+}
+
+// setSamplingPriority forces serverSpan to be sampled if the metadata attached
+// to ctx has a truthy header. Any value is truthy but an empty one or one
+// that strconv.ParseBool parses as false, e.g. "0" or "false".
+func setSamplingPriority(serverSpan opentracing.Span, ctx context.Context, header string) {
+	vals := serverMetadata(ctx)[strings.ToLower(header)]
+	if len(vals) == 0 || vals[0] == "" {
+		return
+	}
+	if sampled, err := strconv.ParseBool(vals[0]); err == nil && !sampled {
+		return
+	}
+	ext.SamplingPriority.Set(serverSpan, 1)
+}
+
+// setPeerTags tags serverSpan with the address and, when it was verified over
+// TLS, the identity of the peer that issued the RPC. Information that is not
+// known is left out, e.g. the peer of in-process connections.
+func setPeerTags(serverSpan opentracing.Span, ctx context.Context) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return
+	}
+	if p.Addr != nil {
+		ext.PeerAddress.Set(serverSpan, p.Addr.String())
+		if _, port, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			if port, err := strconv.ParseUint(port, 10, 16); err == nil {
+				ext.PeerPort.Set(serverSpan, uint16(port))
+			}
+		}
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		if chains := tlsInfo.State.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			serverSpan.SetTag("peer.identity", chains[0][0].Subject.CommonName)
+		}
+	}
+}
+
+// setAuthorityTag tags serverSpan with the ":authority" header of the RPC,
+// looked up in the metadata attached with NewContext, then in the incoming
+// gRPC metadata. The tag is left out if there is no such header.
+func setAuthorityTag(serverSpan opentracing.Span, ctx context.Context) {
+	md, _ := FromContext(ctx)
+	authority := md[":authority"]
+	if len(authority) == 0 {
+		md, _ = metadata.FromIncomingContext(ctx)
+		authority = md[":authority"]
+	}
+	if len(authority) > 0 {
+		serverSpan.SetTag("grpc.authority", authority[0])
+	}
+}
+
+// sendResponseTraceHeader sends the SpanContext of serverSpan and its trace
+// ID back to the client, as configured in otgrpcOpts, with setHeader, or with
+// setTrailer if setHeader fails, e.g. because the header was already sent.
+func sendResponseTraceHeader(
+	serverSpan opentracing.Span,
+	tracer opentracing.Tracer,
+	method string,
+	otgrpcOpts *options,
+	setHeader, setTrailer func(metadata.MD) error) {
+	md := metadata.MD{}
+	var err error
+	if otgrpcOpts.responseTraceHeader {
+		if md, err = injectCarrier(tracer, serverSpan.Context(), otgrpcOpts.propagationFormat); err != nil {
+			md = metadata.MD{}
+		}
+	}
+	if otgrpcOpts.traceIDHeader != "" {
+		traceIDFunc := otgrpcOpts.traceIDFunc
+		if traceIDFunc == nil {
+			traceIDFunc = SpanContextTraceID
+		}
+		if traceID := traceIDFunc(serverSpan.Context()); traceID != "" {
+			md[otgrpcOpts.traceIDHeader] = []string{traceID}
+		}
+	}
+	if len(md) > 0 {
+		if setErr := setHeader(md); setErr != nil {
+			setErr = setTrailer(md)
+			if err == nil {
+				err = setErr
+			}
+		}
+	}
+	if err != nil {
+		if otgrpcOpts.logError {
+			serverSpan.LogFields(log.String("event", "response trace header failed"), log.Error(err))
+		}
+		otgrpcOpts.reportTracingError(err, method)
+	}
+}
+
+// setParentPresenceTag tags serverSpan with whether the SpanContext of the
+// client was found, i.e. whether extracting it returned spanContext and err
+// with err nil.
+func setParentPresenceTag(serverSpan opentracing.Span, spanContext opentracing.SpanContext, err error) {
+	serverSpan.SetTag("grpc.has_parent", err == nil && spanContext != nil)
+}
+
+// serverMetadata returns the metadata attached to ctx with NewContext, or else
+// the incoming gRPC metadata, which may be nil.
+func serverMetadata(ctx context.Context) metadata.MD {
+	if md, ok := FromContext(ctx); ok {
+		return md
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md
+}
+
+// setServerMetadataTags tags serverSpan with the headers named keys of the
+// metadata attached with NewContext, or else of the incoming gRPC metadata.
+func setServerMetadataTags(serverSpan opentracing.Span, ctx context.Context, keys []string) {
+	md, _ := FromContext(ctx)
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	setMetadataTags(serverSpan, keys, md, incoming)
+}
+
+// setDeadlineTag tags serverSpan with the deadline of ctx, if it has one, and
+// with the time remaining until then.
+func setDeadlineTag(serverSpan opentracing.Span, ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		serverSpan.SetTag("grpc.deadline", deadline.UTC().Format(time.RFC3339Nano))
+		serverSpan.SetTag("grpc.deadline_remaining_ms", time.Until(deadline).Milliseconds())
+	}
+}
+
+// logClientCancelled logs a "client_cancelled" event on serverSpan, along with
+// fields and the milliseconds elapsed since start, if the client cancelled the
+// RPC of ctx. The span is not flagged as failed for it: that is left to the
+// error classification of the status the handler returned.
+func logClientCancelled(serverSpan opentracing.Span, ctx context.Context, start time.Time, fields ...log.Field) {
+	if ctx.Err() != context.Canceled {
+		return
+	}
+	serverSpan.LogFields(append([]log.Field{
+		log.String("event", "client_cancelled"),
+		log.Int64("elapsed_ms", time.Since(start).Milliseconds()),
+	}, fields...)...)
+}
+
+// logDeadlineExceeded logs a "deadline.exceeded" event on serverSpan if the
+// deadline of ctx has passed, along with how long ago.
+func logDeadlineExceeded(serverSpan opentracing.Span, ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if overrun := time.Since(deadline); overrun > 0 {
+			serverSpan.LogFields(
+				log.String("event", "deadline.exceeded"),
+				log.Int64("overrun_ms", overrun.Milliseconds()),
+			)
+		}
+	}
+}
+
+// ExtractSpanContext extracts the OpenTracing SpanContext carried in the gRPC
+// metadata attached to ctx, or else in the incoming gRPC metadata of ctx. It
+// returns opentracing.ErrSpanContextNotFound if there is no metadata or the
+// metadata carries no SpanContext.
+//
+// This is useful to continue a trace outside of the server interceptors, e.g.
+// when an RPC hands its work off to a background worker.
+func ExtractSpanContext(ctx context.Context, tracer opentracing.Tracer) (opentracing.SpanContext, error) {
+	return extractMetadata(ctx, tracer, opentracing.HTTPHeaders, nil)
+}
+
+// ParentSpanContextKey is the context.Context key under which the server
+// interceptors store the SpanContext they extract from the metadata of an RPC,
+// i.e. the parent of its server span, for its handler.
+type ParentSpanContextKey struct{}
+
+// ParentSpanContext returns the SpanContext that the server interceptors
+// extracted from the metadata of the RPC of ctx, e.g. for a handler to start
+// a sibling of its server span. ok is false if the RPC carried none.
+func ParentSpanContext(ctx context.Context) (sc opentracing.SpanContext, ok bool) {
+	sc, ok = ctx.Value(ParentSpanContextKey{}).(opentracing.SpanContext)
+	return
+}
+
+// extractSpanContext extracts the SpanContext of an RPC with tracer, falling
+// back on otgrpcOpts.extractFallbacks in order if tracer cannot find any. If a
+// fallback succeeds after another tracer failed with a genuine error, that
+// error is reported to the tracing error handler rather than returned.
+func extractSpanContext(ctx context.Context, tracer opentracing.Tracer, method string, otgrpcOpts *options) (opentracing.SpanContext, error) {
+	spanContext, err := extractMetadata(ctx, tracer, otgrpcOpts.propagationFormat, otgrpcOpts.incomingKeyMapper)
+	if err == nil || len(otgrpcOpts.extractFallbacks) == 0 {
+		return spanContext, err
+	}
+	if err == opentracing.ErrSpanContextNotFound {
+		err = nil
+	}
+	for _, fallback := range otgrpcOpts.extractFallbacks {
+		spanContext, fallbackErr := extractMetadata(ctx, fallback, otgrpcOpts.propagationFormat, otgrpcOpts.incomingKeyMapper)
+		if fallbackErr == nil {
+			if err != nil {
+				otgrpcOpts.reportExtractError(err, method)
+			}
+			return spanContext, nil
+		}
+		if err == nil && fallbackErr != opentracing.ErrSpanContextNotFound {
+			err = fallbackErr
+		}
+	}
+	if err == nil {
+		err = opentracing.ErrSpanContextNotFound
+	}
+	return nil, err
+}
+
+func extractMetadata(ctx context.Context, tracer opentracing.Tracer, format opentracing.BuiltinFormat, keyMapper IncomingKeyMapperFunc) (opentracing.SpanContext, error) {
 	md, ok := FromContext(ctx)
 	if !ok {
-		md = New(nil)
+		// Fall back on the metadata gRPC received, e.g. on servers whose
+		// clients only send the SpanContext in gRPC metadata.
+		if md, ok = metadata.FromIncomingContext(ctx); !ok {
+			md = New(nil)
+		}
+	}
+	return extractFromMD(md, tracer, format, keyMapper)
+}
+
+// decodeBinaryHeader decodes v, the value of a binary header, from base64,
+// padded or not, as gRPC does.
+func decodeBinaryHeader(v string) (string, bool) {
+	encoding := base64.StdEncoding
+	if len(v)%4 != 0 {
+		encoding = base64.RawStdEncoding
+	}
+	decoded, err := encoding.DecodeString(v)
+	return string(decoded), err == nil
+}
+
+// extractFromMD extracts with tracer the SpanContext carried by md in format.
+func extractFromMD(md metadata.MD, tracer opentracing.Tracer, format opentracing.BuiltinFormat, keyMapper IncomingKeyMapperFunc) (opentracing.SpanContext, error) {
+	if format == opentracing.Binary {
+		vals := metadataValues(md, binarySpanContextKey)
+		if len(vals) == 0 {
+			return nil, opentracing.ErrSpanContextNotFound
+		}
+		sc, err := tracer.Extract(format, strings.NewReader(vals[0]))
+		if err != nil {
+			// gRPC decodes the base64 of binary headers off the wire, but
+			// metadata that did not go through it, e.g. built with New or
+			// forwarded as is from gRPC-Web, may still be encoded.
+			if decoded, ok := decodeBinaryHeader(vals[0]); ok {
+				if decodedSC, decodedErr := tracer.Extract(format, strings.NewReader(decoded)); decodedErr == nil {
+					return decodedSC, nil
+				}
+			}
+		}
+		return sc, err
 	}
-	return tracer.Extract(opentracing.HTTPHeaders, metadataReaderWriter{md})
+	return tracer.Extract(format, metadataReaderWriter{MD: md, keyMapper: keyMapper})
 }
@@ -0,0 +1,1638 @@
+package otgrpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeServerStream is a grpc.ServerStream that receives a fixed number of
+// messages before returning io.EOF.
+type fakeServerStream struct {
+	ctx         context.Context
+	messages    int
+	panicOnSend bool
+}
+
+func (ss *fakeServerStream) SetHeader(metadata.MD) error  { return nil }
+func (ss *fakeServerStream) SendHeader(metadata.MD) error { return nil }
+func (ss *fakeServerStream) SetTrailer(metadata.MD)       {}
+func (ss *fakeServerStream) Context() context.Context     { return ss.ctx }
+func (ss *fakeServerStream) SendMsg(m interface{}) error {
+	if ss.panicOnSend {
+		panic("send")
+	}
+	return nil
+}
+func (ss *fakeServerStream) RecvMsg(m interface{}) error {
+	if ss.messages == 0 {
+		return io.EOF
+	}
+	ss.messages--
+	return nil
+}
+
+var streamInfo = &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Method"}
+
+// echoStreamHandler sends back one message for every message received.
+func echoStreamHandler(srv interface{}, ss grpc.ServerStream) error {
+	for {
+		if err := ss.RecvMsg(nil); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := ss.SendMsg(nil); err != nil {
+			return err
+		}
+	}
+}
+
+func TestStreamMessageSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer, WithStreamMessageSpans())
+	ss := &fakeServerStream{ctx: context.Background(), messages: 2}
+	err := interceptor(nil, ss, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 6 {
+		t.Fatalf("Incorrect span length")
+	}
+	streamSpan := spans[5]
+	expectedNames := []string{
+		"/pkg.Service/Method/recv",
+		"/pkg.Service/Method/send",
+		"/pkg.Service/Method/recv",
+		"/pkg.Service/Method/send",
+		"/pkg.Service/Method/recv",
+	}
+	assert.Equal(t, uint64(5), streamSpan.Tag("grpc.message.count"))
+	for i, name := range expectedNames {
+		assert.Equal(t, name, spans[i].OperationName)
+		assert.Equal(t, name[len("/pkg.Service/Method/"):], spans[i].Tag("grpc.message.direction"))
+		assert.Equal(t, streamSpan.SpanContext.SpanID, spans[i].ParentID)
+		assert.Equal(t, uint64(i+1), spans[i].Tag("grpc.message.seq"))
+		// The final io.EOF must not be treated as an error.
+		assert.Nil(t, spans[i].Tag("error"))
+	}
+}
+
+func TestStreamMessageSpansPanic(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer, WithStreamMessageSpans())
+	ss := &fakeServerStream{ctx: context.Background(), messages: 1, panicOnSend: true}
+	assert.Panics(t, func() {
+		interceptor(nil, ss, streamInfo, echoStreamHandler)
+	})
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "/pkg.Service/Method/recv", spans[0].OperationName)
+	assert.Equal(t, "/pkg.Service/Method/send", spans[1].OperationName)
+}
+
+func TestStreamMessageSpansDisabled(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer)
+	ss := &fakeServerStream{ctx: context.Background(), messages: 2}
+	err := interceptor(nil, ss, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tracer.FinishedSpans()))
+}
+
+var unaryInfo = &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+
+func echoHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return req, nil
+}
+
+func TestStreamMessageCounts(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer)
+	ss := &fakeServerStream{ctx: context.Background(), messages: 3}
+	// Sends concurrently with receives, as bidi handlers may do.
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ss.SendMsg(nil)
+			}()
+		}
+		for ss.RecvMsg(nil) == nil {
+		}
+		wg.Wait()
+		return nil
+	}
+	err := interceptor(nil, ss, streamInfo, handler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	// The final io.EOF is not a message.
+	assert.Equal(t, uint64(3), spans[0].Tag("grpc.stream.messages_received"))
+	assert.Equal(t, uint64(10), spans[0].Tag("grpc.stream.messages_sent"))
+}
+
+func TestOperationNameFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	var received []string
+	opName := WithOperationNameFunc(func(fullMethod string) string {
+		received = append(received, fullMethod)
+		return "renamed"
+	})
+
+	interceptor := OpenTracingServerInterceptor(tracer, opName)
+	_, err := interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer, opName)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "renamed", span.OperationName)
+	}
+	assert.Equal(t, []string{"/pkg.Service/Method", "/pkg.Service/Method"}, received)
+}
+
+func TestPeerAddressTag(t *testing.T) {
+	tracer := mocktracer.New()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4242}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+
+	interceptor := OpenTracingServerInterceptor(tracer)
+	_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	_, err = interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "10.0.0.1:4242", spans[0].Tag("peer.address"))
+	assert.Equal(t, uint16(4242), spans[0].Tag("peer.port"))
+	assert.Nil(t, spans[1].Tag("peer.address"))
+	assert.Nil(t, spans[1].Tag("peer.port"))
+	assert.Equal(t, "10.0.0.1:4242", spans[2].Tag("peer.address"))
+	assert.Equal(t, uint16(4242), spans[2].Tag("peer.port"))
+}
+
+func TestPeerIdentityTag(t *testing.T) {
+	tracer := mocktracer.New()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client.example.com"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4242},
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		},
+	})
+
+	interceptor := OpenTracingServerInterceptor(tracer)
+	_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, "client.example.com", tracer.FinishedSpans()[0].Tag("peer.identity"))
+}
+
+func TestPeerTagsBufconn(t *testing.T) {
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(
+		grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, WithAuthorityTag())),
+		grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+			return nil
+		}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+	cs, err := cc.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true}, "/pkg.Service/Method")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	assert.Equal(t, io.EOF, cs.RecvMsg(&emptypb.Empty{}))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "bufnet", spans[0].Tag("grpc.authority"))
+	// bufconn addresses have no port.
+	assert.Equal(t, "bufconn", spans[0].Tag("peer.address"))
+	assert.Nil(t, spans[0].Tag("peer.port"))
+	assert.Nil(t, spans[0].Tag("peer.identity"))
+}
+
+func TestAuthorityTag(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, tc := range []struct {
+		ctx      context.Context
+		optFuncs []Option
+		expected interface{}
+	}{
+		{NewContext(context.Background(), metadata.Pairs(":authority", "tenant.example.com")), []Option{WithAuthorityTag()}, "tenant.example.com"},
+		{metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "tenant.example.com")), []Option{WithAuthorityTag()}, "tenant.example.com"},
+		// The header is absent.
+		{context.Background(), []Option{WithAuthorityTag()}, nil},
+		// The tag is disabled.
+		{NewContext(context.Background(), metadata.Pairs(":authority", "tenant.example.com")), nil, nil},
+	} {
+		tracer.Reset()
+		_, err := OpenTracingServerInterceptor(tracer, tc.optFuncs...)(tc.ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, tracer.FinishedSpans()[0].Tag("grpc.authority"))
+	}
+}
+
+func TestParentPresenceTag(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	withParent, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+	corrupt := metadata.NewIncomingContext(context.Background(), metadata.Pairs("mockpfx-ids-traceid", "x"))
+	for _, tc := range []struct {
+		ctx      context.Context
+		optFuncs []Option
+		expected interface{}
+	}{
+		{withParent, []Option{WithParentPresenceTag()}, true},
+		{context.Background(), []Option{WithParentPresenceTag()}, false},
+		{corrupt, []Option{WithParentPresenceTag()}, false},
+		// The tag is disabled.
+		{withParent, nil, nil},
+	} {
+		tracer.Reset()
+		_, err := OpenTracingServerInterceptor(tracer, tc.optFuncs...)(tc.ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, tc.optFuncs...)(nil, &fakeServerStream{ctx: tc.ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		for _, span := range tracer.FinishedSpans() {
+			assert.Equal(t, tc.expected, span.Tag("grpc.has_parent"), span.OperationName)
+		}
+	}
+}
+
+func TestDeadlineTag(t *testing.T) {
+	tracer := mocktracer.New()
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	interceptor := OpenTracingServerInterceptor(tracer, WithDeadlineTag())
+	_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	_, err = interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer, WithDeadlineTag())
+	err = streamInterceptor(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "2030-01-02T03:04:05Z", spans[0].Tag("grpc.deadline"))
+	assert.Nil(t, spans[1].Tag("grpc.deadline"))
+	assert.Equal(t, "2030-01-02T03:04:05Z", spans[2].Tag("grpc.deadline"))
+}
+
+func TestDeadlineRemaining(t *testing.T) {
+	tracer := mocktracer.New()
+	past, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	near, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// The handler overruns the deadline.
+	overrun, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	slowHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		time.Sleep(5 * time.Millisecond)
+		return nil, nil
+	}
+
+	interceptor := OpenTracingServerInterceptor(tracer, WithDeadlineTag())
+	for _, ctx := range []context.Context{past, near, context.Background()} {
+		_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+	}
+	_, err := interceptor(overrun, nil, unaryInfo, slowHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, WithDeadlineTag())(nil, &fakeServerStream{ctx: past}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("Incorrect span length")
+	}
+	remaining := func(span *mocktracer.MockSpan) int64 {
+		return span.Tag("grpc.deadline_remaining_ms").(int64)
+	}
+	assert.True(t, remaining(spans[0]) <= -1000)
+	assert.True(t, remaining(spans[1]) > 0 && remaining(spans[1]) <= 60000)
+	assert.Nil(t, spans[2].Tag("grpc.deadline_remaining_ms"))
+	assert.True(t, remaining(spans[3]) >= 0 && remaining(spans[3]) <= 5)
+	assert.True(t, remaining(spans[4]) <= -1000)
+
+	for i, exceeded := range []bool{true, false, false, true, true} {
+		_, ok := logFields(spans[i])["overrun_ms"]
+		assert.Equal(t, exceeded, ok, "span %d", i)
+		if exceeded {
+			assert.Equal(t, "deadline.exceeded", logFields(spans[i])["event"])
+		}
+	}
+}
+
+func TestExtractErrorInclusionFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	var extractErrs []error
+	skipCorrupt := IncludingSpansOnExtractError(func(parentSpanCtx opentracing.SpanContext, method string, req interface{}, extractErr error) bool {
+		extractErrs = append(extractErrs, extractErr)
+		return extractErr == nil || extractErr == opentracing.ErrSpanContextNotFound
+	})
+
+	interceptor := OpenTracingServerInterceptor(corruptTracer{tracer}, skipCorrupt)
+	_, err := interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	streamInterceptor := OpenTracingStreamServerInterceptor(corruptTracer{tracer}, skipCorrupt)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	assert.Empty(t, tracer.FinishedSpans())
+
+	interceptor = OpenTracingServerInterceptor(tracer, skipCorrupt)
+	_, err = interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tracer.FinishedSpans()))
+
+	assert.Equal(t, []error{
+		opentracing.ErrSpanContextCorrupted,
+		opentracing.ErrSpanContextCorrupted,
+		opentracing.ErrSpanContextNotFound,
+	}, extractErrs)
+}
+
+// sampledSpanContext is a MockSpanContext telling whether it is sampled.
+type sampledSpanContext struct {
+	mocktracer.MockSpanContext
+	sampled bool
+}
+
+func (sc sampledSpanContext) IsSampled() bool { return sc.sampled }
+
+// sampledTracer extracts sampledSpanContexts that are sampled or not.
+type sampledTracer struct {
+	*mocktracer.MockTracer
+	sampled bool
+}
+
+func (t sampledTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	sc, err := t.MockTracer.Extract(format, carrier)
+	if err != nil {
+		return sc, err
+	}
+	return sampledSpanContext{sc.(mocktracer.MockSpanContext), t.sampled}, nil
+}
+
+func (t sampledTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sso := opentracing.StartSpanOptions{}
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	mockOpts := []opentracing.StartSpanOption{opentracing.Tags(sso.Tags)}
+	for _, ref := range sso.References {
+		if sc, ok := ref.ReferencedContext.(sampledSpanContext); ok {
+			ref.ReferencedContext = sc.MockSpanContext
+		}
+		mockOpts = append(mockOpts, ref)
+	}
+	return t.MockTracer.StartSpan(operationName, mockOpts...)
+}
+
+func TestRespectUpstreamSampling(t *testing.T) {
+	tracer := mocktracer.New()
+	var calls int
+	respect := WithRespectUpstreamSampling(func(spanContext opentracing.SpanContext) bool {
+		calls++
+		return SpanContextIsSampled(spanContext)
+	})
+	parent := tracer.StartSpan("parent")
+	incoming, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		sampled bool
+		ctx     context.Context
+		spans   int
+		calls   int
+	}{
+		{false, incoming, 0, 2},
+		{true, incoming, 2, 2},
+		// Without a parent, the predicate is not consulted.
+		{false, context.Background(), 2, 0},
+	} {
+		tracer.Reset()
+		calls = 0
+		handled := 0
+		sampled := sampledTracer{tracer, tc.sampled}
+		_, err := OpenTracingServerInterceptor(sampled, respect)(tc.ctx, nil, unaryInfo,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				handled++
+				return echoHandler(ctx, req)
+			})
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(sampled, respect)(nil, &fakeServerStream{ctx: tc.ctx}, streamInfo,
+			func(srv interface{}, ss grpc.ServerStream) error {
+				handled++
+				return echoStreamHandler(srv, ss)
+			})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, handled)
+		assert.Equal(t, tc.calls, calls, "%+v", tc)
+		spans := tracer.FinishedSpans()
+		assert.Equal(t, tc.spans, len(spans), "%+v", tc)
+		if tc.sampled {
+			for _, span := range spans {
+				assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+			}
+		}
+	}
+}
+
+func TestRespectUpstreamSamplingPropagation(t *testing.T) {
+	tracer := mocktracer.New()
+	respect := WithRespectUpstreamSampling(func(spanContext opentracing.SpanContext) bool {
+		return spanContext.(mocktracer.MockSpanContext).Sampled
+	})
+	parent := tracer.StartSpan("parent")
+	ext.SamplingPriority.Set(parent, 0)
+	parentID := strconv.Itoa(parent.Context().(mocktracer.MockSpanContext).SpanID)
+	incoming, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+
+	// The handler calls a downstream service through a client interceptor
+	// without the Option, which starts an unsampled child of the parent, and
+	// through one with it, which only sends the parent along.
+	var outgoing []metadata.MD
+	invoker := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		outgoing = append(outgoing, md)
+		return nil
+	}
+	callDownstream := func(ctx context.Context) {
+		assert.NoError(t, OpenTracingClientInterceptor(tracer)(ctx, "/pkg.Downstream/Method", nil, nil, nil, invoker))
+		assert.NoError(t, OpenTracingClientInterceptor(tracer, respect)(ctx, "/pkg.Downstream/Method", nil, nil, nil, invoker))
+	}
+	_, err = OpenTracingServerInterceptor(tracer, respect)(incoming, nil, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			callDownstream(ctx)
+			return nil, nil
+		})
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, respect)(nil, &fakeServerStream{ctx: incoming}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			callDownstream(ss.Context())
+			return nil
+		})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 || len(outgoing) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, span := range spans {
+		assert.Equal(t, ext.SpanKindRPCClientEnum, span.Tag(string(ext.SpanKind)))
+		assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+		assert.False(t, span.SpanContext.Sampled)
+		assert.Equal(t, []string{strconv.Itoa(span.SpanContext.SpanID)}, outgoing[2*i].Get("mockpfx-ids-spanid"))
+		assert.Equal(t, []string{parentID}, outgoing[2*i+1].Get("mockpfx-ids-spanid"))
+		assert.Equal(t, []string{"false"}, outgoing[2*i+1].Get("mockpfx-ids-sampled"))
+	}
+}
+
+func TestRespectUpstreamSamplingLocalParent(t *testing.T) {
+	tracer := mocktracer.New()
+	var calls int
+	respect := WithRespectUpstreamSampling(func(spanContext opentracing.SpanContext) bool {
+		calls++
+		return spanContext.(mocktracer.MockSpanContext).Sampled
+	})
+	// The RPC carries no SpanContext, but the local parent is unsampled.
+	local := tracer.StartSpan("local")
+	ext.SamplingPriority.Set(local, 0)
+	ctx := opentracing.ContextWithSpan(context.Background(), local)
+
+	_, err := OpenTracingServerInterceptor(tracer, WithLocalParentPreference(), respect)(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, WithLocalParentPreference(), respect)(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Empty(t, tracer.FinishedSpans())
+
+	// Without the preference, there is no parent to consult.
+	_, err = OpenTracingServerInterceptor(tracer, respect)(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, tracer.FinishedSpans(), 1)
+}
+
+func TestMetadataInclusionFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	debugOnly := WithMetadataInclusionFunc(func(md metadata.MD, fullMethod string) bool {
+		assert.Equal(t, "/pkg.Service/Method", fullMethod)
+		return len(md["x-debug"]) > 0 && md["x-debug"][0] == "true"
+	})
+	debugCtx := NewContext(context.Background(), New(map[string]string{"x-debug": "true"}))
+	otherCtx := NewContext(context.Background(), New(map[string]string{"x-debug": "false"}))
+
+	interceptor := OpenTracingServerInterceptor(tracer, debugOnly)
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer, debugOnly)
+	for _, ctx := range []context.Context{debugCtx, otherCtx, context.Background()} {
+		_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = streamInterceptor(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, len(tracer.FinishedSpans()))
+
+	// Both inclusion funcs must include the call.
+	tracer.Reset()
+	interceptor = OpenTracingServerInterceptor(tracer, debugOnly, IncludingSpans(ExcludeServices("pkg.Service")))
+	_, err := interceptor(debugCtx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Empty(t, tracer.FinishedSpans())
+}
+
+func TestMetadataInclusionFuncOverTheWire(t *testing.T) {
+	tracer := mocktracer.New()
+	debugOnly := WithMetadataInclusionFunc(func(md metadata.MD, fullMethod string) bool {
+		return len(md["x-debug"]) > 0 && md["x-debug"][0] == "true"
+	})
+	for _, serverOpt := range []grpc.ServerOption{
+		grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, debugOnly)),
+		grpc.StatsHandler(NewServerStatsHandler(tracer, debugOnly)),
+	} {
+		tracer.Reset()
+		cc := statsEchoConn(t, []grpc.ServerOption{serverOpt})
+		for _, debug := range []string{"false", "true"} {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "x-debug", debug)
+			err := cc.Invoke(ctx, "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+			assert.NoError(t, err)
+		}
+		waitForSpans(t, tracer, 1, bySpanID)
+	}
+}
+
+func TestTracingErrorHandler(t *testing.T) {
+	tracer := mocktracer.New()
+	var reported []error
+	handler := WithTracingErrorHandler(func(err error, method string) {
+		assert.Equal(t, "/pkg.Service/Method", method)
+		reported = append(reported, err)
+		panic("must not break the RPC")
+	})
+
+	interceptor := OpenTracingServerInterceptor(corruptTracer{tracer}, handler)
+	_, err := interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	streamInterceptor := OpenTracingStreamServerInterceptor(corruptTracer{tracer}, handler)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	// A missing SpanContext is not an error.
+	interceptor = OpenTracingServerInterceptor(tracer, handler)
+	_, err = interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []error{opentracing.ErrSpanContextCorrupted, opentracing.ErrSpanContextCorrupted}, reported)
+	assert.Equal(t, 3, len(tracer.FinishedSpans()))
+}
+
+func TestExtractErrorHandler(t *testing.T) {
+	tracer := mocktracer.New()
+	var reported, extractReported []error
+	optFuncs := []Option{
+		WithTracingErrorHandler(func(err error, method string) {
+			reported = append(reported, err)
+		}),
+		WithExtractErrorHandler(func(err error) {
+			extractReported = append(extractReported, err)
+			panic("must not break the RPC")
+		}),
+	}
+
+	_, err := OpenTracingServerInterceptor(corruptTracer{tracer}, optFuncs...)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(corruptTracer{tracer}, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	// A missing SpanContext is not an error.
+	_, err = OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	expected := []error{opentracing.ErrSpanContextCorrupted, opentracing.ErrSpanContextCorrupted}
+	assert.Equal(t, expected, extractReported)
+	assert.Equal(t, expected, reported)
+	assert.Equal(t, 3, len(tracer.FinishedSpans()))
+}
+
+func TestStreamLifecycleEvents(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer, WithStreamLifecycleEvents(), LogError())
+	err := interceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			return status.Error(codes.Internal, "")
+		})
+	assert.Error(t, err)
+
+	var events []string
+	for _, record := range tracer.FinishedSpans()[0].Logs() {
+		for _, field := range record.Fields {
+			if field.Key == "event" {
+				events = append(events, field.ValueString)
+			}
+		}
+	}
+	assert.Equal(t, []string{"stream.open", "error", "stream.close"}, events)
+}
+
+// b3Propagator propagates MockSpanContexts in B3 headers. Like Zipkin
+// tracers, it injects mixed-case header names, which end up lowercase in the
+// metadata.
+type b3Propagator struct{}
+
+func (b3Propagator) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	writer := carrier.(opentracing.TextMapWriter)
+	writer.Set("X-B3-TraceId", strconv.Itoa(sc.TraceID))
+	writer.Set("X-B3-SpanId", strconv.Itoa(sc.SpanID))
+	return nil
+}
+
+func (b3Propagator) Extract(carrier interface{}) (mocktracer.MockSpanContext, error) {
+	sc := mocktracer.MockSpanContext{}
+	err := carrier.(opentracing.TextMapReader).ForeachKey(func(key, val string) error {
+		var err error
+		switch key {
+		case "x-b3-traceid":
+			sc.TraceID, err = strconv.Atoi(val)
+		case "x-b3-spanid":
+			sc.SpanID, err = strconv.Atoi(val)
+		}
+		return err
+	})
+	if err != nil {
+		return sc, err
+	}
+	if sc.TraceID == 0 || sc.SpanID == 0 {
+		return sc, opentracing.ErrSpanContextNotFound
+	}
+	return sc, nil
+}
+
+func TestExtractFallbacks(t *testing.T) {
+	tracer := mocktracer.New()
+	b3Tracer := mocktracer.New()
+	b3Tracer.RegisterInjector(opentracing.HTTPHeaders, b3Propagator{})
+	b3Tracer.RegisterExtractor(opentracing.HTTPHeaders, b3Propagator{})
+
+	primaryParent := tracer.StartSpan("primary")
+	b3Parent := b3Tracer.StartSpan("b3")
+	primaryCtx, _ := InjectSpanContext(context.Background(), tracer, primaryParent.Context())
+	b3Ctx, _ := InjectSpanContext(context.Background(), b3Tracer, b3Parent.Context())
+	bothCtx, _ := InjectSpanContext(b3Ctx, tracer, primaryParent.Context())
+
+	for _, tc := range []struct {
+		name           string
+		ctx            context.Context
+		expectedParent int
+	}{
+		{"only B3", b3Ctx, b3Parent.Context().(mocktracer.MockSpanContext).SpanID},
+		{"only HTTPHeaders", primaryCtx, primaryParent.Context().(mocktracer.MockSpanContext).SpanID},
+		{"both", bothCtx, primaryParent.Context().(mocktracer.MockSpanContext).SpanID},
+		{"neither", context.Background(), 0},
+	} {
+		tracer.Reset()
+		var reported []error
+		interceptor := OpenTracingServerInterceptor(tracer,
+			WithExtractFallbacks(b3Tracer),
+			WithTracingErrorHandler(func(err error, method string) {
+				reported = append(reported, err)
+			}))
+		_, err := interceptor(tc.ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedParent, tracer.FinishedSpans()[0].ParentID, tc.name)
+		assert.Empty(t, reported, tc.name)
+	}
+}
+
+func TestExtractFallbacksParseError(t *testing.T) {
+	tracer := mocktracer.New()
+	b3Tracer := mocktracer.New()
+	b3Tracer.RegisterExtractor(opentracing.HTTPHeaders, b3Propagator{})
+	ctx := NewContext(context.Background(), New(map[string]string{"x-b3-traceid": "corrupt"}))
+
+	var reported []error
+	interceptor := OpenTracingServerInterceptor(tracer,
+		WithExtractFallbacks(b3Tracer),
+		WithTracingErrorHandler(func(err error, method string) {
+			reported = append(reported, err)
+		}))
+	_, err := interceptor(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tracer.FinishedSpans()[0].ParentID)
+	assert.Equal(t, 1, len(reported))
+}
+
+func TestSpanObserver(t *testing.T) {
+	tracer := mocktracer.New()
+	observer := WithSpanObserver(func(span opentracing.Span, fullMethod string, md metadata.MD) {
+		if tenant := md["x-tenant"]; len(tenant) > 0 {
+			span.SetTag("tenant", tenant[0])
+		}
+		span.SetTag("observed.method", fullMethod)
+	})
+	ctx := NewContext(context.Background(), New(map[string]string{"x-tenant": "acme"}))
+
+	interceptor := OpenTracingServerInterceptor(tracer, observer)
+	_, err := interceptor(ctx, nil, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		// The observer has already run when the handler starts.
+		span := opentracing.SpanFromContext(ctx).(*mocktracer.MockSpan)
+		assert.Equal(t, "acme", span.Tag("tenant"))
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	streamInterceptor := OpenTracingStreamServerInterceptor(tracer, observer)
+	err = streamInterceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "acme", spans[0].Tag("tenant"))
+	assert.Equal(t, "/pkg.Service/Method", spans[0].Tag("observed.method"))
+	assert.Nil(t, spans[1].Tag("tenant"))
+	assert.Equal(t, "/pkg.Service/Method", spans[1].Tag("observed.method"))
+}
+
+func TestSpanObserverOverTheWire(t *testing.T) {
+	tracer := mocktracer.New()
+	observer := WithSpanObserver(func(span opentracing.Span, fullMethod string, md metadata.MD) {
+		if tenant := md["x-tenant"]; len(tenant) > 0 {
+			span.SetTag("tenant", tenant[0])
+		}
+	})
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, observer))})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "acme")
+	err := cc.Invoke(ctx, "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 1, bySpanID)
+	assert.Equal(t, "acme", spans[0].Tag("tenant"))
+}
+
+func TestNilTracer(t *testing.T) {
+	ctx := NewContext(context.Background(), New(map[string]string{"mockpfx-ids-traceid": "1"}))
+	resp, err := OpenTracingServerInterceptor(nil, LogPayloads())(ctx, "req", unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, "req", resp)
+	err = OpenTracingStreamServerInterceptor(nil)(nil, &fakeServerStream{ctx: ctx, messages: 1}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(nil)(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(nil)(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(nil))
+}
+
+func panicHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	panic("boom")
+}
+
+func panicStreamHandler(srv interface{}, ss grpc.ServerStream) error {
+	panic("boom")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	tracer := mocktracer.New()
+	assert.PanicsWithValue(t, "boom", func() {
+		OpenTracingServerInterceptor(tracer, WithPanicRecovery())(context.Background(), nil, unaryInfo, panicHandler)
+	})
+	assert.PanicsWithValue(t, "boom", func() {
+		OpenTracingStreamServerInterceptor(tracer, WithPanicRecovery())(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, panicStreamHandler)
+	})
+	_, err := OpenTracingServerInterceptor(tracer, WithPanicsAsInternal())(context.Background(), nil, unaryInfo, panicHandler)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	err = OpenTracingStreamServerInterceptor(tracer, WithPanicsAsInternal())(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, panicStreamHandler)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, span := range spans {
+		assert.Equal(t, true, span.Tag("error"))
+		fields := logFields(span)
+		assert.Equal(t, "panic", fields["event"])
+		assert.Equal(t, "boom", fields["message"])
+		// The stack leads to the handler that panicked.
+		assert.Contains(t, fields["stack"], "server_test.go")
+		if i >= 2 {
+			assert.Equal(t, "Internal", span.Tag("grpc.code"))
+		}
+	}
+}
+
+func TestPanicRecoveryDisabled(t *testing.T) {
+	tracer := mocktracer.New()
+	assert.PanicsWithValue(t, "boom", func() {
+		OpenTracingServerInterceptor(tracer)(context.Background(), nil, unaryInfo, panicHandler)
+	})
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Nil(t, spans[0].Tag("error"))
+	assert.Empty(t, spans[0].Logs())
+}
+
+func TestForceSampleHeader(t *testing.T) {
+	tracer := mocktracer.New()
+	// Server spans inherit the sampling decision of this unsampled parent
+	// unless it is forced.
+	parent := tracer.StartSpan("parent")
+	ext.SamplingPriority.Set(parent, 0)
+	withParent := func(md map[string]string) context.Context {
+		ctx, err := InjectSpanContext(NewContext(context.Background(), New(md)), tracer, parent.Context())
+		assert.NoError(t, err)
+		return ctx
+	}
+	for _, tc := range []struct {
+		md       map[string]string
+		expected bool
+	}{
+		{map[string]string{"x-b3-sampled": "1"}, true},
+		{map[string]string{"x-b3-sampled": "true"}, true},
+		{map[string]string{"x-b3-sampled": "0"}, false},
+		{map[string]string{"x-b3-sampled": ""}, false},
+		{map[string]string{"x-other": "1"}, false},
+		{nil, false},
+	} {
+		tracer.Reset()
+		ctx := withParent(tc.md)
+		_, err := OpenTracingServerInterceptor(tracer, WithForceSampleHeader("X-B3-Sampled"))(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, WithForceSampleHeader("X-B3-Sampled"))(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		for _, span := range tracer.FinishedSpans() {
+			assert.Equal(t, tc.expected, span.SpanContext.Sampled, "%v", tc.md)
+		}
+	}
+
+	tracer.Reset()
+	ctx := withParent(map[string]string{"jaeger-debug-id": "abc"})
+	_, err := OpenTracingServerInterceptor(tracer, WithForceSampleHeader("jaeger-debug-id"))(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.True(t, tracer.FinishedSpans()[0].SpanContext.Sampled)
+}
+
+func TestForceSampleHeaderOverTheWire(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ext.SamplingPriority.Set(parent, 0)
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, WithForceSampleHeader("X-B3-Sampled")))},
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer)))
+	ctx := metadata.AppendToOutgoingContext(opentracing.ContextWithSpan(context.Background(), parent), "x-b3-sampled", "1")
+	err := cc.Invoke(ctx, "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	client, server := spans[0], spans[1]
+	assert.False(t, client.SpanContext.Sampled)
+	assert.True(t, server.SpanContext.Sampled)
+}
+
+func TestReferenceType(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ctx, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+
+	var refs []opentracing.SpanReferenceType
+	StartSpanFactory = func(spanContext opentracing.SpanContext, tracer opentracing.Tracer, operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+		sso := opentracing.StartSpanOptions{}
+		for _, o := range opts {
+			o.Apply(&sso)
+		}
+		for _, ref := range sso.References {
+			refs = append(refs, ref.Type)
+		}
+		return defaultStartSpan(spanContext, tracer, operationName, opts...)
+	}
+	defer func() { StartSpanFactory = defaultStartSpan }()
+
+	for _, optFuncs := range [][]Option{nil, {WithReferenceType(opentracing.FollowsFromRef)}} {
+		_, err = OpenTracingServerInterceptor(tracer, optFuncs...)(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []opentracing.SpanReferenceType{
+		opentracing.ChildOfRef, opentracing.ChildOfRef,
+		opentracing.FollowsFromRef, opentracing.FollowsFromRef,
+	}, refs)
+	_, err = OpenTracingServerInterceptor(tracer, WithReferenceType(opentracing.FollowsFromRef))(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, span := range spans {
+		assert.Equal(t, ext.SpanKindRPCServerEnum, span.Tag("span.kind"))
+		if i < 4 {
+			assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+		} else {
+			// Without a client SpanContext, the server span is a root span.
+			assert.Equal(t, 0, span.ParentID)
+		}
+	}
+}
+
+func TestLocalParentPreference(t *testing.T) {
+	tracer := mocktracer.New()
+	local := tracer.StartSpan("local")
+	remote := tracer.StartSpan("remote")
+	spanID := func(sc opentracing.SpanContext) int {
+		return sc.(mocktracer.MockSpanContext).SpanID
+	}
+
+	var refs []opentracing.SpanReference
+	factory := WithSpanFactory(func(spanContext opentracing.SpanContext, tracer opentracing.Tracer, operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+		sso := opentracing.StartSpanOptions{}
+		for _, o := range opts {
+			o.Apply(&sso)
+		}
+		refs = sso.References
+		return tracer.StartSpan(operationName, opts...)
+	})
+
+	withLocal := opentracing.ContextWithSpan(context.Background(), local)
+	withRemote, err := InjectSpanContext(context.Background(), tracer, remote.Context())
+	assert.NoError(t, err)
+	withBoth, err := InjectSpanContext(withLocal, tracer, remote.Context())
+	assert.NoError(t, err)
+	withSame, err := InjectSpanContext(withLocal, tracer, local.Context())
+	assert.NoError(t, err)
+	type ref struct {
+		refType opentracing.SpanReferenceType
+		spanID  int
+	}
+	for _, tc := range []struct {
+		name         string
+		ctx          context.Context
+		optFuncs     []Option
+		expectedRefs []ref
+	}{
+		{"context only", withLocal, []Option{WithLocalParentPreference()}, []ref{{opentracing.ChildOfRef, spanID(local.Context())}}},
+		{"metadata only", withRemote, []Option{WithLocalParentPreference()}, []ref{{opentracing.ChildOfRef, spanID(remote.Context())}}},
+		{"both", withBoth, []Option{WithLocalParentPreference()}, []ref{
+			{opentracing.ChildOfRef, spanID(local.Context())},
+			{opentracing.FollowsFromRef, spanID(remote.Context())},
+		}},
+		{"same", withSame, []Option{WithLocalParentPreference()}, []ref{{opentracing.ChildOfRef, spanID(local.Context())}}},
+		// The context is ignored by default.
+		{"disabled", withBoth, nil, []ref{{opentracing.ChildOfRef, spanID(remote.Context())}}},
+	} {
+		tracer.Reset()
+		var unaryRefs, streamRefs []ref
+		optFuncs := append([]Option{factory}, tc.optFuncs...)
+		_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(tc.ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		for _, r := range refs {
+			unaryRefs = append(unaryRefs, ref{r.Type, spanID(r.ReferencedContext)})
+		}
+		err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: tc.ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		for _, r := range refs {
+			streamRefs = append(streamRefs, ref{r.Type, spanID(r.ReferencedContext)})
+		}
+		assert.Equal(t, tc.expectedRefs, unaryRefs, tc.name)
+		assert.Equal(t, tc.expectedRefs, streamRefs, tc.name)
+		for _, span := range tracer.FinishedSpans() {
+			assert.Equal(t, ext.SpanKindRPCServerEnum, span.Tag("span.kind"), tc.name)
+			assert.Equal(t, tc.expectedRefs[0].spanID, span.ParentID, tc.name)
+		}
+	}
+}
+
+func TestTracerProvider(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.GlobalTracer())
+	var calls int
+	provider := WithTracerProvider(func() opentracing.Tracer {
+		calls++
+		return opentracing.GlobalTracer()
+	})
+	// The interceptors are built before the global tracer is set.
+	opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	unary := OpenTracingServerInterceptor(nil, provider)
+	stream := OpenTracingStreamServerInterceptor(nil, provider)
+	client := OpenTracingClientInterceptor(nil, provider)
+	streamClient := OpenTracingStreamClientInterceptor(nil, provider)
+
+	for i := 0; i < 2; i++ {
+		tracer := mocktracer.New()
+		opentracing.SetGlobalTracer(tracer)
+		calls = 0
+		ctx := context.Background()
+		_, err := unary(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = stream(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		err = client(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := streamClient(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		cs.(*openTracingClientStream).finishFunc(nil)
+
+		assert.Equal(t, 4, calls)
+		assert.Len(t, tracer.FinishedSpans(), 4)
+	}
+}
+
+type tenantKey struct{}
+
+func TestTracerFromContext(t *testing.T) {
+	defaultTracer, tenantTracer := mocktracer.New(), mocktracer.New()
+	fromContext := WithTracerFromContext(func(ctx context.Context) opentracing.Tracer {
+		if tracer, ok := ctx.Value(tenantKey{}).(opentracing.Tracer); ok {
+			return tracer
+		}
+		return nil
+	})
+	unary := OpenTracingServerInterceptor(defaultTracer, fromContext)
+	stream := OpenTracingStreamServerInterceptor(defaultTracer, fromContext)
+	client := OpenTracingClientInterceptor(defaultTracer, fromContext)
+	streamClient := OpenTracingStreamClientInterceptor(defaultTracer, fromContext)
+
+	for _, tc := range []struct {
+		ctx    context.Context
+		tracer *mocktracer.MockTracer
+	}{
+		{context.WithValue(context.Background(), tenantKey{}, opentracing.Tracer(tenantTracer)), tenantTracer},
+		{context.Background(), defaultTracer},
+	} {
+		parent := tc.tracer.StartSpan("parent")
+		incoming, err := InjectSpanContext(tc.ctx, tc.tracer, parent.Context())
+		assert.NoError(t, err)
+		_, err = unary(incoming, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = stream(nil, &fakeServerStream{ctx: incoming}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		err = client(tc.ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := streamClient(tc.ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		cs.(*openTracingClientStream).finishFunc(nil)
+
+		spans := tc.tracer.FinishedSpans()
+		if len(spans) != 4 {
+			t.Fatalf("Incorrect span length")
+		}
+		// The server spans join the trace extracted with the same Tracer.
+		for _, span := range spans[:2] {
+			assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+		}
+	}
+
+	// The NoopTracer does not bypass the function.
+	err := OpenTracingClientInterceptor(opentracing.NoopTracer{}, fromContext)(
+		context.WithValue(context.Background(), tenantKey{}, opentracing.Tracer(tenantTracer)),
+		"/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	assert.Len(t, tenantTracer.FinishedSpans(), 5)
+}
+
+func TestIncomingKeyMapper(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	injectedCtx, _ := InjectSpanContext(context.Background(), tracer, parent.Context())
+	injected, _ := FromContext(injectedCtx)
+	// A legacy service sends the trace headers under a prefix.
+	legacy := metadata.MD{"x-unrelated": {"value"}}
+	for k, v := range injected {
+		legacy["legacy-"+k] = v
+	}
+	ctx := NewContext(context.Background(), legacy)
+
+	var mapped []string
+	mapper := WithIncomingKeyMapper(func(key string) (string, bool) {
+		mapped = append(mapped, key)
+		if !strings.HasPrefix(key, "legacy-") {
+			return "", false
+		}
+		return strings.TrimPrefix(key, "legacy-"), true
+	})
+	_, err := OpenTracingServerInterceptor(tracer, mapper)(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Contains(t, mapped, "x-unrelated")
+	_, err = OpenTracingServerInterceptor(tracer)(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	assert.Equal(t, 0, spans[1].ParentID)
+}
+
+func TestStreamFinishOnLastSend(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer, WithStreamFinishOnLastSend())
+	var sentBy time.Time
+	err := interceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			if err := ss.SendMsg(nil); err != nil {
+				return err
+			}
+			sentBy = time.Now()
+			// Work done after the last send is left out of the span.
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+	assert.NoError(t, err)
+	err = interceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	logs := spans[0].Logs()
+	assert.Equal(t, "last_send", logs[len(logs)-1].Fields[0].ValueString)
+	assert.Equal(t, spans[0].FinishTime, logs[len(logs)-1].Timestamp)
+	assert.False(t, spans[0].FinishTime.After(sentBy))
+	// Streams that sent nothing are finished as usual.
+	assert.Empty(t, spans[1].Logs())
+	assert.False(t, spans[1].FinishTime.IsZero())
+}
+
+func TestWrapServerStream(t *testing.T) {
+	tracer := mocktracer.New()
+	type key struct{}
+	// A downstream interceptor adds to the context of the traced stream.
+	downstream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, WrapServerStream(ss, context.WithValue(ss.Context(), key{}, "value")))
+	}
+	err := OpenTracingStreamServerInterceptor(tracer, WithStreamServerInterceptor(downstream))(nil,
+		&fakeServerStream{ctx: context.Background(), messages: 1}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			assert.Equal(t, "value", ss.Context().Value(key{}))
+			assert.NotNil(t, opentracing.SpanFromContext(ss.Context()))
+			// The other methods reach the traced stream.
+			assert.NoError(t, ss.RecvMsg(nil))
+			return ss.SendMsg(nil)
+		})
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, uint64(1), spans[0].Tag("grpc.stream.messages_sent"))
+	assert.Equal(t, uint64(1), spans[0].Tag("grpc.stream.messages_received"))
+}
+
+func TestSpanFromStream(t *testing.T) {
+	tracer := mocktracer.New()
+	exclude := IncludingSpans(func(parentSpanCtx opentracing.SpanContext, method string, req, resp interface{}) bool {
+		return method != "/pkg.Service/Excluded"
+	})
+	interceptor := OpenTracingStreamServerInterceptor(tracer, exclude)
+
+	var spans []opentracing.Span
+	var traced []bool
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		_, ok := ss.(TracedStream)
+		traced = append(traced, ok)
+		span := SpanFromStream(ss)
+		// The span is usable either way.
+		span.SetTag("handled", true)
+		spans = append(spans, span)
+		return nil
+	}
+	for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Excluded"} {
+		err := interceptor(nil, &fakeServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: method}, handler)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []bool{true, false}, traced)
+	finished := tracer.FinishedSpans()
+	if len(finished) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, finished[0], spans[0])
+	assert.Equal(t, true, finished[0].Tag("handled"))
+	assert.IsType(t, opentracing.NoopTracer{}.StartSpan(""), spans[1])
+
+	// Streams wrapping the traced one are supported through their context.
+	ctx := opentracing.ContextWithSpan(context.Background(), finished[0])
+	assert.Equal(t, finished[0], SpanFromStream(&fakeServerStream{ctx: ctx}))
+}
+
+func TestTracerSelector(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.GlobalTracer())
+	globalTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(globalTracer)
+	oldTracer, newTracer := mocktracer.New(), mocktracer.New()
+	selector := func(fullMethod string) opentracing.Tracer {
+		switch fullMethod {
+		case "/pkg.Service/Old":
+			return oldTracer
+		case "/pkg.Service/New":
+			return newTracer
+		}
+		return nil
+	}
+
+	// The new tracer must find the parent it propagated.
+	parent := newTracer.StartSpan("parent")
+	ctx, err := InjectSpanContext(context.Background(), newTracer, parent.Context())
+	assert.NoError(t, err)
+	unary := OpenTracingServerInterceptorFunc(selector)
+	stream := OpenTracingStreamServerInterceptorFunc(selector)
+	for _, method := range []string{"/pkg.Service/Old", "/pkg.Service/New", "/pkg.Service/Other"} {
+		_, err := unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, echoHandler)
+		assert.NoError(t, err)
+		err = stream(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, echoStreamHandler)
+		assert.NoError(t, err)
+	}
+
+	for tracer, method := range map[*mocktracer.MockTracer]string{
+		oldTracer:    "/pkg.Service/Old",
+		newTracer:    "/pkg.Service/New",
+		globalTracer: "/pkg.Service/Other",
+	} {
+		spans := tracer.FinishedSpans()
+		if len(spans) != 2 {
+			t.Fatalf("Incorrect span length")
+		}
+		for _, span := range spans {
+			assert.Equal(t, method, span.OperationName)
+		}
+	}
+	for _, span := range newTracer.FinishedSpans() {
+		assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+	}
+}
+
+func TestClientCancelledEvent(t *testing.T) {
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	started := make(chan struct{}, 1)
+	// done is signalled once the server span of an RPC is finished.
+	done := make(chan struct{}, 1)
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				defer func() { done <- struct{}{} }()
+				return handler(ctx, req)
+			},
+			OpenTracingServerInterceptor(tracer)),
+		grpc.ChainStreamInterceptor(
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				defer func() { done <- struct{}{} }()
+				return handler(srv, ss)
+			},
+			OpenTracingStreamServerInterceptor(tracer)),
+		grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(ss)
+			if method == "/pkg.Service/AfterRecv" {
+				if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+					return err
+				}
+				started <- struct{}{}
+				<-ss.Context().Done()
+				return status.FromContextError(ss.Context().Err()).Err()
+			}
+			started <- struct{}{}
+			for {
+				if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+					return err
+				}
+			}
+		}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "pkg.Unary",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Method",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &emptypb.Empty{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/pkg.Unary/Method"},
+					func(ctx context.Context, req interface{}) (interface{}, error) {
+						started <- struct{}{}
+						<-ctx.Done()
+						return nil, status.FromContextError(ctx.Err()).Err()
+					})
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	err = cc.Invoke(ctx, "/pkg.Unary/Method", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	<-done
+
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	for _, method := range []string{"/pkg.Service/Recv", "/pkg.Service/AfterRecv"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cs, err := cc.NewStream(ctx, desc, method)
+		if err != nil {
+			t.Fatalf("NewStream = %v", err)
+		}
+		assert.NoError(t, cs.SendMsg(&emptypb.Empty{}))
+		<-started
+		cancel()
+		<-done
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, detected := range []string{"", "recv", "after_recv"} {
+		fields := logFields(spans[i])
+		assert.Equal(t, "client_cancelled", fields["event"], "span %d", i)
+		assert.Contains(t, fields, "elapsed_ms", "span %d", i)
+		if detected != "" {
+			assert.Equal(t, detected, fields["detected"], "span %d", i)
+		}
+		assert.Nil(t, spans[i].Tag(string(ext.Error)), "span %d", i)
+	}
+}
+
+func TestClientCancelledEventAbsent(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingServerInterceptor(tracer)
+	_, err := interceptor(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.NotContains(t, logFields(tracer.FinishedSpans()[0]), "elapsed_ms")
+}
+
+func TestParentSpanContext(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	withParent, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+	exclude := IncludingSpans(ExcludeMethods("/pkg.Service/Excluded"))
+
+	var parents []opentracing.SpanContext
+	record := func(ctx context.Context) {
+		sc, ok := ParentSpanContext(ctx)
+		assert.Equal(t, sc != nil, ok)
+		parents = append(parents, sc)
+	}
+	unaryHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		record(ctx)
+		return nil, nil
+	}
+	streamHandler := func(srv interface{}, ss grpc.ServerStream) error {
+		record(ss.Context())
+		return nil
+	}
+	for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Excluded"} {
+		for _, ctx := range []context.Context{withParent, context.Background()} {
+			_, err := OpenTracingServerInterceptor(tracer, exclude)(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, unaryHandler)
+			assert.NoError(t, err)
+			err = OpenTracingStreamServerInterceptor(tracer, exclude)(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, streamHandler)
+			assert.NoError(t, err)
+		}
+	}
+
+	for i, sc := range parents {
+		if i%4 < 2 {
+			assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, sc.(mocktracer.MockSpanContext).SpanID, "call %d", i)
+		} else {
+			assert.Nil(t, sc, "call %d", i)
+		}
+	}
+	// The server spans are children of the parent rather than the parent.
+	for _, span := range tracer.FinishedSpans() {
+		assert.NotEqual(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.SpanContext.SpanID)
+	}
+}
+
+func TestSpanFinishHook(t *testing.T) {
+	tracer := mocktracer.New()
+	type call struct {
+		method   string
+		err      error
+		finished int
+	}
+	var calls []call
+	hook := WithSpanFinishHook(func(fullMethod string, duration time.Duration, err error) {
+		assert.True(t, duration >= 10*time.Millisecond, fullMethod)
+		calls = append(calls, call{fullMethod, err, len(tracer.FinishedSpans())})
+		panic("hook")
+	})
+	exclude := IncludingSpans(ExcludeMethods("/pkg.Service/Excluded"))
+	notFound := status.Error(codes.NotFound, "")
+
+	_, err := OpenTracingServerInterceptor(tracer, hook, exclude)(context.Background(), nil, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			time.Sleep(10 * time.Millisecond)
+			return nil, notFound
+		})
+	assert.Equal(t, notFound, err)
+	err = OpenTracingStreamServerInterceptor(tracer, hook, exclude)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+	assert.NoError(t, err)
+	_, err = OpenTracingServerInterceptor(tracer, hook, exclude)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Excluded"}, echoHandler)
+	assert.NoError(t, err)
+
+	// The hook runs right before each span is finished.
+	assert.Equal(t, []call{
+		{unaryInfo.FullMethod, notFound, 0},
+		{streamInfo.FullMethod, nil, 1},
+	}, calls)
+	assert.Len(t, tracer.FinishedSpans(), 2)
+}
+
+func TestResponseTraceHeader(t *testing.T) {
+	tracer := mocktracer.New()
+	interceptor := OpenTracingStreamServerInterceptor(tracer, WithResponseTraceHeader())
+	lis := serveBufconn(t,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			return ss.SendMsg(&emptypb.Empty{})
+		},
+		[]grpc.ServerOption{
+			grpc.UnaryInterceptor(OpenTracingServerInterceptor(tracer, WithResponseTraceHeader())),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				// The header is already sent when the interceptor runs.
+				if info.FullMethod == "/pkg.Service/HeaderSent" {
+					if err := ss.SendHeader(nil); err != nil {
+						return err
+					}
+				}
+				return interceptor(srv, ss, info, handler)
+			}),
+		},
+		unaryService(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return req, nil
+		}))
+	cc := dialBufconn(t, lis)
+
+	var headers, trailers []metadata.MD
+	for _, method := range []string{"/pkg.Unary/Method", "/pkg.Service/Method", "/pkg.Service/HeaderSent"} {
+		var header, trailer metadata.MD
+		err := cc.Invoke(context.Background(), method, &emptypb.Empty{}, &emptypb.Empty{}, grpc.Header(&header), grpc.Trailer(&trailer))
+		assert.NoError(t, err, method)
+		headers, trailers = append(headers, header), append(trailers, trailer)
+	}
+
+	spans := waitForSpans(t, tracer, 3, bySpanID)
+	for i, md := range []metadata.MD{headers[0], headers[1], trailers[2]} {
+		spanID := strconv.Itoa(spans[i].SpanContext.SpanID)
+		assert.Equal(t, []string{spanID}, md.Get("mockpfx-ids-spanid"), spans[i].OperationName)
+	}
+	assert.Empty(t, trailers[0].Get("mockpfx-ids-spanid"))
+	assert.Empty(t, headers[2].Get("mockpfx-ids-spanid"))
+
+	// Failures are reported.
+	var tracingErrs []error
+	_, err := OpenTracingServerInterceptor(tracer, WithResponseTraceHeader(), LogError(),
+		WithTracingErrorHandler(func(err error, method string) {
+			tracingErrs = append(tracingErrs, err)
+		}))(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Len(t, tracingErrs, 1)
+}
+
+func TestTraceIDResponseHeader(t *testing.T) {
+	tracer := mocktracer.New()
+	opt := WithTraceIDResponseHeader("X-Trace-ID", nil)
+	lis := serveBufconn(t,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			if err := ss.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			// The header of the handler is sent along with the trace ID.
+			if err := ss.SendHeader(metadata.Pairs("x-handler", "1")); err != nil {
+				return err
+			}
+			for i := 0; i < 2; i++ {
+				if err := ss.SendMsg(&emptypb.Empty{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		[]grpc.ServerOption{
+			grpc.UnaryInterceptor(OpenTracingServerInterceptor(tracer, opt)),
+			grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, opt)),
+		},
+		unaryService(func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.Internal, "")
+		}))
+	cc := dialBufconn(t, lis)
+
+	var unaryHeader metadata.MD
+	err := cc.Invoke(context.Background(), "/pkg.Unary/Method", &emptypb.Empty{}, &emptypb.Empty{}, grpc.Header(&unaryHeader))
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	cs, err := cc.NewStream(context.Background(), &grpc.StreamDesc{ServerStreams: true}, "/pkg.Service/Method")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	assert.NoError(t, cs.SendMsg(&emptypb.Empty{}))
+	assert.NoError(t, cs.CloseSend())
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, cs.RecvMsg(&emptypb.Empty{}))
+	}
+	assert.Equal(t, io.EOF, cs.RecvMsg(&emptypb.Empty{}))
+	streamHeader, err := cs.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, streamHeader.Get("x-handler"))
+
+	spans := waitForSpans(t, tracer, 2, bySpanID)
+	for i, md := range []metadata.MD{unaryHeader, streamHeader} {
+		traceID := strconv.Itoa(spans[i].SpanContext.TraceID)
+		assert.Equal(t, []string{traceID}, md.Get("x-trace-id"), spans[i].OperationName)
+		// The SpanContext itself is only sent with WithResponseTraceHeader.
+		assert.Empty(t, md.Get("mockpfx-ids-spanid"))
+	}
+}
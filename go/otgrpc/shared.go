@@ -1,26 +1,57 @@
 package otgrpc
 
 import (
+	"fmt"
+	"io"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
 	"google.golang.org/grpc/metadata"
 )
 
+const (
+	// binarySpanContextKey is the metadata key under which the SpanContext is
+	// propagated in the opentracing.Binary format. The "-bin" suffix makes
+	// gRPC base64-encode the value on the wire.
+	binarySpanContextKey = "ot-span-context-bin"
+)
+
 var (
 	// Morally a const:
 	gRPCComponentTag = opentracing.Tag{string(ext.Component), "gRPC"}
 
-	// StartSpanFactory ...
+	// StartSpanFactory starts the spans of the interceptors and stats
+	// handlers that were not given WithSpanFactory.
+	//
+	// Deprecated: Use WithSpanFactory, which, unlike setting this variable,
+	// only affects the interceptors it is given to.
 	StartSpanFactory = defaultStartSpan
 )
 
+// SpanFactoryFunc starts the span named operationName with tracer and opts,
+// whose parent, if any, is the SpanContext parent. See WithSpanFactory.
+type SpanFactoryFunc func(
+	parent opentracing.SpanContext,
+	tracer opentracing.Tracer,
+	operationName string,
+	opts ...opentracing.StartSpanOption) opentracing.Span
 
 // metadataReaderWriter satisfies both the opentracing.TextMapReader and
-// opentracing.TextMapWriter interfaces.
+// opentracing.TextMapWriter interfaces. The values of binary headers, whose
+// names end in "-bin", are handed as they are: gRPC base64-encodes them on
+// the wire and decodes them on receipt, so that they round-trip unchanged.
 type metadataReaderWriter struct {
 	metadata.MD
+
+	// keyMapper, if not nil, maps the keys passed to the handler of
+	// ForeachKey.
+	keyMapper IncomingKeyMapperFunc
 }
 
 func (w metadataReaderWriter) Set(key, val string) {
@@ -35,6 +66,12 @@ func (w metadataReaderWriter) Set(key, val string) {
 
 func (w metadataReaderWriter) ForeachKey(handler func(key, val string) error) error {
 	for k, vals := range w.MD {
+		if w.keyMapper != nil {
+			var ok bool
+			if k, ok = w.keyMapper(k); !ok {
+				continue
+			}
+		}
 		for _, v := range vals {
 			if err := handler(k, v); err != nil {
 				return err
@@ -45,6 +82,202 @@ func (w metadataReaderWriter) ForeachKey(handler func(key, val string) error) er
 	return nil
 }
 
+// messageCounts counts the messages sent and received on a stream and, if
+// sizes is set, the bytes of those that are protocol buffers. Its counters are
+// accessed atomically.
+type messageCounts struct {
+	sent          uint64
+	received      uint64
+	bytesSent     uint64
+	bytesReceived uint64
+
+	sizes bool
+}
+
+// countSent counts msg as sent.
+func (c *messageCounts) countSent(msg interface{}) {
+	atomic.AddUint64(&c.sent, 1)
+	if c.sizes {
+		atomic.AddUint64(&c.bytesSent, messageSize(msg))
+	}
+}
+
+// countReceived counts msg as received.
+func (c *messageCounts) countReceived(msg interface{}) {
+	atomic.AddUint64(&c.received, 1)
+	if c.sizes {
+		atomic.AddUint64(&c.bytesReceived, messageSize(msg))
+	}
+}
+
+// setTags tags the span of the stream with the message counts and, if sizes
+// is set, byte totals.
+func (c *messageCounts) setTags(span opentracing.Span) {
+	span.SetTag("grpc.stream.messages_sent", atomic.LoadUint64(&c.sent))
+	span.SetTag("grpc.stream.messages_received", atomic.LoadUint64(&c.received))
+	if c.sizes {
+		span.SetTag("grpc.stream.bytes_sent", atomic.LoadUint64(&c.bytesSent))
+		span.SetTag("grpc.stream.bytes_received", atomic.LoadUint64(&c.bytesReceived))
+	}
+}
+
+// messageSize returns the serialized size of msg if it is a protocol buffer,
+// and 0 otherwise.
+func messageSize(msg interface{}) uint64 {
+	if pb, ok := msg.(proto.Message); ok {
+		return uint64(proto.Size(pb))
+	}
+	return 0
+}
+
+// startMessageSpan starts a child Span of streamSpan covering a single message
+// sent or received on a stream.
+func startMessageSpan(
+	otgrpcOpts *options,
+	tracer opentracing.Tracer,
+	streamSpan opentracing.Span,
+	method string,
+	direction string,
+	seq uint64) opentracing.Span {
+	msgSpan := otgrpcOpts.startSpan(
+		streamSpan.Context(),
+		tracer,
+		method+"/"+direction,
+		opentracing.ChildOf(streamSpan.Context()),
+		otgrpcOpts.componentTag(),
+	)
+	otgrpcOpts.setStaticTags(msgSpan)
+	msgSpan.SetTag("grpc.message.direction", direction)
+	msgSpan.SetTag("grpc.message.seq", seq)
+	return msgSpan
+}
+
+// finishMessageSpan finishes a Span started by startMessageSpan, tagging err
+// on it unless it merely signals the end of the stream.
+func finishMessageSpan(msgSpan opentracing.Span, err error, client bool) {
+	if err != nil && err != io.EOF {
+		SetSpanTags(msgSpan, err, client)
+		msgSpan.LogFields(log.String("event", "error"), log.String("message", err.Error()))
+	}
+	msgSpan.Finish()
+}
+
+// logPayload logs payload on span, along with fields, after passing it through
+// the configured redactor and truncating it according to
+// otgrpcOpts.maxPayloadLogSize.
+func logPayload(span opentracing.Span, method string, direction PayloadDirection, payload interface{}, otgrpcOpts *options, fields ...log.Field) {
+	key := "gRPC request"
+	if direction == ResponsePayload {
+		key = "gRPC response"
+	}
+	if otgrpcOpts.payloadRedactor != nil {
+		if payload = otgrpcOpts.payloadRedactor(method, payload, direction); payload == nil {
+			return
+		}
+	}
+	maxSize := otgrpcOpts.maxPayloadLogSize
+	if maxSize <= 0 {
+		span.LogFields(append(fields, log.Object(key, payload))...)
+		return
+	}
+	s := fmt.Sprintf("%v", payload)
+	if len(s) <= maxSize {
+		span.LogFields(append(fields, log.String(key, s))...)
+		return
+	}
+	span.LogFields(append(fields,
+		log.String(key, truncatePayload(s, maxSize)),
+		log.Int(key+" size", len(s)),
+	)...)
+}
+
+// streamPayloadLogger logs the messages of a stream on the stream span for
+// LogPayloads, up to otgrpcOpts.maxStreamPayloadLogs of them. A nil
+// *streamPayloadLogger logs nothing.
+type streamPayloadLogger struct {
+	// The counters are accessed atomically and kept first for 64-bit
+	// alignment.
+	logged   uint64
+	sent     uint64
+	received uint64
+
+	span       opentracing.Span
+	method     string
+	otgrpcOpts *options
+	client     bool
+}
+
+// newStreamPayloadLogger returns a streamPayloadLogger for the stream of
+// span, or nil if payloads are not logged.
+func newStreamPayloadLogger(span opentracing.Span, method string, otgrpcOpts *options, client bool) *streamPayloadLogger {
+	if !otgrpcOpts.logRequests && !otgrpcOpts.logResponses {
+		return nil
+	}
+	return &streamPayloadLogger{
+		span:       span,
+		method:     method,
+		otgrpcOpts: otgrpcOpts,
+		client:     client,
+	}
+}
+
+// log logs msg, which was sent on the stream if send is true and received
+// otherwise, along with its direction and per-direction sequence number.
+func (l *streamPayloadLogger) log(msg interface{}, send bool) {
+	if l == nil {
+		return
+	}
+	// Clients send requests, servers send responses.
+	payloadDirection := ResponsePayload
+	if send == l.client {
+		payloadDirection = RequestPayload
+	}
+	if payloadDirection == RequestPayload && !l.otgrpcOpts.logRequests ||
+		payloadDirection == ResponsePayload && !l.otgrpcOpts.logResponses {
+		return
+	}
+	max := l.otgrpcOpts.maxStreamPayloadLogs
+	if n := atomic.AddUint64(&l.logged, 1); max > 0 && n > uint64(max) {
+		if n == uint64(max)+1 {
+			l.span.LogFields(log.String("event", "payload logging capped"), log.Int("limit", max))
+		}
+		return
+	}
+	direction, seq := "recv", &l.received
+	if send {
+		direction, seq = "send", &l.sent
+	}
+	logPayload(l.span, l.method, payloadDirection, msg, l.otgrpcOpts,
+		log.String("grpc.message.direction", direction),
+		log.Uint64("grpc.message.seq", atomic.AddUint64(seq, 1)),
+	)
+}
+
+// truncatePayload truncates s so that, marker included, it is at most
+// maxSize bytes long.
+func truncatePayload(s string, maxSize int) string {
+	marker := fmt.Sprintf("...(truncated, original %d bytes)", len(s))
+	if len(marker) >= maxSize {
+		return marker[:maxSize]
+	}
+	n := maxSize - len(marker)
+	// Avoid cutting a multi-byte character in half.
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + marker
+}
+
+// isNoopTracer reports whether tracer is nil or an opentracing.NoopTracer, in
+// which case the interceptors pass calls through without doing any work.
+func isNoopTracer(tracer opentracing.Tracer) bool {
+	switch tracer.(type) {
+	case nil, opentracing.NoopTracer, *opentracing.NoopTracer:
+		return true
+	}
+	return false
+}
+
 func defaultStartSpan(
 	spanContext opentracing.SpanContext,
 	tracer opentracing.Tracer,
@@ -52,3 +285,56 @@ func defaultStartSpan(
 	opts ...opentracing.StartSpanOption) opentracing.Span {
 	return tracer.StartSpan(operationName, opts...)
 }
+
+// setServiceMethodTags tags span with the service and the method of
+// fullMethod, e.g. "pkg.Service" and "Method" for "/pkg.Service/Method".
+// Malformed method names are left untagged.
+func setServiceMethodTags(span opentracing.Span, fullMethod string) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return
+	}
+	span.SetTag("grpc.service", name[:i])
+	span.SetTag("grpc.method", name[i+1:])
+}
+
+// setMetadataTags tags span with the values of the headers named keys, as
+// found in the first of mds carrying them. keys must be in lower case; the
+// header names of mds may be in any case.
+func setMetadataTags(span opentracing.Span, keys []string, mds ...metadata.MD) {
+	for _, key := range keys {
+		for _, md := range mds {
+			if vals := metadataValues(md, key); len(vals) > 0 {
+				span.SetTag("grpc.metadata."+key, strings.Join(vals, ","))
+				break
+			}
+		}
+	}
+}
+
+// metadataValues returns the values of the header named key in md, matching
+// its name case-insensitively. The values of headers whose names only differ
+// in case are concatenated in the order of their names.
+func metadataValues(md metadata.MD, key string) []string {
+	var names []string
+	for name := range md {
+		if strings.EqualFold(name, key) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var vals []string
+	for _, name := range names {
+		vals = append(vals, md[name]...)
+	}
+	return vals
+}
+
+// setMessageSizeTag tags span under key with the serialized size of msg, if
+// msg is a protocol buffer.
+func setMessageSizeTag(span opentracing.Span, key string, msg interface{}) {
+	if pb, ok := msg.(proto.Message); ok {
+		span.SetTag(key, proto.Size(pb))
+	}
+}
@@ -0,0 +1,1065 @@
+package otgrpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// logFields flattens the log records of span into a key/value map.
+func logFields(span *mocktracer.MockSpan) map[string]string {
+	fields := map[string]string{}
+	for _, record := range span.Logs() {
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+	}
+	return fields
+}
+
+func TestMaxPayloadLogSize(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, size := range []int{1, 10, 40, 100} {
+		tracer.Reset()
+		interceptor := OpenTracingServerInterceptor(tracer, LogPayloads(), MaxPayloadLogSize(size))
+		req := strings.Repeat("x", 64)
+		_, err := interceptor(context.Background(), req, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+
+		fields := logFields(tracer.FinishedSpans()[0])
+		for _, key := range []string{"gRPC request", "gRPC response"} {
+			assert.True(t, len(fields[key]) <= size, "size %d: %q", size, fields[key])
+			if size < len(req) {
+				assert.Equal(t, "64", fields[key+" size"])
+			} else {
+				assert.Equal(t, req, fields[key])
+			}
+		}
+	}
+
+	tracer.Reset()
+	interceptor := OpenTracingServerInterceptor(tracer, LogPayloads(), WithMaxPayloadLogSize(40))
+	_, err := interceptor(context.Background(), strings.Repeat("x", 64), unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, "64", logFields(tracer.FinishedSpans()[0])["gRPC request size"])
+}
+
+func TestTruncatePayload(t *testing.T) {
+	assert.Equal(t, "xxxx...(truncated, original 40 bytes)", truncatePayload(strings.Repeat("x", 40), 37))
+	// Multi-byte characters must not be split.
+	assert.Equal(t, "...(truncated, original 20 bytes)", truncatePayload(strings.Repeat("é", 10), 34))
+}
+
+func TestPayloadRedactor(t *testing.T) {
+	tracer := mocktracer.New()
+	type redactorCall struct {
+		method    string
+		msg       interface{}
+		direction PayloadDirection
+	}
+	var calls []redactorCall
+	redactor := WithPayloadRedactor(func(fullMethod string, msg interface{}, direction PayloadDirection) interface{} {
+		calls = append(calls, redactorCall{fullMethod, msg, direction})
+		return "redacted"
+	})
+
+	interceptor := OpenTracingServerInterceptor(tracer, LogPayloads(), redactor)
+	resp, err := interceptor(context.Background(), "secret", unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", resp)
+
+	fields := logFields(tracer.FinishedSpans()[0])
+	assert.Equal(t, "redacted", fields["gRPC request"])
+	assert.Equal(t, "redacted", fields["gRPC response"])
+	assert.Equal(t, []redactorCall{
+		{"/pkg.Service/Method", "secret", RequestPayload},
+		{"/pkg.Service/Method", "secret", ResponsePayload},
+	}, calls)
+}
+
+func TestServiceMethodTags(t *testing.T) {
+	tracer := mocktracer.New()
+	optFuncs := []Option{
+		TagServiceMethod(),
+		WithOperationNameFunc(func(fullMethod string) string { return "rpc" }),
+	}
+	_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	cs.(*openTracingClientStream).finishFunc(nil)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "rpc", span.OperationName)
+		assert.Equal(t, "pkg.Service", span.Tag("grpc.service"))
+		assert.Equal(t, "Method", span.Tag("grpc.method"))
+	}
+
+	tracer.Reset()
+	err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), "malformed", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	assert.Nil(t, tracer.FinishedSpans()[0].Tag("grpc.service"))
+	assert.Nil(t, tracer.FinishedSpans()[0].Tag("grpc.method"))
+}
+
+func TestStreamMessageCountsBidi(t *testing.T) {
+	const messages = 50
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	// The server sends its messages while it receives those of the client.
+	srv := grpc.NewServer(
+		grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer)),
+		grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+			errc := make(chan error, 1)
+			go func() {
+				for i := 0; i < messages; i++ {
+					if err := ss.SendMsg(&emptypb.Empty{}); err != nil {
+						errc <- err
+						return
+					}
+				}
+				errc <- nil
+			}()
+			for ss.RecvMsg(&emptypb.Empty{}) == nil {
+			}
+			return <-errc
+		}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithStreamInterceptor(OpenTracingStreamClientInterceptor(tracer)))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	cs, err := cc.NewStream(context.Background(), desc, "/pkg.Service/Method")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < messages; i++ {
+			cs.SendMsg(&emptypb.Empty{})
+		}
+		cs.CloseSend()
+		close(sent)
+	}()
+	for i := 0; i < messages; i++ {
+		assert.NoError(t, cs.RecvMsg(&emptypb.Empty{}))
+	}
+	// The client span is finished by the final io.EOF, which must come after
+	// all sends are counted.
+	<-sent
+	assert.Equal(t, io.EOF, cs.RecvMsg(&emptypb.Empty{}))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, uint64(messages), span.Tag("grpc.stream.messages_sent"))
+		assert.Equal(t, uint64(messages), span.Tag("grpc.stream.messages_received"))
+	}
+}
+
+func TestSpanDecoratorRename(t *testing.T) {
+	tracer := mocktracer.New()
+	rename := SpanDecorator(func(ctx context.Context, span opentracing.Span, method string, req, resp interface{}, grpcError error) {
+		span.SetOperationName(fmt.Sprintf("%s %v", method, status.Code(grpcError)))
+	})
+	notFound := status.Error(codes.NotFound, "")
+
+	_, err := OpenTracingServerInterceptor(tracer, rename)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, rename)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			return notFound
+		})
+	assert.Equal(t, notFound, err)
+	err = OpenTracingClientInterceptor(tracer, rename)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, rename)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	cs.(*openTracingClientStream).finishFunc(notFound)
+
+	// The spans are reported under their new names.
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, expected := range []string{
+		"/pkg.Service/Method OK",
+		"/pkg.Service/Method NotFound",
+		"/pkg.Service/Method OK",
+		"/pkg.Service/Method NotFound",
+	} {
+		assert.Equal(t, expected, spans[i].OperationName)
+	}
+}
+
+func TestStreamPayloadLogging(t *testing.T) {
+	tracer := mocktracer.New()
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for i := 0; i < 3; i++ {
+			if err := ss.SendMsg(fmt.Sprintf("msg-%d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	interceptor := OpenTracingStreamServerInterceptor(tracer, LogPayloads(), MaxStreamPayloadLogs(2))
+	err := interceptor(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, handler)
+	assert.NoError(t, err)
+
+	cs, err := OpenTracingStreamClientInterceptor(tracer, LogPayloads())(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg("req"))
+	assert.NoError(t, cs.RecvMsg("resp"))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	// Messages beyond the cap are not logged.
+	serverLogs := spans[0].Logs()
+	if len(serverLogs) != 3 {
+		t.Fatalf("Incorrect log length")
+	}
+	for i, expected := range []string{"msg-0", "msg-1"} {
+		fields := map[string]string{}
+		for _, field := range serverLogs[i].Fields {
+			fields[field.Key] = field.ValueString
+		}
+		assert.Equal(t, map[string]string{
+			"grpc.message.direction": "send",
+			"grpc.message.seq":       fmt.Sprint(i + 1),
+			"gRPC response":          expected,
+		}, fields)
+	}
+	assert.Equal(t, "payload logging capped", serverLogs[2].Fields[0].ValueString)
+
+	clientFields := logFields(spans[1])
+	assert.Equal(t, "req", clientFields["gRPC request"])
+	assert.Equal(t, "resp", clientFields["gRPC response"])
+}
+
+func TestPayloadSanitizer(t *testing.T) {
+	tracer := mocktracer.New()
+	sanitizer := WithPayloadSanitizer(func(method string, msg interface{}) interface{} {
+		if msg == "secret" {
+			return nil
+		}
+		return strings.ToUpper(msg.(string))
+	})
+
+	_, err := OpenTracingServerInterceptor(tracer, LogPayloads(), sanitizer)(context.Background(), "hello", unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	_, err = OpenTracingServerInterceptor(tracer, LogPayloads(), sanitizer)(context.Background(), "secret", unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, LogPayloads(), sanitizer)(context.Background(), "/pkg.Service/Method", "hello", "world", nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, LogPayloads(), sanitizer)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg("hello"))
+	assert.NoError(t, cs.RecvMsg("secret"))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, map[string]string{"gRPC request": "HELLO", "gRPC response": "HELLO"}, logFields(spans[0]))
+	// Payloads sanitized to nil are not logged at all.
+	assert.Empty(t, spans[1].Logs())
+	assert.Equal(t, map[string]string{"gRPC request": "HELLO", "gRPC response": "WORLD"}, logFields(spans[2]))
+	assert.Equal(t, 1, len(spans[3].Logs()))
+	assert.Equal(t, "HELLO", logFields(spans[3])["gRPC request"])
+}
+
+func TestLogPayloadsOnError(t *testing.T) {
+	tracer := mocktracer.New()
+	notFound := status.Error(codes.NotFound, "")
+	internal := status.Error(codes.Internal, "")
+	ignoreNotFound := WithErrorClassifier(func(err error) (bool, string) {
+		return status.Code(err) != codes.NotFound, ""
+	})
+	for _, tc := range []struct {
+		optFuncs []Option
+		err      error
+		expected map[string]string
+	}{
+		{[]Option{LogPayloadsOnError()}, nil, map[string]string{}},
+		{[]Option{LogPayloadsOnError()}, internal, map[string]string{"gRPC request": "req", "gRPC response": "resp"}},
+		{[]Option{LogPayloadsOnError(), ignoreNotFound}, notFound, map[string]string{}},
+		{[]Option{WithPayloadLogOnErrorOnly(), ignoreNotFound}, internal, map[string]string{"gRPC request": "req", "gRPC response": "resp"}},
+		{[]Option{LogPayloadsOnError(), WithNonErrorCodes(codes.NotFound)}, notFound, map[string]string{}},
+		{[]Option{LogPayloadsOnError(), WithNonErrorCodes(codes.NotFound)}, internal, map[string]string{"gRPC request": "req", "gRPC response": "resp"}},
+		{[]Option{LogPayloadsOnError(), WithNonErrorCodes(codes.Internal), ignoreNotFound}, internal, map[string]string{}},
+		// LogPayloads wins.
+		{[]Option{LogPayloadsOnError(), LogPayloads()}, nil, map[string]string{"gRPC request": "req", "gRPC response": "resp"}},
+		{[]Option{LogPayloadsOnError(), LogPayloads()}, internal, map[string]string{"gRPC request": "req"}},
+	} {
+		tracer.Reset()
+		_, err := OpenTracingServerInterceptor(tracer, tc.optFuncs...)(context.Background(), "req", unaryInfo,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "resp", tc.err
+			})
+		assert.Equal(t, tc.err, err)
+		err = OpenTracingClientInterceptor(tracer, tc.optFuncs...)(context.Background(), "/pkg.Service/Method", "req", "resp", nil,
+			func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return tc.err
+			})
+		assert.Equal(t, tc.err, err)
+
+		for _, span := range tracer.FinishedSpans() {
+			assert.Equal(t, tc.expected, logFields(span), "%v", tc.err)
+		}
+	}
+}
+
+func TestLogRequestResponsePayloads(t *testing.T) {
+	tracer := mocktracer.New()
+	for _, tc := range []struct {
+		option   Option
+		expected map[string]string
+	}{
+		{LogRequestPayloads(), map[string]string{"gRPC request": "req"}},
+		{LogResponsePayloads(), map[string]string{"gRPC response": "resp"}},
+		{LogPayloads(), map[string]string{"gRPC request": "req", "gRPC response": "resp"}},
+	} {
+		tracer.Reset()
+		_, err := OpenTracingServerInterceptor(tracer, tc.option)(context.Background(), "req", unaryInfo,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "resp", nil
+			})
+		assert.NoError(t, err)
+		err = OpenTracingClientInterceptor(tracer, tc.option)(context.Background(), "/pkg.Service/Method", "req", "resp", nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := OpenTracingStreamClientInterceptor(tracer, tc.option)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.SendMsg("req"))
+		assert.NoError(t, cs.RecvMsg("resp"))
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 3 {
+			t.Fatalf("Incorrect span length")
+		}
+		for _, span := range spans {
+			fields := logFields(span)
+			delete(fields, "grpc.message.direction")
+			delete(fields, "grpc.message.seq")
+			assert.Equal(t, tc.expected, fields)
+		}
+	}
+}
+
+func TestMessageSizeTags(t *testing.T) {
+	tracer := mocktracer.New()
+	req := wrapperspb.String("hello")
+	resp := wrapperspb.String("hello, world")
+	_, err := OpenTracingServerInterceptor(tracer, WithMessageSizeTags())(context.Background(), req, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return resp, nil
+		})
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, WithMessageSizeTags())(context.Background(), "/pkg.Service/Method", req, resp, nil, fakeInvoker)
+	assert.NoError(t, err)
+	// Messages that are not protocol buffers are skipped.
+	plain := struct{ Name string }{"hello"}
+	_, err = OpenTracingServerInterceptor(tracer, WithMessageSizeTags())(context.Background(), plain, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	// So are responses of failed RPCs.
+	_, err = OpenTracingServerInterceptor(tracer, WithMessageSizeTags())(context.Background(), req, unaryInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return resp, status.Error(codes.Internal, "")
+		})
+	assert.Error(t, err)
+	// Sizes are only computed with WithMessageSizeTags.
+	err = OpenTracingClientInterceptor(tracer)(context.Background(), "/pkg.Service/Method", req, resp, nil, fakeInvoker)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans[:2] {
+		assert.Equal(t, proto.Size(req), span.Tag("grpc.request.size"))
+		assert.Equal(t, proto.Size(resp), span.Tag("grpc.response.size"))
+	}
+	assert.Nil(t, spans[2].Tag("grpc.request.size"))
+	assert.Nil(t, spans[2].Tag("grpc.response.size"))
+	assert.Equal(t, proto.Size(req), spans[3].Tag("grpc.request.size"))
+	assert.Nil(t, spans[3].Tag("grpc.response.size"))
+	assert.Nil(t, spans[4].Tag("grpc.request.size"))
+	assert.Nil(t, spans[4].Tag("grpc.response.size"))
+}
+
+func TestMultipleDecoratorsAndInclusionFuncs(t *testing.T) {
+	tracer := mocktracer.New()
+	var calls []string
+	decorator := func(name string) Option {
+		return SpanDecorator(func(ctx context.Context, span opentracing.Span, method string, req, resp interface{}, grpcError error) {
+			calls = append(calls, name)
+			span.SetTag(name, true)
+		})
+	}
+	inclusion := func(name, excluded string) Option {
+		return IncludingSpans(func(parentSpanCtx opentracing.SpanContext, method string, req, resp interface{}) bool {
+			calls = append(calls, name)
+			return method != excluded
+		})
+	}
+	optFuncs := []Option{
+		decorator("first"), decorator("second"),
+		inclusion("include1", "/pkg.Service/Excluded1"), inclusion("include2", "/pkg.Service/Excluded2"),
+	}
+	run := func(method string) {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil, info, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()},
+			&grpc.StreamServerInfo{FullMethod: method}, echoStreamHandler)
+		assert.NoError(t, err)
+		err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), method, nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(context.Background(), &grpc.StreamDesc{}, nil, method, fakeStreamer)
+		assert.NoError(t, err)
+		if otcs, ok := cs.(*openTracingClientStream); ok {
+			otcs.finishFunc(nil)
+		}
+	}
+
+	run("/pkg.Service/Method")
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, true, span.Tag("first"))
+		assert.Equal(t, true, span.Tag("second"))
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []string{"include1", "include2", "first", "second"}, calls[4*i:4*i+4])
+	}
+
+	// Every inclusion func must include the call, and evaluation stops at
+	// the first one that does not.
+	for _, tc := range []struct {
+		method        string
+		expectedCalls []string
+	}{
+		{"/pkg.Service/Excluded1", []string{"include1"}},
+		{"/pkg.Service/Excluded2", []string{"include1", "include2"}},
+	} {
+		tracer.Reset()
+		calls = nil
+		run(tc.method)
+		assert.Empty(t, tracer.FinishedSpans())
+		for i := 0; i < 4; i++ {
+			n := len(tc.expectedCalls)
+			assert.Equal(t, tc.expectedCalls, calls[n*i:n*i+n])
+		}
+	}
+}
+
+func TestMethodOverrides(t *testing.T) {
+	tracer := mocktracer.New()
+	tagger := func(key string) Option {
+		return SpanDecorator(func(ctx context.Context, span opentracing.Span, method string, req, resp interface{}, grpcError error) {
+			span.SetTag(key, true)
+		})
+	}
+	optFuncs := []Option{
+		// Overrides take precedence over the Options that follow them.
+		WithMethodOverrides(map[string][]Option{
+			"/pkg.Service/Debug": {LogPayloads(), tagger("debug")},
+			"/pkg.Service/Other": {tagger("other"), WithOperationNameFunc(func(fullMethod string) string {
+				return "other"
+			})},
+		}),
+		tagger("global1"), tagger("global2"), tagger("global3"),
+		WithOperationNameFunc(func(fullMethod string) string {
+			return "global"
+		}),
+	}
+	unary := OpenTracingServerInterceptor(tracer, optFuncs...)
+	stream := OpenTracingStreamServerInterceptor(tracer, optFuncs...)
+	client := OpenTracingClientInterceptor(tracer, optFuncs...)
+	for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Debug", "/pkg.Service/Other"} {
+		_, err := unary(context.Background(), "req", &grpc.UnaryServerInfo{FullMethod: method}, echoHandler)
+		assert.NoError(t, err)
+		err = stream(nil, &fakeServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: method}, echoStreamHandler)
+		assert.NoError(t, err)
+		err = client(context.Background(), method, "req", "resp", nil, fakeInvoker)
+		assert.NoError(t, err)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 9 {
+		t.Fatalf("Incorrect span length")
+	}
+	for i, span := range spans {
+		for _, key := range []string{"global1", "global2", "global3"} {
+			assert.Equal(t, true, span.Tag(key))
+		}
+		switch i / 3 {
+		case 0:
+			assert.Equal(t, "global", span.OperationName)
+			assert.Nil(t, span.Tag("debug"))
+			assert.Nil(t, span.Tag("other"))
+			assert.Empty(t, span.Logs())
+		case 1:
+			assert.Equal(t, "global", span.OperationName)
+			assert.Equal(t, true, span.Tag("debug"))
+			assert.Nil(t, span.Tag("other"))
+			if i%3 != 1 {
+				// The fake server stream carries no message.
+				assert.Equal(t, "req", logFields(span)["gRPC request"])
+			}
+		case 2:
+			assert.Equal(t, "other", span.OperationName)
+			assert.Nil(t, span.Tag("debug"))
+			assert.Equal(t, true, span.Tag("other"))
+			assert.Empty(t, span.Logs())
+		}
+	}
+}
+
+func TestTagFromRequest(t *testing.T) {
+	tracer := mocktracer.New()
+	userID := func(req interface{}) map[string]interface{} {
+		return map[string]interface{}{"user.id": req.(*wrapperspb.StringValue).GetValue()}
+	}
+	optFuncs := []Option{
+		WithTagFromRequest("/pkg.Users/GetUser", userID),
+		WithTagFromRequest("/pkg.Users/GetUser", func(req interface{}) map[string]interface{} {
+			return map[string]interface{}{"user.known": true}
+		}),
+	}
+	req := wrapperspb.String("42")
+	for _, method := range []string{"/pkg.Users/GetUser", "/pkg.Users/ListUsers"} {
+		_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), req,
+			&grpc.UnaryServerInfo{FullMethod: method}, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), method, req, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans[:2] {
+		assert.Equal(t, "42", span.Tag("user.id"))
+		assert.Equal(t, true, span.Tag("user.known"))
+	}
+	for _, span := range spans[2:] {
+		assert.Nil(t, span.Tag("user.id"))
+		assert.Nil(t, span.Tag("user.known"))
+	}
+}
+
+func TestSpanTagsFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	shardKey := WithSpanTagsFunc(func(ctx context.Context, method string, req interface{}) opentracing.Tags {
+		if req == nil {
+			md, _ := FromContext(ctx)
+			return opentracing.Tags{"shard": strings.Join(md["x-shard"], ",")}
+		}
+		return opentracing.Tags{"shard": req.(*wrapperspb.StringValue).GetValue()}
+	})
+	req := wrapperspb.String("7")
+	_, err := OpenTracingServerInterceptor(tracer, shardKey)(context.Background(), req, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, shardKey)(context.Background(), "/pkg.Service/Method", req, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	ctx := NewContext(context.Background(), New(map[string]string{"x-shard": "8"}))
+	err = OpenTracingStreamServerInterceptor(tracer, shardKey)(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+
+	// Nil maps and panics are fine.
+	var tracingErrs []error
+	handler := WithTracingErrorHandler(func(err error, method string) {
+		tracingErrs = append(tracingErrs, err)
+	})
+	nilTags := WithSpanTagsFunc(func(ctx context.Context, method string, req interface{}) opentracing.Tags {
+		return nil
+	})
+	panicking := WithSpanTagsFunc(func(ctx context.Context, method string, req interface{}) opentracing.Tags {
+		panic("boom")
+	})
+	_, err = OpenTracingServerInterceptor(tracer, nilTags, handler)(context.Background(), req, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	_, err = OpenTracingServerInterceptor(tracer, panicking, handler)(context.Background(), req, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, panicking, handler)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return &eofClientStream{fakeClientStream{ctx: ctx}}, nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 6 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, "7", spans[0].Tag("shard"))
+	assert.Equal(t, "7", spans[1].Tag("shard"))
+	assert.Equal(t, "8", spans[2].Tag("shard"))
+	for _, span := range spans[3:] {
+		assert.Nil(t, span.Tag("shard"))
+	}
+	if assert.Len(t, tracingErrs, 2) {
+		assert.Contains(t, tracingErrs[0].Error(), "boom")
+	}
+}
+
+func TestMetadataTags(t *testing.T) {
+	tracer := mocktracer.New()
+	tags := WithMetadataTags("X-Request-Id", "x-b2b-partner", "user-agent", "x-trace-bin")
+	md := metadata.MD{
+		"x-request-id":  {"req-1"},
+		"X-B2B-Partner": {"acme", "globex"},
+		"x-trace-bin":   {"\x00"},
+	}
+
+	// Server spans read the incoming metadata.
+	incoming := metadata.NewIncomingContext(context.Background(), md)
+	_, err := OpenTracingServerInterceptor(tracer, tags)(incoming, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, tags)(nil, &fakeServerStream{ctx: incoming}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	// Client spans read the outgoing metadata.
+	outgoing := metadata.NewOutgoingContext(context.Background(), md)
+	err = OpenTracingClientInterceptor(tracer, tags)(outgoing, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, tags)(outgoing, &grpc.StreamDesc{}, nil, "/pkg.Service/Method",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return &eofClientStream{fakeClientStream{ctx: ctx}}, nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "req-1", span.Tag("grpc.metadata.x-request-id"))
+		assert.Equal(t, "acme,globex", span.Tag("grpc.metadata.x-b2b-partner"))
+		assert.Nil(t, span.Tag("grpc.metadata.user-agent"), "missing key")
+		assert.Nil(t, span.Tag("grpc.metadata.x-trace-bin"), "binary key")
+	}
+
+	// Headers differing only in case are joined in a deterministic order.
+	tracer.Reset()
+	ctx := NewContext(context.Background(), metadata.MD{
+		"x-b2b-partner": {"initech"},
+		"X-B2B-Partner": {"acme"},
+	})
+	_, err = OpenTracingServerInterceptor(tracer, tags)(ctx, nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme,initech", tracer.FinishedSpans()[0].Tag("grpc.metadata.x-b2b-partner"))
+}
+
+// errClientStream is a fakeClientStream whose server ends the stream with err.
+type errClientStream struct {
+	fakeClientStream
+	err error
+}
+
+func (cs *errClientStream) RecvMsg(m interface{}) error {
+	if cs.err == nil {
+		return io.EOF
+	}
+	return cs.err
+}
+
+func TestMetricsObserver(t *testing.T) {
+	type observation struct {
+		method   string
+		code     codes.Code
+		isStream bool
+	}
+	var observed []observation
+	observer := WithMetricsObserver(func(method string, code codes.Code, duration time.Duration, isStream bool) {
+		assert.True(t, duration > 0)
+		observed = append(observed, observation{method, code, isStream})
+		panic("must not break the RPC")
+	})
+	exclude := IncludingSpans(func(parentSpanCtx opentracing.SpanContext, method string, req, resp interface{}) bool {
+		return method != "/pkg.Service/Excluded"
+	})
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tc := range []struct {
+		err      error
+		expected codes.Code
+	}{
+		{nil, codes.OK},
+		{status.Error(codes.NotFound, ""), codes.NotFound},
+		{canceled.Err(), codes.Canceled},
+	} {
+		tracer := mocktracer.New()
+		observed = nil
+		optFuncs := []Option{observer, exclude, ObserveExcludedRPCs()}
+		for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Excluded"} {
+			_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil,
+				&grpc.UnaryServerInfo{FullMethod: method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()},
+				&grpc.StreamServerInfo{FullMethod: method},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					return tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), method, nil, nil, nil,
+				func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					return tc.err
+				})
+			assert.Equal(t, tc.err, err)
+			// The stream ends when the client receives its status.
+			cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(context.Background(), &grpc.StreamDesc{ServerStreams: true}, nil, method,
+				func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+					return &errClientStream{fakeClientStream{ctx: ctx}, tc.err}, nil
+				})
+			assert.NoError(t, err)
+			n := len(observed)
+			assert.NoError(t, cs.SendMsg(nil))
+			assert.Len(t, observed, n)
+			expectedErr := tc.err
+			if expectedErr == nil {
+				expectedErr = io.EOF
+			}
+			assert.Equal(t, expectedErr, cs.RecvMsg(nil))
+			assert.Len(t, observed, n+1)
+		}
+
+		var expected []observation
+		for _, method := range []string{"/pkg.Service/Method", "/pkg.Service/Excluded"} {
+			expected = append(expected,
+				observation{method, tc.expected, false},
+				observation{method, tc.expected, true},
+				observation{method, tc.expected, false},
+				observation{method, tc.expected, true},
+			)
+		}
+		assert.Equal(t, expected, observed)
+		assert.Len(t, tracer.FinishedSpans(), 4)
+	}
+
+	// Excluded RPCs are only observed on demand.
+	observed = nil
+	_, err := OpenTracingServerInterceptor(mocktracer.New(), observer, exclude)(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Excluded"}, echoHandler)
+	assert.NoError(t, err)
+	assert.Empty(t, observed)
+
+	// The observer runs with a NoopTracer too.
+	_, err = OpenTracingServerInterceptor(opentracing.NoopTracer{}, observer)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Len(t, observed, 1)
+}
+
+func TestStreamByteTotals(t *testing.T) {
+	tracer := mocktracer.New()
+	lis := bufconn.Listen(1 << 20)
+	// The server answers every message with one twice as long, sending while
+	// it receives.
+	srv := grpc.NewServer(
+		grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer, WithMessageSizeTags())),
+		grpc.UnknownServiceHandler(func(srv interface{}, ss grpc.ServerStream) error {
+			replies := make(chan string, 16)
+			errc := make(chan error, 1)
+			go func() {
+				for s := range replies {
+					if err := ss.SendMsg(wrapperspb.String(s + s)); err != nil {
+						errc <- err
+						return
+					}
+				}
+				errc <- nil
+			}()
+			for {
+				msg := &wrapperspb.StringValue{}
+				if ss.RecvMsg(msg) != nil {
+					break
+				}
+				replies <- msg.Value
+			}
+			close(replies)
+			return <-errc
+		}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithStreamInterceptor(OpenTracingStreamClientInterceptor(tracer, WithMessageSizeTags())))
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	cs, err := cc.NewStream(context.Background(), desc, "/pkg.Service/Method")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	var requestBytes, replyBytes uint64
+	for i := 1; i <= 20; i++ {
+		s := strings.Repeat("x", i*10)
+		requestBytes += uint64(proto.Size(wrapperspb.String(s)))
+		replyBytes += uint64(proto.Size(wrapperspb.String(s + s)))
+		assert.NoError(t, cs.SendMsg(wrapperspb.String(s)))
+	}
+	assert.NoError(t, cs.CloseSend())
+	for {
+		if err := cs.RecvMsg(&wrapperspb.StringValue{}); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	client, server := spans[0], spans[1]
+	assert.Equal(t, requestBytes, client.Tag("grpc.stream.bytes_sent"))
+	assert.Equal(t, replyBytes, client.Tag("grpc.stream.bytes_received"))
+	assert.Equal(t, replyBytes, server.Tag("grpc.stream.bytes_sent"))
+	assert.Equal(t, requestBytes, server.Tag("grpc.stream.bytes_received"))
+
+	// Totals are only computed with WithMessageSizeTags.
+	tracer.Reset()
+	err = OpenTracingStreamServerInterceptor(tracer)(nil, &fakeServerStream{ctx: context.Background(), messages: 1}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	assert.Nil(t, tracer.FinishedSpans()[0].Tag("grpc.stream.bytes_received"))
+}
+
+func TestComponentNameAndStaticTags(t *testing.T) {
+	tracer := mocktracer.New()
+	optFuncs := []Option{
+		WithComponentName("grpc-internal"),
+		WithStaticTags(opentracing.Tags{"deployment.environment": "test", "service.version": "1.0"}),
+		WithStaticTags(opentracing.Tags{"service.version": "1.1"}),
+		SpanDecorator(func(ctx context.Context, span opentracing.Span, method string, req, resp interface{}, grpcError error) {
+			span.SetTag("deployment.environment", "decorated")
+		}),
+	}
+
+	_, err := OpenTracingServerInterceptor(tracer, optFuncs...)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingStreamServerInterceptor(tracer, optFuncs...)(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, optFuncs...)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+	cs, err := OpenTracingStreamClientInterceptor(tracer, optFuncs...)(context.Background(), &grpc.StreamDesc{}, nil, "/pkg.Service/Method",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return &eofClientStream{fakeClientStream{ctx: ctx}}, nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+	// Without the Options.
+	_, err = OpenTracingServerInterceptor(tracer)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans[:4] {
+		assert.Equal(t, "grpc-internal", span.Tag("component"), span.OperationName)
+		assert.Equal(t, "1.1", span.Tag("service.version"))
+		// The decorator wins.
+		assert.Equal(t, "decorated", span.Tag("deployment.environment"))
+	}
+	assert.Equal(t, "gRPC", spans[4].Tag("component"))
+	assert.Nil(t, spans[4].Tag("service.version"))
+
+	// Message spans and attempt spans too.
+	tracer.Reset()
+	optFuncs = []Option{
+		WithComponentName("grpc-internal"),
+		WithStaticTags(opentracing.Tags{"service.version": "1.1"}),
+	}
+	err = OpenTracingStreamServerInterceptor(tracer, append(optFuncs, WithStreamMessageSpans())...)(nil,
+		&fakeServerStream{ctx: context.Background(), messages: 1}, streamInfo, echoStreamHandler)
+	assert.NoError(t, err)
+	cc := statsEchoConn(t, nil,
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, append(optFuncs, WithRetryAttemptSpans())...)),
+		grpc.WithStatsHandler(RetryAttemptStatsHandler()))
+	err = cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans = tracer.FinishedSpans()
+	// The stream span, 3 message spans, the attempt span and the call span.
+	if len(spans) != 6 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "grpc-internal", span.Tag("component"), span.OperationName)
+		assert.Equal(t, "1.1", span.Tag("service.version"), span.OperationName)
+	}
+}
+
+func TestSpanFactory(t *testing.T) {
+	tracer := mocktracer.New()
+	// factory returns an Option whose spans are tagged with name.
+	factory := func(name string) Option {
+		return WithSpanFactory(func(parent opentracing.SpanContext, tracer opentracing.Tracer, operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+			return tracer.StartSpan(operationName, append(opts, opentracing.Tag{Key: "factory", Value: name})...)
+		})
+	}
+	var globalCalls int
+	StartSpanFactory = func(parent opentracing.SpanContext, tracer opentracing.Tracer, operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+		globalCalls++
+		return defaultStartSpan(parent, tracer, operationName, opts...)
+	}
+	defer func() { StartSpanFactory = defaultStartSpan }()
+
+	for _, name := range []string{"first", "second"} {
+		tracer.Reset()
+		opt := factory(name)
+		_, err := OpenTracingServerInterceptor(tracer, opt)(context.Background(), nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, opt, WithStreamMessageSpans())(nil,
+			&fakeServerStream{ctx: context.Background(), messages: 1}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		err = OpenTracingClientInterceptor(tracer, opt)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := OpenTracingStreamClientInterceptor(tracer, opt, WithStreamMessageSpans())(context.Background(),
+			&grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.SendMsg(nil))
+		assert.NoError(t, cs.RecvMsg(nil))
+
+		spans := tracer.FinishedSpans()
+		// Message spans included.
+		if len(spans) != 9 {
+			t.Fatalf("Incorrect span length")
+		}
+		for _, span := range spans {
+			assert.Equal(t, name, span.Tag("factory"), span.OperationName)
+		}
+	}
+	assert.Zero(t, globalCalls)
+
+	// So are attempt spans.
+	tracer.Reset()
+	cc := statsEchoConn(t, nil,
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, factory("attempt"), WithRetryAttemptSpans())),
+		grpc.WithStatsHandler(RetryAttemptStatsHandler()))
+	err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	for _, span := range spans {
+		assert.Equal(t, "attempt", span.Tag("factory"), span.OperationName)
+	}
+	assert.Zero(t, globalCalls)
+
+	// The deprecated variable is still used without the Option, attempt
+	// spans included.
+	_, err = OpenTracingServerInterceptor(tracer)(context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, globalCalls)
+	cc = statsEchoConn(t, nil,
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, WithRetryAttemptSpans())),
+		grpc.WithStatsHandler(RetryAttemptStatsHandler()))
+	err = cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, globalCalls)
+}
+
+func TestStartSpanOptions(t *testing.T) {
+	tracer := mocktracer.New()
+	startTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	opt := WithStartSpanOptions(
+		opentracing.StartTime(startTime),
+		opentracing.Tag{Key: "sampling.tier", Value: "gold"},
+		opentracing.Tag{Key: "component", Value: "custom"},
+	)
+
+	// A span.kind given this way overrides the default one.
+	_, err := OpenTracingServerInterceptor(tracer, opt, WithStartSpanOptions(ext.SpanKindConsumer))(
+		context.Background(), nil, unaryInfo, echoHandler)
+	assert.NoError(t, err)
+	err = OpenTracingClientInterceptor(tracer, opt)(context.Background(), "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, ext.SpanKindConsumerEnum, spans[0].Tag(string(ext.SpanKind)))
+	assert.Equal(t, ext.SpanKindRPCClientEnum, spans[1].Tag(string(ext.SpanKind)))
+	for _, span := range spans {
+		assert.Equal(t, startTime, span.StartTime)
+		assert.Equal(t, "gold", span.Tag("sampling.tier"))
+		assert.Equal(t, "custom", span.Tag("component"))
+	}
+}
+
+func TestInjectLowercasesKeys(t *testing.T) {
+	tracer := mocktracer.New()
+	tracer.RegisterInjector(opentracing.HTTPHeaders, b3Propagator{})
+	tracer.RegisterExtractor(opentracing.HTTPHeaders, b3Propagator{})
+	parent := tracer.StartSpan("parent")
+
+	ctx, err := InjectSpanContext(context.Background(), tracer, parent.Context())
+	assert.NoError(t, err)
+	md, _ := FromContext(ctx)
+	assert.Equal(t, 2, len(md))
+	assert.Equal(t, []string{strconv.Itoa(parent.Context().(mocktracer.MockSpanContext).TraceID)}, md["x-b3-traceid"])
+	assert.Equal(t, []string{strconv.Itoa(parent.Context().(mocktracer.MockSpanContext).SpanID)}, md["x-b3-spanid"])
+
+	// The lowercase keys go over the wire and are extracted on the server.
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer))},
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer)))
+	err = cc.Invoke(opentracing.ContextWithSpan(context.Background(), parent),
+		"/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	client, server := spans[0], spans[1]
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, client.ParentID)
+	assert.Equal(t, client.SpanContext.SpanID, server.ParentID)
+}
@@ -0,0 +1,225 @@
+package otgrpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+type statsRPCKey struct{}
+
+// statsRPC is the state of an RPC traced by a tracing stats.Handler.
+type statsRPC struct {
+	// isStream is accessed atomically.
+	isStream uint32
+
+	span       opentracing.Span
+	method     string
+	otgrpcOpts *options
+	start      time.Time
+}
+
+// NewServerStatsHandler returns a grpc/stats.Handler that traces the RPCs of
+// a server, as an alternative to the OpenTracing server interceptors, for use
+// in a grpc.NewServer call:
+//
+//	s := grpc.NewServer(
+//	    ...,  // (existing ServerOptions)
+//	    grpc.StatsHandler(otgrpc.NewServerStatsHandler(tracer)))
+//
+// Unlike the interceptors, a stats.Handler sees the transport: the spans it
+// creates log the wire and uncompressed sizes of every message, and are
+// finished when gRPC is done with the RPC rather than when its handler
+// returns. It extracts the SpanContext of the client the way the server
+// interceptors do, so its spans join the traces of clients using either the
+// client interceptors or NewClientStatsHandler.
+//
+// The options that rely on the requests or the handlers of the RPCs, e.g.
+// WithPanicRecovery or WithServerInterceptor, have no effect; request and
+// response payloads are logged as they are received and sent, if enabled.
+func NewServerStatsHandler(tracer opentracing.Tracer, optFuncs ...Option) stats.Handler {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.apply(optFuncs...)
+	return &tracingStatsHandler{tracer: tracer, otgrpcOpts: otgrpcOpts}
+}
+
+// NewClientStatsHandler returns a grpc/stats.Handler that traces the RPCs of
+// a client, as an alternative to the OpenTracing client interceptors, for use
+// in a grpc.Dial call:
+//
+//	conn, err := grpc.Dial(
+//	    address,
+//	    ...,  // (existing DialOptions)
+//	    grpc.WithStatsHandler(otgrpc.NewClientStatsHandler(tracer)))
+//
+// gRPC calls the handler once per attempt at an RPC, so a client span is
+// created for every attempt, transparent retries included, and tagged with
+// "grpc.transparent_retry" for the latter. Spans log the wire and
+// uncompressed sizes of every message, and the SpanContext is injected as the
+// client interceptors do, for servers using either the server interceptors or
+// NewServerStatsHandler.
+//
+// grpc.CallOptions are not visible to stats handlers, so NoTrace and
+// WithSpanTags have no effect.
+func NewClientStatsHandler(tracer opentracing.Tracer, optFuncs ...Option) stats.Handler {
+	otgrpcOpts := newOptions()
+	otgrpcOpts.apply(optFuncs...)
+	return &tracingStatsHandler{tracer: tracer, otgrpcOpts: otgrpcOpts, client: true}
+}
+
+type tracingStatsHandler struct {
+	tracer     opentracing.Tracer
+	otgrpcOpts *options
+	client     bool
+}
+
+func (h *tracingStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	if h.otgrpcOpts.tracingDisabled() {
+		return ctx
+	}
+	start := time.Now()
+	method := info.FullMethodName
+	otgrpcOpts := h.otgrpcOpts.forMethod(method)
+	tracer := otgrpcOpts.callTracer(ctx, h.tracer, method)
+	var span opentracing.Span
+	if h.client {
+		var parentCtx opentracing.SpanContext
+		if parent := opentracing.SpanFromContext(ctx); parent != nil {
+			parentCtx = parent.Context()
+		}
+		if otgrpcOpts.unsampledParent(parentCtx) {
+			return injectUnsampledParent(ctx, tracer, parentCtx, method, otgrpcOpts)
+		}
+		if !otgrpcOpts.include(parentCtx, method, nil, nil, nil) {
+			return ctx
+		}
+		span = otgrpcOpts.startRPCSpan(
+			parentCtx,
+			tracer,
+			otgrpcOpts.operationName(method),
+			clientSpanReference(parentCtx, otgrpcOpts),
+			ext.SpanKindRPCClient,
+			otgrpcOpts.componentTag(),
+		)
+		otgrpcOpts.setStaticTags(span)
+		ctx = injectSpanContext(ctx, tracer, span, method, otgrpcOpts)
+	} else {
+		spanContext, err := extractSpanContext(ctx, tracer, method, otgrpcOpts)
+		if err != nil && err != opentracing.ErrSpanContextNotFound {
+			otgrpcOpts.reportExtractError(err, method)
+		}
+		if err == nil {
+			ctx = context.WithValue(ctx, ParentSpanContextKey{}, spanContext)
+		}
+		parentCtx, spanOption := serverSpanParent(ctx, spanContext, err, otgrpcOpts)
+		if otgrpcOpts.unsampledParent(parentCtx) {
+			return withUnsampledParent(ctx, tracer, parentCtx)
+		}
+		if !otgrpcOpts.include(parentCtx, method, nil, nil, err) ||
+			!otgrpcOpts.includeMetadata(ctx, method) {
+			return ctx
+		}
+		span = otgrpcOpts.startRPCSpan(
+			parentCtx,
+			tracer,
+			otgrpcOpts.operationName(method),
+			spanOption,
+			otgrpcOpts.componentTag(),
+		)
+		otgrpcOpts.setStaticTags(span)
+		if otgrpcOpts.parentPresenceTag {
+			setParentPresenceTag(span, spanContext, err)
+		}
+		setPeerTags(span, ctx)
+		if otgrpcOpts.deadlineTag {
+			setDeadlineTag(span, ctx)
+		}
+		ctx = opentracing.ContextWithSpan(ctx, span)
+		ctx = contextWithBaggage(ctx, span, otgrpcOpts.baggageToContext)
+	}
+	if otgrpcOpts.tagServiceMethod {
+		setServiceMethodTags(span, method)
+	}
+	return context.WithValue(ctx, statsRPCKey{}, &statsRPC{
+		span:       span,
+		method:     method,
+		otgrpcOpts: otgrpcOpts,
+		start:      start,
+	})
+}
+
+func (h *tracingStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	rpc, ok := ctx.Value(statsRPCKey{}).(*statsRPC)
+	if !ok {
+		return
+	}
+	// Clients send requests, servers send responses.
+	sentPayload, receivedPayload := ResponsePayload, RequestPayload
+	if h.client {
+		sentPayload, receivedPayload = RequestPayload, ResponsePayload
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		if s.IsClientStream || s.IsServerStream {
+			atomic.StoreUint32(&rpc.isStream, 1)
+		}
+		if s.IsTransparentRetryAttempt {
+			rpc.span.SetTag("grpc.transparent_retry", true)
+		}
+	case *stats.InHeader:
+		if h.client {
+			rpc.span.LogFields(log.String("event", "headers.received"))
+		}
+	case *stats.InPayload:
+		rpc.logMessage("message.received", receivedPayload, s.Payload, s.WireLength, s.Length)
+	case *stats.OutPayload:
+		rpc.logMessage("message.sent", sentPayload, s.Payload, s.WireLength, s.Length)
+	case *stats.End:
+		rpc.finish(ctx, s, h.client)
+	}
+}
+
+// logMessage logs a message sent or received on the RPC, along with its
+// sizes, and its payload if payloads are logged in its direction.
+func (rpc *statsRPC) logMessage(event string, direction PayloadDirection, payload interface{}, wireLength, length int) {
+	rpc.span.LogFields(
+		log.String("event", event),
+		log.Int("grpc.message.wire_length", wireLength),
+		log.Int("grpc.message.uncompressed_length", length),
+	)
+	logs := rpc.otgrpcOpts.logRequests
+	if direction == ResponsePayload {
+		logs = rpc.otgrpcOpts.logResponses
+	}
+	if logs && payload != nil {
+		logPayload(rpc.span, rpc.method, direction, payload, rpc.otgrpcOpts)
+	}
+}
+
+// finish finishes the span of the RPC, which ended as end describes.
+func (rpc *statsRPC) finish(ctx context.Context, end *stats.End, client bool) {
+	otgrpcOpts := rpc.otgrpcOpts
+	setCodeTag(rpc.span, end.Error)
+	if end.Error != nil && otgrpcOpts.logError {
+		setErrorTags(rpc.span, end.Error, client, otgrpcOpts)
+		rpc.span.LogFields(log.String("event", "error"), log.String("message", end.Error.Error()))
+	}
+	otgrpcOpts.decorate(ctx, rpc.span, rpc.method, nil, nil, end.Error)
+	otgrpcOpts.observeMetrics(rpc.method, end.Error, rpc.start, atomic.LoadUint32(&rpc.isStream) != 0)
+	if end.EndTime.IsZero() {
+		rpc.span.Finish()
+		return
+	}
+	rpc.span.FinishWithOptions(opentracing.FinishOptions{FinishTime: end.EndTime})
+}
+
+func (h *tracingStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *tracingStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
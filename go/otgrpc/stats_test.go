@@ -0,0 +1,265 @@
+package otgrpc
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// serveBufconn starts a server with serverOpts and services on a bufconn
+// listener, handling the methods of other services with handler, and returns
+// the listener. It is stopped when the test ends.
+func serveBufconn(t *testing.T, handler grpc.StreamHandler, serverOpts []grpc.ServerOption, services ...*grpc.ServiceDesc) *bufconn.Listener {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(append(serverOpts, grpc.UnknownServiceHandler(handler))...)
+	for _, service := range services {
+		srv.RegisterService(service, struct{}{})
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis
+}
+
+// dialBufconn returns a connection to lis, dialed with dialOpts, which may
+// replace its dialer. It is closed when the test ends.
+func dialBufconn(t *testing.T, lis *bufconn.Listener, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	cc, err := grpc.Dial("bufnet", append([]grpc.DialOption{grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		})}, dialOpts...)...)
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+// unaryService is the "pkg.Unary" service, whose "Method" method is handled
+// by handler through the unary interceptor of the server.
+func unaryService(handler grpc.UnaryHandler) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "pkg.Unary",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Method",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &emptypb.Empty{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Unary/Method"}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		}},
+	}
+}
+
+// echoMessageHandler echoes a single message.
+func echoMessageHandler(srv interface{}, ss grpc.ServerStream) error {
+	msg := &wrapperspb.StringValue{}
+	if err := ss.RecvMsg(msg); err != nil {
+		return err
+	}
+	return ss.SendMsg(msg)
+}
+
+// statsEchoConn starts a server whose every method echoes a single message,
+// and returns a connection to it. It is stopped when the test ends.
+func statsEchoConn(t *testing.T, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	return dialBufconn(t, serveBufconn(t, echoMessageHandler, serverOpts), dialOpts...)
+}
+
+// waitForSpans waits for tracer to have n finished spans and returns them,
+// sorted with less.
+func waitForSpans(t *testing.T, tracer *mocktracer.MockTracer, n int, less func(a, b *mocktracer.MockSpan) bool) []*mocktracer.MockSpan {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracer.FinishedSpans()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != n {
+		t.Fatalf("Incorrect span length")
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return less(spans[i], spans[j]) })
+	return spans
+}
+
+// clientSpanFirst orders client spans before the others.
+func clientSpanFirst(a, b *mocktracer.MockSpan) bool {
+	return a.Tag(string(ext.SpanKind)) == ext.SpanKindRPCClientEnum &&
+		b.Tag(string(ext.SpanKind)) != ext.SpanKindRPCClientEnum
+}
+
+// bySpanID orders spans by span ID, i.e. in the order they were started.
+func bySpanID(a, b *mocktracer.MockSpan) bool {
+	return a.SpanContext.SpanID < b.SpanContext.SpanID
+}
+
+func TestClientStatsHandlerWithServerInterceptor(t *testing.T) {
+	tracer := mocktracer.New()
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StreamInterceptor(OpenTracingStreamServerInterceptor(tracer))},
+		grpc.WithStatsHandler(NewClientStatsHandler(tracer, LogPayloads())))
+
+	req := wrapperspb.String("hello")
+	err := cc.Invoke(context.Background(), "/pkg.Service/Method", req, &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	client, server := spans[0], spans[1]
+	assert.Equal(t, "/pkg.Service/Method", client.OperationName)
+	assert.Equal(t, client.SpanContext.TraceID, server.SpanContext.TraceID)
+	assert.Equal(t, client.SpanContext.SpanID, server.ParentID)
+	assert.Equal(t, ext.SpanKindRPCServerEnum, server.Tag(string(ext.SpanKind)))
+	assert.Equal(t, codes.OK.String(), client.Tag("grpc.code"))
+
+	var events []string
+	for _, record := range client.Logs() {
+		fields := map[string]string{}
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+		event := fields["event"]
+		if event == "message.sent" || event == "message.received" {
+			// The wire length includes the 5-byte gRPC message header.
+			assert.Equal(t, strconv.Itoa(proto.Size(req)), fields["grpc.message.uncompressed_length"])
+			assert.Equal(t, strconv.Itoa(proto.Size(req)+5), fields["grpc.message.wire_length"])
+		}
+		if event != "" {
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, []string{"message.sent", "headers.received", "message.received"}, events)
+	assert.Contains(t, logFields(client), "gRPC request")
+	assert.Contains(t, logFields(client), "gRPC response")
+}
+
+func TestServerStatsHandlerWithClientInterceptor(t *testing.T) {
+	tracer := mocktracer.New()
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StatsHandler(NewServerStatsHandler(tracer, TagServiceMethod(), WithParentPresenceTag()))},
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer)))
+
+	err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	client, server := spans[0], spans[1]
+	assert.Equal(t, client.SpanContext.TraceID, server.SpanContext.TraceID)
+	assert.Equal(t, client.SpanContext.SpanID, server.ParentID)
+	assert.Equal(t, "pkg.Service", server.Tag("grpc.service"))
+	assert.Equal(t, true, server.Tag("grpc.has_parent"))
+	assert.Equal(t, codes.OK.String(), server.Tag("grpc.code"))
+	assert.Equal(t, "bufconn", server.Tag("peer.address"))
+	assert.Equal(t, "message.sent", logFields(server)["event"])
+}
+
+// localSpanStatsHandler is a stats.Handler putting span in the context of
+// RPCs, standing for a local parent.
+type localSpanStatsHandler struct {
+	span opentracing.Span
+}
+
+func (h localSpanStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return opentracing.ContextWithSpan(ctx, h.span)
+}
+
+func (localSpanStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {}
+
+func (localSpanStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (localSpanStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+func TestServerStatsHandlerLocalParentPreference(t *testing.T) {
+	tracer := mocktracer.New()
+	local := tracer.StartSpan("local")
+	for _, tc := range []struct {
+		optFuncs    []Option
+		localParent bool
+	}{
+		{[]Option{WithLocalParentPreference()}, true},
+		{nil, false},
+	} {
+		tracer.Reset()
+		cc := statsEchoConn(t,
+			[]grpc.ServerOption{
+				grpc.StatsHandler(localSpanStatsHandler{local}),
+				grpc.StatsHandler(NewServerStatsHandler(tracer, tc.optFuncs...)),
+			},
+			grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer)))
+		err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+		assert.NoError(t, err)
+
+		spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+		client, server := spans[0], spans[1]
+		if tc.localParent {
+			assert.Equal(t, local.Context().(mocktracer.MockSpanContext).SpanID, server.ParentID)
+		} else {
+			assert.Equal(t, client.SpanContext.SpanID, server.ParentID)
+		}
+	}
+}
+
+func TestStatsHandlerError(t *testing.T) {
+	tracer := mocktracer.New()
+	var observed []codes.Code
+	observer := func(method string, code codes.Code, duration time.Duration, isStream bool) {
+		observed = append(observed, code)
+	}
+	cc := statsEchoConn(t, nil,
+		grpc.WithStatsHandler(NewClientStatsHandler(tracer, LogError(), WithMetricsObserver(observer))))
+
+	// The server expects a single message from unary calls.
+	cs, err := cc.NewStream(context.Background(), &grpc.StreamDesc{ClientStreams: true}, "/pkg.Service/Method")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	assert.NoError(t, cs.CloseSend())
+	assert.Error(t, cs.RecvMsg(&wrapperspb.StringValue{}))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Incorrect span length")
+	}
+	assert.Equal(t, true, spans[0].Tag(string(ext.Error)))
+	assert.Equal(t, "error", logFields(spans[0])["event"])
+	assert.Len(t, observed, 1)
+}
+
+func TestStatsHandlerExcluded(t *testing.T) {
+	tracer := mocktracer.New()
+	cc := statsEchoConn(t,
+		[]grpc.ServerOption{grpc.StatsHandler(NewServerStatsHandler(tracer, IncludingSpans(ExcludeMethods("/pkg.Service/Method"))))},
+		grpc.WithStatsHandler(NewClientStatsHandler(tracer, IncludingSpans(ExcludeMethods("/pkg.Service/Method")))))
+
+	err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+	err = cc.Invoke(context.Background(), "/pkg.Service/Other", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+
+	spans := waitForSpans(t, tracer, 2, clientSpanFirst)
+	for _, span := range spans {
+		assert.Equal(t, "/pkg.Service/Other", span.OperationName)
+	}
+}
@@ -0,0 +1,64 @@
+package otgrpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+type callTimingKey struct{}
+
+// callTiming is the client span of a call whose timing is tagged.
+type callTiming struct {
+	span  opentracing.Span
+	start time.Time
+	// sent is set to 1, atomically, once the headers of the call were sent.
+	sent uint32
+}
+
+// withCallTiming returns a copy of ctx through which ClientTimingStatsHandler
+// can find clientSpan, the span of a client call started at start.
+func withCallTiming(ctx context.Context, clientSpan opentracing.Span, start time.Time) context.Context {
+	return context.WithValue(ctx, callTimingKey{}, &callTiming{span: clientSpan, start: start})
+}
+
+// setTotalTag tags clientSpan with the milliseconds elapsed since start, the
+// start of its call.
+func setTotalTag(clientSpan opentracing.Span, start time.Time) {
+	clientSpan.SetTag("grpc.total_ms", time.Since(start).Milliseconds())
+}
+
+// ClientTimingStatsHandler returns a stats.Handler that tags the client spans
+// of calls made with WithClientTimingTags with the time they waited for a
+// connection. It ignores RPCs whose client interceptor was not given that
+// Option.
+func ClientTimingStatsHandler() stats.Handler {
+	return clientTimingStatsHandler{}
+}
+
+type clientTimingStatsHandler struct{}
+
+func (clientTimingStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (clientTimingStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	timing, ok := ctx.Value(callTimingKey{}).(*callTiming)
+	if !ok {
+		return
+	}
+	// The headers are sent once the call is on a ready connection; only the
+	// first attempt counts.
+	if _, ok := s.(*stats.OutHeader); ok && atomic.CompareAndSwapUint32(&timing.sent, 0, 1) {
+		timing.span.SetTag("grpc.wait_ms", time.Since(timing.start).Milliseconds())
+	}
+}
+
+func (clientTimingStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (clientTimingStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
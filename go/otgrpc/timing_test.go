@@ -0,0 +1,58 @@
+package otgrpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestClientTimingTags(t *testing.T) {
+	tracer := mocktracer.New()
+	const dialDelay = 50 * time.Millisecond
+	lis := serveBufconn(t,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			time.Sleep(dialDelay)
+			return echoMessageHandler(srv, ss)
+		}, nil)
+
+	// The connection is only ready after a while.
+	cc := dialBufconn(t, lis,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			time.Sleep(dialDelay)
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithUnaryInterceptor(OpenTracingClientInterceptor(tracer, WithClientTimingTags())),
+		grpc.WithStreamInterceptor(OpenTracingStreamClientInterceptor(tracer, WithClientTimingTags())),
+		grpc.WithStatsHandler(ClientTimingStatsHandler()))
+
+	err := cc.Invoke(context.Background(), "/pkg.Service/Method", wrapperspb.String("hello"), &wrapperspb.StringValue{})
+	assert.NoError(t, err)
+	cs, err := cc.NewStream(context.Background(), &grpc.StreamDesc{}, "/pkg.Service/Stream")
+	if err != nil {
+		t.Fatalf("NewStream = %v", err)
+	}
+	assert.NoError(t, cs.SendMsg(wrapperspb.String("hello")))
+	assert.NoError(t, cs.RecvMsg(&wrapperspb.StringValue{}))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Incorrect span length")
+	}
+	unary, stream := spans[0], spans[1]
+	unaryWait, unaryTotal := unary.Tag("grpc.wait_ms").(int64), unary.Tag("grpc.total_ms").(int64)
+	assert.GreaterOrEqual(t, unaryWait, dialDelay.Milliseconds())
+	// The handler adds up to the total, not to the wait.
+	assert.GreaterOrEqual(t, unaryTotal, unaryWait+dialDelay.Milliseconds())
+	// The connection is ready for the second call.
+	streamWait, streamTotal := stream.Tag("grpc.wait_ms").(int64), stream.Tag("grpc.total_ms").(int64)
+	assert.Less(t, streamWait, dialDelay.Milliseconds())
+	assert.GreaterOrEqual(t, streamTotal, dialDelay.Milliseconds())
+
+}
@@ -0,0 +1,33 @@
+package otgrpc
+
+import "sync/atomic"
+
+// TracingToggle switches the tracing of the interceptors it is bound to with
+// WithTracingToggle off and on at runtime, e.g. to shed load during an
+// incident. While disabled, the interceptors pass RPCs through untraced; RPCs
+// already in flight are traced to the end.
+//
+// A TracingToggle is enabled when created and is safe for concurrent use.
+type TracingToggle struct {
+	disabled int32
+}
+
+// NewTracingToggle returns an enabled TracingToggle.
+func NewTracingToggle() *TracingToggle {
+	return &TracingToggle{}
+}
+
+// Enable switches tracing on.
+func (t *TracingToggle) Enable() {
+	atomic.StoreInt32(&t.disabled, 0)
+}
+
+// Disable switches tracing off.
+func (t *TracingToggle) Disable() {
+	atomic.StoreInt32(&t.disabled, 1)
+}
+
+// Enabled reports whether tracing is switched on.
+func (t *TracingToggle) Enabled() bool {
+	return atomic.LoadInt32(&t.disabled) == 0
+}
@@ -0,0 +1,124 @@
+package otgrpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestTracingToggle(t *testing.T) {
+	tracer := mocktracer.New()
+	toggle := NewTracingToggle()
+	run := func() {
+		ctx := context.Background()
+		_, err := OpenTracingServerInterceptor(tracer, WithTracingToggle(toggle))(ctx, nil, unaryInfo, echoHandler)
+		assert.NoError(t, err)
+		err = OpenTracingStreamServerInterceptor(tracer, WithTracingToggle(toggle))(nil, &fakeServerStream{ctx: ctx}, streamInfo, echoStreamHandler)
+		assert.NoError(t, err)
+		err = OpenTracingClientInterceptor(tracer, WithTracingToggle(toggle))(ctx, "/pkg.Service/Method", nil, nil, nil, fakeInvoker)
+		assert.NoError(t, err)
+		cs, err := OpenTracingStreamClientInterceptor(tracer, WithTracingToggle(toggle))(ctx, &grpc.StreamDesc{}, nil, "/pkg.Service/Method", fakeStreamer)
+		assert.NoError(t, err)
+		if otcs, ok := cs.(*openTracingClientStream); ok {
+			otcs.finishFunc(nil)
+		}
+	}
+
+	assert.True(t, toggle.Enabled())
+	run()
+	assert.Len(t, tracer.FinishedSpans(), 4)
+
+	tracer.Reset()
+	toggle.Disable()
+	assert.False(t, toggle.Enabled())
+	run()
+	assert.Empty(t, tracer.FinishedSpans())
+
+	toggle.Enable()
+	run()
+	assert.Len(t, tracer.FinishedSpans(), 4)
+}
+
+func TestTracingToggleConcurrent(t *testing.T) {
+	tracer := mocktracer.New()
+	toggle := NewTracingToggle()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(ServerOptions(tracer, WithTracingToggle(toggle))...)
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "pkg.Service",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Unary",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &emptypb.Empty{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/pkg.Service/Unary"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return &emptypb.Empty{}, nil
+				})
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	dialOpts := append(DialOptions(tracer, WithTracingToggle(toggle)), grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	cc, err := grpc.Dial("bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer cc.Close()
+
+	// Flip the toggle while RPCs are in flight.
+	done := make(chan struct{})
+	flipped := make(chan struct{})
+	go func() {
+		defer close(flipped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				toggle.Disable()
+			} else {
+				toggle.Enable()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := cc.Invoke(context.Background(), "/pkg.Service/Unary", &emptypb.Empty{}, &emptypb.Empty{})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-flipped
+
+	assert.True(t, len(tracer.FinishedSpans()) <= 2*8*50)
+	toggle.Enable()
+	tracer.Reset()
+	err = cc.Invoke(context.Background(), "/pkg.Service/Unary", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.NoError(t, err)
+	assert.Len(t, tracer.FinishedSpans(), 2)
+}